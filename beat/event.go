@@ -1,5 +1,7 @@
 package beat
 
+import "time"
+
 // Event a single event in redis sent by filebeat
 type Event struct {
 	Beat struct {
@@ -11,6 +13,22 @@ type Event struct {
 		Module string `json:"module"`
 		Name   string `json:"name"`
 	} `json:"fileset"` // contains module, name
+	Timestamp  time.Time `json:"@timestamp"` // time when filebeat read the line
+	Kubernetes struct {
+		Namespace string `json:"namespace"`
+		Pod       struct {
+			Name string `json:"name"`
+		} `json:"pod"`
+		Container struct {
+			Name  string `json:"name"`
+			Image string `json:"image"`
+		} `json:"container"`
+		Node struct {
+			Name string `json:"name"`
+		} `json:"node"`
+		Labels      map[string]interface{} `json:"labels"`
+		Annotations map[string]interface{} `json:"annotations"`
+	} `json:"kubernetes"` // contains kubernetes metadata, added by filebeat 'add_kubernetes_metadata'
 }
 
 type PartialEvent struct {
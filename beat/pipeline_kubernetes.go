@@ -0,0 +1,180 @@
+package beat
+
+import (
+	"github.com/logtube/logtubed/types"
+	"strings"
+	"time"
+)
+
+/*
+
+Pipeline Kubernetes:
+
+Filebeat with 'add_kubernetes_metadata' attaches namespace, pod, container, labels and annotations to each event,
+env / project / topic are resolved by rules in order, falling back to the path convention of Pipeline Logtube
+
+Rules:
+
+  annotation:logtube.io/env   value of annotation 'logtube.io/env'
+  label:app                   value of label 'app'
+  namespace                   namespace name
+  pod                         pod name
+  container                   container name
+
+*/
+
+const (
+	KubernetesRuleAnnotation = "annotation:"
+	KubernetesRuleLabel      = "label:"
+	KubernetesRuleNamespace  = "namespace"
+	KubernetesRulePod        = "pod"
+	KubernetesRuleContainer  = "container"
+)
+
+var (
+	// container stdout logs, path convention is not applicable
+	kubernetesContainerLogDirs = []string{"/var/lib/docker/containers/", "/var/log/containers/", "/var/log/pods/"}
+
+	kubernetesDefaultEnvRules     = []string{"annotation:logtube.io/env", "label:logtube.io/env"}
+	kubernetesDefaultProjectRules = []string{"annotation:logtube.io/project", "label:logtube.io/project", "label:app"}
+	kubernetesDefaultTopicRules   = []string{"annotation:logtube.io/topic", "label:logtube.io/topic"}
+)
+
+type KubernetesPipelineOptions struct {
+	EnvRules          []string
+	ProjectRules      []string
+	TopicRules        []string
+	DefaultTopic      string
+	DefaultTimeOffset int
+}
+
+func NewKubernetesPipeline(opts KubernetesPipelineOptions) Pipeline {
+	if len(opts.EnvRules) == 0 {
+		opts.EnvRules = kubernetesDefaultEnvRules
+	}
+	if len(opts.ProjectRules) == 0 {
+		opts.ProjectRules = kubernetesDefaultProjectRules
+	}
+	if len(opts.TopicRules) == 0 {
+		opts.TopicRules = kubernetesDefaultTopicRules
+	}
+	if len(opts.DefaultTopic) == 0 {
+		opts.DefaultTopic = "info"
+	}
+	return &kubernetesPipeline{opts: opts}
+}
+
+type kubernetesPipeline struct {
+	opts KubernetesPipelineOptions
+}
+
+func (k *kubernetesPipeline) Name() string {
+	return "kubernetes"
+}
+
+func (k *kubernetesPipeline) Match(b Event) bool {
+	return b.Kubernetes.Namespace != "" && b.Kubernetes.Pod.Name != ""
+}
+
+func (k *kubernetesPipeline) Process(b Event, r *types.Event) (ok bool) {
+	// container hostname is the pod name
+	r.Hostname = b.Kubernetes.Pod.Name
+	// resolve env, project, topic from metadata
+	r.Env = resolveKubernetesRules(b, k.opts.EnvRules)
+	r.Project = resolveKubernetesRules(b, k.opts.ProjectRules)
+	r.Topic = resolveKubernetesRules(b, k.opts.TopicRules)
+	// fallback to path convention
+	if (r.Env == "" || r.Project == "" || r.Topic == "") && !isKubernetesContainerLog(b.Source) {
+		var s types.Event
+		if decodeLogtubeBeatSource(b.Source, &s) {
+			if r.Env == "" {
+				r.Env = s.Env
+			}
+			if r.Project == "" {
+				r.Project = s.Project
+			}
+			if r.Topic == "" {
+				r.Topic = s.Topic
+			}
+		}
+	}
+	if r.Env == "" || r.Project == "" {
+		return
+	}
+	if r.Topic == "" {
+		r.Topic = k.opts.DefaultTopic
+	}
+	// decode message, fallback to plain message with filebeat timestamp, i.e. stdout of container
+	if !DecodeLogtubeMessage(b.Message, k.opts.DefaultTimeOffset, r) {
+		r.Timestamp = b.Timestamp
+		if r.Timestamp.IsZero() {
+			r.Timestamp = time.Now()
+		}
+		r.Crid = ""
+		r.Keyword = ""
+		r.Extra = nil
+		extractMessage(r, []byte(strings.TrimSpace(b.Message)))
+	}
+	// enrich metadata
+	if r.Extra == nil {
+		r.Extra = map[string]interface{}{}
+	}
+	r.Extra["k8s_namespace"] = b.Kubernetes.Namespace
+	r.Extra["k8s_pod"] = b.Kubernetes.Pod.Name
+	if b.Kubernetes.Container.Name != "" {
+		r.Extra["k8s_container"] = b.Kubernetes.Container.Name
+	}
+	if b.Kubernetes.Node.Name != "" {
+		r.Extra["k8s_node"] = b.Kubernetes.Node.Name
+	}
+	ok = true
+	return
+}
+
+func isKubernetesContainerLog(source string) bool {
+	for _, dir := range kubernetesContainerLogDirs {
+		if strings.HasPrefix(source, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveKubernetesRules(b Event, rules []string) string {
+	for _, rule := range rules {
+		var val string
+		rule = strings.TrimSpace(rule)
+		switch {
+		case strings.HasPrefix(rule, KubernetesRuleAnnotation):
+			val = lookupKubernetesMeta(b.Kubernetes.Annotations, rule[len(KubernetesRuleAnnotation):])
+		case strings.HasPrefix(rule, KubernetesRuleLabel):
+			val = lookupKubernetesMeta(b.Kubernetes.Labels, rule[len(KubernetesRuleLabel):])
+		case rule == KubernetesRuleNamespace:
+			val = b.Kubernetes.Namespace
+		case rule == KubernetesRulePod:
+			val = b.Kubernetes.Pod.Name
+		case rule == KubernetesRuleContainer:
+			val = b.Kubernetes.Container.Name
+		}
+		if val = strings.TrimSpace(val); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// lookupKubernetesMeta lookup labels or annotations, filebeat may nest keys containing dots if dedot is disabled
+func lookupKubernetesMeta(m map[string]interface{}, key string) string {
+	if m == nil || key == "" {
+		return ""
+	}
+	if val, ok := m[key].(string); ok {
+		return val
+	}
+	if i := strings.Index(key, "."); i > 0 {
+		if sub, ok := m[key[:i]].(map[string]interface{}); ok {
+			return lookupKubernetesMeta(sub, key[i+1:])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+package beat
+
+import (
+	"encoding/json"
+	"github.com/logtube/logtubed/types"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestKubernetesPipeline_Process(t *testing.T) {
+	p := NewKubernetesPipeline(KubernetesPipelineOptions{})
+
+	var b Event
+	err := json.Unmarshal([]byte(`{
+		"@timestamp": "2020-08-14T11:09:21.727Z",
+		"beat": {"hostname": "filebeat-x8k2d"},
+		"source": "/var/lib/docker/containers/abcd/abcd-json.log",
+		"message": "[2020-08-14 19:09:21.727 +0800] [{\"c\":\"995799fb55e0d7ee\",\"k\":\"hello\"}] message body",
+		"kubernetes": {
+			"namespace": "shop",
+			"pod": {"name": "ms-order-7d9f8-x2x1k"},
+			"container": {"name": "ms-order"},
+			"node": {"name": "node-1"},
+			"labels": {"app": "ms-order"},
+			"annotations": {"logtube": {"io/env": "prod"}}
+		}
+	}`), &b)
+	require.NoError(t, err)
+	require.True(t, p.Match(b))
+
+	var e types.Event
+	require.True(t, p.Process(b, &e))
+	require.Equal(t, "prod", e.Env)
+	require.Equal(t, "ms-order", e.Project)
+	require.Equal(t, "info", e.Topic)
+	require.Equal(t, "ms-order-7d9f8-x2x1k", e.Hostname)
+	require.Equal(t, "995799fb55e0d7ee", e.Crid)
+	require.Equal(t, "message body", e.Message)
+	require.Equal(t, "shop", e.Extra["k8s_namespace"])
+	require.Equal(t, "node-1", e.Extra["k8s_node"])
+}
+
+func TestKubernetesPipeline_Fallback(t *testing.T) {
+	p := NewKubernetesPipeline(KubernetesPipelineOptions{
+		EnvRules:     []string{"label:env", "namespace"},
+		ProjectRules: []string{"label:project"},
+		TopicRules:   []string{"annotation:topic"},
+	})
+
+	var b Event
+	b.Timestamp = time.Unix(1597403361, 0)
+	b.Source = "/var/log/logtube-logs/prod/x-redis-track/ms-order.log"
+	b.Message = "CRID[abcd] plain stdout line"
+	b.Kubernetes.Namespace = "staging"
+	b.Kubernetes.Pod.Name = "ms-order-7d9f8-x2x1k"
+
+	var e types.Event
+	require.True(t, p.Process(b, &e))
+	require.Equal(t, "staging", e.Env)
+	require.Equal(t, "ms-order", e.Project)
+	require.Equal(t, "x-redis-track", e.Topic)
+	require.Equal(t, "abcd", e.Crid)
+	require.Equal(t, "CRID[abcd] plain stdout line", e.Message)
+	require.True(t, e.Timestamp.Equal(b.Timestamp))
+
+	b.Source = "/var/lib/docker/containers/abcd/abcd-json.log"
+	e = types.Event{}
+	require.False(t, p.Process(b, &e))
+
+	b.Kubernetes.Namespace = ""
+	require.False(t, p.Match(b))
+}
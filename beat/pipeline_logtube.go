@@ -50,23 +50,27 @@ func (l *logtubePipeline) Process(b Event, r *types.Event) (ok bool) {
 	if ok = decodeLogtubeBeatSource(b.Source, r); !ok {
 		return
 	}
+	// decode message field
+	ok = DecodeLogtubeMessage(b.Message, l.opts.DefaultTimeOffset, r)
+	return
+}
+
+// DecodeLogtubeMessage decode a V1 or V2 Logtube message into r, env, topic and project are not touched
+func DecodeLogtubeMessage(raw string, defaultTimeOffset int, r *types.Event) (ok bool) {
 	// trim message
-	b.Message = strings.TrimSpace(b.Message)
+	raw = strings.TrimSpace(raw)
 	// detect v2 message
-	if isLogtubeV2Message(b.Message) {
+	if isLogtubeV2Message(raw) {
 		// decode v2 message field
-		if ok = decodeLogtubeV2BeatMessage(b.Message, r); !ok {
-			return
-		}
-	} else {
-		// decode v1 message field
-		var noOffset bool
-		if noOffset, ok = decodeLogtubeV1Message(b.Message, strings.Contains(r.Topic, "_json_"), r); !ok {
-			return
-		}
-		if !noOffset {
-			r.Timestamp = r.Timestamp.Add(time.Hour * time.Duration(l.opts.DefaultTimeOffset))
-		}
+		return decodeLogtubeV2BeatMessage(raw, r)
+	}
+	// decode v1 message field
+	var noOffset bool
+	if noOffset, ok = decodeLogtubeV1Message(raw, strings.Contains(r.Topic, "_json_"), r); !ok {
+		return
+	}
+	if !noOffset {
+		r.Timestamp = r.Timestamp.Add(time.Hour * time.Duration(defaultTimeOffset))
 	}
 	return
 }
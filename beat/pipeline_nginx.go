@@ -4,13 +4,42 @@ import (
 	"github.com/guoyk93/compactkv"
 	"github.com/logtube/logtubed/types"
 	"github.com/rs/zerolog/log"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
+/*
+
+Pipeline Nginx Access:
+
+compactkv: [2020-03-11T20:05:34+08:00] r=GET / HTTP/1.1|ra=::1|urt=0.010, 0.200|s=200
+combined:  127.0.0.1 - - [11/Mar/2020:20:05:34 +0800] "GET / HTTP/1.1" 200 612 "-" "curl/7.64.1"
+main:      127.0.0.1 - - [11/Mar/2020:20:05:34 +0800] "GET / HTTP/1.1" 200 612 "-" "curl/7.64.1" "-"
+
+*/
+
 const (
-	// decode nginx $time_iso8601 '11/Mar/2020:19:03:53 +0800'
+	// decode nginx $time_iso8601 '2020-03-11T19:03:53+08:00'
 	ngxFormatISO8601 = `2006-01-02T15:04:05-07:00`
+	// decode nginx $time_local '11/Mar/2020:19:03:53 +0800'
+	ngxFormatLocal = `02/Jan/2006:15:04:05 -0700`
+)
+
+const (
+	NginxFormatAuto      = "auto"
+	NginxFormatCompactKV = "compactkv"
+	NginxFormatCombined  = "combined"
+	NginxFormatMain      = "main"
+)
+
+const (
+	NginxTypeString  = "string"
+	NginxTypeInteger = "integer"
+	NginxTypeFloat   = "float"
+	// NginxTypeSeconds float seconds, translated to integer milliseconds
+	NginxTypeSeconds = "seconds"
 )
 
 var (
@@ -29,39 +58,80 @@ var (
 		"p":    "project",
 		"e":    "env",
 	}
-	ngxTagTypes = map[string]compactkv.ValueType{
-		"bbs": compactkv.IntegerType,
-		"rt":  compactkv.FloatType,
-		"s":   compactkv.IntegerType,
-		"urt": compactkv.FloatType,
+	ngxTagTypes = map[string]string{
+		"bbs": NginxTypeInteger,
+		"rt":  NginxTypeSeconds,
+		"s":   NginxTypeInteger,
+		"urt": NginxTypeSeconds,
 	}
-	ngxVarsUnderSecond = map[string]bool{
-		"request_time":           true,
-		"upstream_response_time": true,
+	ngxTagMultis = map[string]bool{
+		"ua":  true,
+		"urt": true,
 	}
 	ngxVarRequest = "request"
 	ngxVarProject = "project"
 	ngxVarEnv     = "env"
+
+	// suffix for the array of a multi-value variable, i.e. 'upstream_response_time_list'
+	ngxSuffixList = "_list"
 )
 
 var (
-	nginxCompactKV = compactkv.NewCompactKV()
+	// $remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" ["$http_x_forwarded_for"]
+	ngxPatternCombined = regexp.MustCompile(`^(?P<remote_addr>\S+) - (?P<remote_user>\S+) \[(?P<time_local>[^]]+)] "(?P<request>[^"]*)" (?P<status>\d+) (?P<body_bytes_sent>\d+|-) "(?P<http_referer>[^"]*)" "(?P<http_user_agent>[^"]*)"(?: "(?P<http_x_forwarded_for>[^"]*)")?`)
 )
 
-func init() {
-	for tag, name := range ngxTagNames {
-		nginxCompactKV.Add(tag, name, ngxTagTypes[tag])
-	}
+// NginxTag a compactkv tag in nginx log_format, for example 'urt=$upstream_response_time'
+type NginxTag struct {
+	Tag   string // tag in log_format, i.e. 'urt'
+	Name  string // nginx variable name, i.e. 'upstream_response_time'
+	Type  string // one of 'string', 'integer', 'float', 'seconds'
+	Multi bool   // value may contain multiple values separated by ', ' or ' : ', i.e. '0.010, 0.200'
 }
 
 type NginxPipelineOptions struct {
+	Format string
+	Tags   []NginxTag
 }
 
 func NewNginxPipeline(opts NginxPipelineOptions) Pipeline {
-	return &ngxPipeline{}
+	opts.Format = strings.ToLower(strings.TrimSpace(opts.Format))
+	if len(opts.Format) == 0 {
+		opts.Format = NginxFormatAuto
+	}
+	n := &ngxPipeline{
+		format: opts.Format,
+		ckv:    compactkv.NewCompactKV(),
+		types:  map[string]string{},
+		multis: map[string]bool{},
+	}
+	for tag, name := range ngxTagNames {
+		n.addTag(NginxTag{Tag: tag, Name: name, Type: ngxTagTypes[tag], Multi: ngxTagMultis[tag]})
+	}
+	for _, t := range opts.Tags {
+		n.addTag(t)
+	}
+	return n
 }
 
 type ngxPipeline struct {
+	format string
+
+	// all values are parsed as string by compactkv, converted later by variable name
+	ckv    *compactkv.CompactKV
+	types  map[string]string
+	multis map[string]bool
+}
+
+func (n *ngxPipeline) addTag(t NginxTag) {
+	t.Tag = strings.TrimSpace(t.Tag)
+	t.Name = strings.TrimSpace(t.Name)
+	if len(t.Tag) == 0 || len(t.Name) == 0 {
+		return
+	}
+	n.ckv.Add(t.Tag, t.Name, compactkv.StringType)
+	n.types[t.Name] = strings.ToLower(strings.TrimSpace(t.Type))
+	n.multis[t.Name] = t.Multi
 }
 
 func (n *ngxPipeline) Name() string {
@@ -82,48 +152,156 @@ func (n *ngxPipeline) Process(b Event, r *types.Event) (success bool) {
 		"file": b.Source,
 	}
 
-	// search for [...]
-	lb := strings.Index(b.Message, "[")
-	rb := strings.Index(b.Message, "]")
-	if lb < 0 || rb < 0 || lb > rb {
-		log.Debug().Int("lb", lb).Int("rb", rb).Msg("nginx_pipeline: invalid bucket location")
-		return
-	}
+	b.Message = strings.TrimSpace(b.Message)
 
-	// decode $time_iso8601
-	var err error
-	if r.Timestamp, err = time.Parse(ngxFormatISO8601, b.Message[lb+1:rb]); err != nil {
-		log.Debug().Err(err).Msg("nginx_pipeline: bad timestamp")
+	var m map[string]string
+	switch n.format {
+	case NginxFormatCompactKV:
+		m = n.parseCompactKV(b.Message, r)
+	case NginxFormatCombined, NginxFormatMain:
+		m = n.parseCombined(b.Message, r)
+	default:
+		if strings.HasPrefix(b.Message, "[") {
+			m = n.parseCompactKV(b.Message, r)
+		} else {
+			m = n.parseCombined(b.Message, r)
+		}
+	}
+	if m == nil {
 		return
 	}
 
-	// decode compact kv
-	m := nginxCompactKV.Parse(b.Message[rb+1:])
 	for k, v := range m {
-		if ngxVarsUnderSecond[k] {
-			// translate float seconds to integer milliseconds
-			if vFloat, ok := v.(float64); ok {
-				r.Extra[k] = int64(vFloat * 1000)
-			}
-		} else if k == ngxVarRequest {
+		if k == ngxVarRequest {
 			// decode $request
-			if request, ok := v.(string); ok {
-				splits := strings.SplitN(request, " ", 3)
-				if len(splits) == 3 {
-					r.Extra["method"] = splits[0]
-					r.Extra["path"] = splits[1]
-					r.Extra["protocol"] = splits[2]
-				}
+			splits := strings.SplitN(v, " ", 3)
+			if len(splits) == 3 {
+				r.Extra["method"] = splits[0]
+				r.Extra["path"] = splits[1]
+				r.Extra["protocol"] = splits[2]
 			}
 		} else if k == ngxVarProject {
-			r.Project, _ = v.(string)
+			r.Project = v
 		} else if k == ngxVarEnv {
-			r.Env, _ = v.(string)
+			r.Env = v
+		} else if n.multis[k] {
+			n.assignMulti(r.Extra, k, v)
 		} else {
-			r.Extra[k] = v
+			r.Extra[k] = convertNginxValue(n.types[k], v)
 		}
 	}
 
 	success = true
 	return
 }
+
+func (n *ngxPipeline) parseCompactKV(msg string, r *types.Event) map[string]string {
+	// search for [...]
+	lb := strings.Index(msg, "[")
+	rb := strings.Index(msg, "]")
+	if lb < 0 || rb < 0 || lb > rb {
+		log.Debug().Int("lb", lb).Int("rb", rb).Msg("nginx_pipeline: invalid bucket location")
+		return nil
+	}
+
+	// decode $time_iso8601
+	var err error
+	if r.Timestamp, err = time.Parse(ngxFormatISO8601, msg[lb+1:rb]); err != nil {
+		log.Debug().Err(err).Msg("nginx_pipeline: bad timestamp")
+		return nil
+	}
+
+	// decode compact kv
+	m := map[string]string{}
+	for k, v := range n.ckv.Parse(msg[rb+1:]) {
+		m[k], _ = v.(string)
+	}
+	return m
+}
+
+func (n *ngxPipeline) parseCombined(msg string, r *types.Event) map[string]string {
+	subs := ngxPatternCombined.FindStringSubmatch(msg)
+	if len(subs) == 0 {
+		log.Debug().Msg("nginx_pipeline: combined format not matched")
+		return nil
+	}
+
+	m := map[string]string{}
+	for i, name := range ngxPatternCombined.SubexpNames() {
+		if i == 0 || name == "" || subs[i] == "" {
+			continue
+		}
+		m[name] = subs[i]
+	}
+
+	// decode $time_local
+	var err error
+	if r.Timestamp, err = time.Parse(ngxFormatLocal, m["time_local"]); err != nil {
+		log.Debug().Err(err).Msg("nginx_pipeline: bad timestamp")
+		return nil
+	}
+	delete(m, "time_local")
+
+	// ignore empty values
+	for k, v := range m {
+		if v == "-" {
+			delete(m, k)
+		}
+	}
+	return m
+}
+
+// assignMulti assigns both the array and the aggregated value of a multi-value variable,
+// nginx separates upstream retries with ', ' and internal redirects with ' : '
+func (n *ngxPipeline) assignMulti(extra map[string]interface{}, name string, val string) {
+	typ := n.types[name]
+	splits := strings.Split(strings.ReplaceAll(val, " : ", ","), ",")
+	list := make([]interface{}, 0, len(splits))
+	for _, s := range splits {
+		if s = strings.TrimSpace(s); len(s) > 0 && s != "-" {
+			list = append(list, convertNginxValue(typ, s))
+		}
+	}
+	if len(list) == 0 {
+		extra[name] = convertNginxValue(typ, val)
+		return
+	}
+	extra[name+ngxSuffixList] = list
+	switch typ {
+	case NginxTypeSeconds:
+		// total milliseconds spent on all upstreams
+		var sum int64
+		for _, v := range list {
+			sum += v.(int64)
+		}
+		extra[name] = sum
+	case NginxTypeFloat:
+		var sum float64
+		for _, v := range list {
+			sum += v.(float64)
+		}
+		extra[name] = sum
+	case NginxTypeInteger:
+		// the last one, i.e. status of the final upstream
+		extra[name] = list[len(list)-1]
+	default:
+		extra[name] = val
+	}
+}
+
+func convertNginxValue(typ string, val string) interface{} {
+	switch typ {
+	case NginxTypeInteger:
+		valInt, _ := strconv.ParseInt(val, 10, 64)
+		return valInt
+	case NginxTypeFloat:
+		valFloat, _ := strconv.ParseFloat(val, 64)
+		return valFloat
+	case NginxTypeSeconds:
+		// translate float seconds to integer milliseconds
+		valFloat, _ := strconv.ParseFloat(val, 64)
+		return int64(valFloat * 1000)
+	default:
+		return val
+	}
+}
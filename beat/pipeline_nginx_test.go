@@ -31,10 +31,47 @@ func TestNginxPipeline_Format(t *testing.T) {
 }
 
 func TestDecodeNginxLog(t *testing.T) {
-	m := &ngxPipeline{}
+	m := NewNginxPipeline(NginxPipelineOptions{})
 	var event types.Event
 	event.Extra = map[string]interface{}{}
 	ok := m.Process(Event{Message: "[2020-03-11T20:05:34+08:00] r=GET /hello%20world HTTP/1.1|ra=::1|urt=-|bbs=209|hua=Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0.3987.132 Safari/537.36|hxff=-|s=404|ua=-|hh=localhost|hr=-|rt=0.000"}, &event)
 	log.Printf("%+v", event)
 	require.True(t, ok)
 }
+
+func TestDecodeNginxLog_Upstreams(t *testing.T) {
+	m := NewNginxPipeline(NginxPipelineOptions{
+		Tags: []NginxTag{
+			{Tag: "us", Name: "upstream_status", Type: NginxTypeInteger, Multi: true},
+			{Tag: "rid", Name: "request_id"},
+		},
+	})
+	var event types.Event
+	ok := m.Process(Event{Message: "[2020-03-11T20:05:34+08:00] r=GET /hello HTTP/1.1|urt=0.010, 0.200 : 0.005|ua=10.0.0.1:8080, 10.0.0.2:8080 : 10.0.0.3:8080|us=502, 502 : 200|rid=abcd|s=200"}, &event)
+	require.True(t, ok)
+	require.Equal(t, int64(215), event.Extra["upstream_response_time"])
+	require.Equal(t, []interface{}{int64(10), int64(200), int64(5)}, event.Extra["upstream_response_time_list"])
+	require.Equal(t, []interface{}{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"}, event.Extra["upstream_addr_list"])
+	require.Equal(t, int64(200), event.Extra["upstream_status"])
+	require.Equal(t, "abcd", event.Extra["request_id"])
+	require.Equal(t, int64(200), event.Extra["status"])
+}
+
+func TestDecodeNginxLog_Combined(t *testing.T) {
+	m := NewNginxPipeline(NginxPipelineOptions{})
+	var event types.Event
+	ok := m.Process(Event{Message: `127.0.0.1 - - [11/Mar/2020:20:05:34 +0800] "GET /hello HTTP/1.1" 200 612 "-" "curl/7.64.1" "10.0.0.1, 10.0.0.2"`}, &event)
+	require.True(t, ok)
+	require.Equal(t, int64(1583928334), event.Timestamp.Unix())
+	require.Equal(t, "127.0.0.1", event.Extra["remote_addr"])
+	require.Equal(t, "GET", event.Extra["method"])
+	require.Equal(t, "/hello", event.Extra["path"])
+	require.Equal(t, int64(200), event.Extra["status"])
+	require.Equal(t, int64(612), event.Extra["body_bytes_sent"])
+	require.Equal(t, "curl/7.64.1", event.Extra["http_user_agent"])
+	require.Equal(t, "10.0.0.1, 10.0.0.2", event.Extra["http_x_forwarded_for"])
+	require.Nil(t, event.Extra["http_referer"])
+
+	m = NewNginxPipeline(NginxPipelineOptions{Format: NginxFormatCompactKV})
+	require.False(t, m.Process(Event{Message: `127.0.0.1 - - [11/Mar/2020:20:05:34 +0800] "GET /hello HTTP/1.1" 200 612 "-" "curl/7.64.1"`}, &event))
+}
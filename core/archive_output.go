@@ -0,0 +1,476 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/logtube/logtubed/s3"
+	"github.com/logtube/logtubed/types"
+	"github.com/rs/zerolog/log"
+	"go.guoyk.net/common"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	archiveStagingExt = ".ndjson"
+	archiveSealedExt  = ".ndjson.sealed"
+	archiveGzipExt    = ".gz"
+
+	archiveFlushInterval  = time.Second
+	archiveSyncInterval   = time.Second * 5
+	archiveTailChunkSize  = 64 * 1024
+	archiveUploadInterval = time.Second * 10
+)
+
+var (
+	// <full index>.<hour>.<id>.ndjson[.sealed]
+	archiveStagingPattern = regexp.MustCompile(`^(.+)\.(\d{2})\.(\d+)\.ndjson(\.sealed)?$`)
+)
+
+type ArchiveOutputOptions struct {
+	Dir      string // staging directory
+	Hostname string // part of object key, distinguishes multiple logtubed instances
+	Prefix   string // object key prefix
+
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string `json:"-"`
+	PathStyle bool
+
+	MaxSize   int64         // seal a staging file once it exceeds this size
+	SealDelay time.Duration // seal a staging file once idle for this duration
+}
+
+// ArchiveOutput batches events per (topic, env, project, hour) into gzip NDJSON objects of a S3-compatible storage
+type ArchiveOutput interface {
+	common.Runnable
+	types.EventConsumer
+}
+
+type archiveStage struct {
+	name    string
+	file    *os.File
+	w       *bufio.Writer
+	size    int64
+	created time.Time
+	written time.Time
+	synced  time.Time
+}
+
+type archiveOutput struct {
+	optDir       string
+	optHostname  string
+	optPrefix    string
+	optMaxSize   int64
+	optSealDelay time.Duration
+
+	client *s3.Client
+
+	stages map[string]*archiveStage // only accessed by writer routine
+
+	ch     chan types.Event
+	sealed chan struct{}
+}
+
+func NewArchiveOutput(opts ArchiveOutputOptions) (ArchiveOutput, error) {
+	if len(opts.Dir) == 0 {
+		return nil, errors.New("ArchiveOutput: Dir is not set")
+	}
+	if len(opts.Hostname) == 0 {
+		opts.Hostname = "localhost"
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 256 * 1024 * 1024
+	}
+	if opts.SealDelay <= 0 {
+		opts.SealDelay = time.Minute * 5
+	}
+	if len(opts.Prefix) > 0 && !strings.HasSuffix(opts.Prefix, "/") {
+		opts.Prefix = opts.Prefix + "/"
+	}
+	client, err := s3.NewClient(s3.ClientOptions{
+		Endpoint:  opts.Endpoint,
+		Region:    opts.Region,
+		Bucket:    opts.Bucket,
+		AccessKey: opts.AccessKey,
+		SecretKey: opts.SecretKey,
+		PathStyle: opts.PathStyle,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	log.Info().Str("output", "archive").Interface("opts", opts).Msg("output created")
+	return &archiveOutput{
+		optDir:       opts.Dir,
+		optHostname:  opts.Hostname,
+		optPrefix:    opts.Prefix,
+		optMaxSize:   opts.MaxSize,
+		optSealDelay: opts.SealDelay,
+		client:       client,
+		stages:       map[string]*archiveStage{},
+		ch:           make(chan types.Event, 1000),
+		sealed:       make(chan struct{}, 1),
+	}, nil
+}
+
+func (a *archiveOutput) ConsumeEvent(e types.Event) error {
+	a.ch <- e
+	return nil
+}
+
+func archiveStageKey(e types.Event) string {
+	return fmt.Sprintf("%s.%02d", e.FullIndex(), e.Timestamp.Hour())
+}
+
+// objectKey <prefix><full index>/<hour>.<hostname>.<id>.ndjson.gz
+func (a *archiveOutput) objectKey(name string) (string, bool) {
+	m := archiveStagingPattern.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
+	}
+	return a.optPrefix + m[1] + "/" + m[2] + "." + a.optHostname + "." + m[3] + ".ndjson.gz", true
+}
+
+func (a *archiveOutput) takeStage(key string) (s *archiveStage, err error) {
+	if s = a.stages[key]; s != nil {
+		return
+	}
+	now := time.Now()
+	var name string
+	for id := now.UnixNano(); ; id++ {
+		name = filepath.Join(a.optDir, key+"."+strconv.FormatInt(id, 10)+archiveStagingExt)
+		if _, err1 := os.Stat(name); os.IsNotExist(err1) {
+			break
+		}
+	}
+	var f *os.File
+	if f, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	s = &archiveStage{name: name, file: f, w: bufio.NewWriter(f), created: now, synced: now}
+	a.stages[key] = s
+	return
+}
+
+func (a *archiveOutput) write(e types.Event) (err error) {
+	var buf []byte
+	if buf, err = json.Marshal(e.ToMap()); err != nil {
+		return
+	}
+	buf = append(buf, '\n')
+	key := archiveStageKey(e)
+	var s *archiveStage
+	if s, err = a.takeStage(key); err != nil {
+		return
+	}
+	var n int
+	n, err = s.w.Write(buf)
+	s.size += int64(n)
+	s.written = time.Now()
+	if err != nil {
+		return
+	}
+	if s.size >= a.optMaxSize {
+		err = a.seal(key)
+	}
+	return
+}
+
+// closeStage flush, sync and close a staging file, it stays unsealed
+func (a *archiveOutput) closeStage(key string) (s *archiveStage, err error) {
+	s = a.stages[key]
+	delete(a.stages, key)
+	if err = s.w.Flush(); err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		_ = s.file.Close()
+		return
+	}
+	err = s.file.Close()
+	return
+}
+
+// seal close a staging file and mark it ready to upload
+func (a *archiveOutput) seal(key string) (err error) {
+	var s *archiveStage
+	if s, err = a.closeStage(key); err != nil {
+		return
+	}
+	if err = os.Rename(s.name, strings.TrimSuffix(s.name, archiveStagingExt)+archiveSealedExt); err != nil {
+		return
+	}
+	log.Debug().Str("output", "archive").Str("file", s.name).Msg("staging file sealed")
+	select {
+	case a.sealed <- struct{}{}:
+	default:
+	}
+	return
+}
+
+// tick flush staging files and sync them periodically, seal idle ones and ones stayed too long
+func (a *archiveOutput) tick(now time.Time) {
+	for key, s := range a.stages {
+		if now.Sub(s.written) >= a.optSealDelay || now.Sub(s.created) >= time.Hour+a.optSealDelay {
+			if err := a.seal(key); err != nil {
+				log.Error().Err(err).Str("file", s.name).Msg("ArchiveOutput: failed to seal staging file")
+			}
+			continue
+		}
+		if err := s.w.Flush(); err != nil {
+			log.Error().Err(err).Str("file", s.name).Msg("ArchiveOutput: failed to flush staging file")
+			continue
+		}
+		if now.Sub(s.synced) >= archiveSyncInterval {
+			if err := s.file.Sync(); err != nil {
+				log.Error().Err(err).Str("file", s.name).Msg("ArchiveOutput: failed to sync staging file")
+				continue
+			}
+			s.synced = now
+		}
+	}
+}
+
+// archiveTruncatePartial truncate a partially written last line, only the end of file is read
+func archiveTruncatePartial(name string) (err error) {
+	var f *os.File
+	if f, err = os.OpenFile(name, os.O_RDWR, 0644); err != nil {
+		return
+	}
+	defer f.Close()
+	var info os.FileInfo
+	if info, err = f.Stat(); err != nil {
+		return
+	}
+	size := info.Size()
+	buf := make([]byte, archiveTailChunkSize)
+	end := size
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err = f.ReadAt(chunk, start); err != nil {
+			return
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if end == size {
+		return
+	}
+	if err = f.Truncate(end); err != nil {
+		return
+	}
+	return f.Sync()
+}
+
+// recover seal staging files left by previous run, a partially written last line is truncated
+func (a *archiveOutput) recover() (err error) {
+	var infos []os.FileInfo
+	if infos, err = ioutil.ReadDir(a.optDir); err != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), archiveStagingExt) {
+			continue
+		}
+		name := filepath.Join(a.optDir, info.Name())
+		if err = archiveTruncatePartial(name); err != nil {
+			return
+		}
+		if err = os.Rename(name, strings.TrimSuffix(name, archiveStagingExt)+archiveSealedExt); err != nil {
+			return
+		}
+		log.Info().Str("output", "archive").Str("file", name).Msg("staging file recovered")
+	}
+	return
+}
+
+// archiveGzipFile gzip src into dst while streaming, returns size and hex encoded SHA256 of dst
+func archiveGzipFile(src, dst string) (size int64, hash string, err error) {
+	var in *os.File
+	if in, err = os.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+	var out *os.File
+	if out, err = os.Create(dst); err != nil {
+		return
+	}
+	defer out.Close()
+	h := sha256.New()
+	cw := &archiveCountWriter{w: io.MultiWriter(out, h)}
+	zw := gzip.NewWriter(cw)
+	if _, err = io.Copy(zw, in); err != nil {
+		return
+	}
+	if err = zw.Close(); err != nil {
+		return
+	}
+	size, hash = cw.n, hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+type archiveCountWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *archiveCountWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+	return
+}
+
+func (a *archiveOutput) upload(ctx context.Context, name string) (err error) {
+	key, ok := a.objectKey(strings.TrimSuffix(name, ".sealed"))
+	if !ok {
+		return errors.New("ArchiveOutput: invalid staging file " + name)
+	}
+	file := filepath.Join(a.optDir, name)
+	var info os.FileInfo
+	if info, err = os.Stat(file); err != nil {
+		return
+	}
+	if info.Size() > 0 {
+		// gzip into a temporary file next to staging file, staging files can be hundreds of megabytes
+		gzFile := file + archiveGzipExt
+		var size int64
+		var hash string
+		if size, hash, err = archiveGzipFile(file, gzFile); err != nil {
+			_ = os.Remove(gzFile)
+			return
+		}
+		defer os.Remove(gzFile)
+		var f *os.File
+		if f, err = os.Open(gzFile); err != nil {
+			return
+		}
+		defer f.Close()
+		if err = a.client.PutObjectStream(ctx, key, f, size, hash, http.Header{
+			"Content-Type":     []string{"application/x-ndjson"},
+			"Content-Encoding": []string{"gzip"},
+		}); err != nil {
+			return
+		}
+		log.Debug().Str("output", "archive").Str("key", key).Int64("size", size).Msg("object uploaded")
+	}
+	return os.Remove(file)
+}
+
+// uploadSealed upload all sealed files, stops at first failure and retries later
+func (a *archiveOutput) uploadSealed(ctx context.Context) {
+	infos, err := ioutil.ReadDir(a.optDir)
+	if err != nil {
+		log.Error().Err(err).Msg("ArchiveOutput: failed to list staging files")
+		return
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), archiveSealedExt) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return
+		}
+		if err = a.upload(ctx, name); err != nil {
+			log.Error().Err(err).Str("file", name).Msg("ArchiveOutput: failed to upload, will retry")
+			return
+		}
+	}
+}
+
+func (a *archiveOutput) runUploader(ctx context.Context) {
+	tk := time.NewTicker(archiveUploadInterval)
+	defer tk.Stop()
+	for {
+		a.uploadSealed(ctx)
+		select {
+		case <-tk.C:
+		case <-a.sealed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *archiveOutput) Run(ctx context.Context) error {
+	log.Info().Str("output", "archive").Msg("started")
+	defer log.Info().Str("output", "archive").Msg("stopped")
+
+	if err := a.recover(); err != nil {
+		return err
+	}
+
+	uDone := make(chan interface{})
+	go func() {
+		a.runUploader(ctx)
+		close(uDone)
+	}()
+
+	tk := time.NewTicker(archiveFlushInterval)
+	defer tk.Stop()
+
+loop:
+	for {
+		select {
+		case e := <-a.ch:
+			if err := a.write(e); err != nil {
+				log.Error().Err(err).Msg("ArchiveOutput: failed to write staging file")
+			}
+		case now := <-tk.C:
+			a.tick(now)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	// drain queued events, staging files are sealed and uploaded on next start
+	for {
+		select {
+		case e := <-a.ch:
+			if err := a.write(e); err != nil {
+				log.Error().Err(err).Msg("ArchiveOutput: failed to write staging file")
+			}
+			continue
+		default:
+		}
+		break
+	}
+	for key, s := range a.stages {
+		if _, err := a.closeStage(key); err != nil {
+			log.Error().Err(err).Str("file", s.name).Msg("ArchiveOutput: failed to close staging file")
+		}
+	}
+
+	<-uDone
+	return nil
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/logtube/logtubed/s3"
+	"github.com/logtube/logtubed/types"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveOutput(t *testing.T) {
+	dir := "/tmp/logtubed-archive-test"
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, os.MkdirAll(dir, 0755))
+
+	// staging file left by previous run, with a partial last line
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "info-test-order-2019-07-16.10.1.ndjson"), []byte("{\"message\":\"old\"}\n{\"mess"), 0644))
+
+	server := s3.NewMemoryServer(s3.Credentials{AccessKey: "minio", SecretKey: "minio123", Region: "us-east-1"})
+	hs := httptest.NewServer(server)
+	defer hs.Close()
+
+	o, err := NewArchiveOutput(ArchiveOutputOptions{
+		Dir:       dir,
+		Hostname:  "node-1",
+		Prefix:    "logs",
+		Endpoint:  hs.URL,
+		Bucket:    "archive",
+		AccessKey: "minio",
+		SecretKey: "minio123",
+		PathStyle: true,
+	})
+	require.NoError(t, err)
+	a := o.(*archiveOutput)
+	require.NoError(t, a.recover())
+
+	for _, h := range []int{11, 11, 12} {
+		require.NoError(t, a.write(types.Event{
+			Timestamp: time.Date(2019, 7, 16, h, 0, 0, 0, time.UTC),
+			Topic:     "info",
+			Env:       "test",
+			Project:   "order",
+			Message:   "hello",
+		}))
+	}
+	require.Len(t, a.stages, 2)
+	a.tick(time.Now().Add(time.Hour))
+	require.Len(t, a.stages, 0)
+
+	a.uploadSealed(context.Background())
+
+	keys := server.Keys()
+	sort.Strings(keys)
+	require.Len(t, keys, 3)
+	require.Equal(t, "archive/logs/info-test-order-2019-07-16/10.node-1.1.ndjson.gz", keys[0])
+	require.True(t, strings.HasPrefix(keys[1], "archive/logs/info-test-order-2019-07-16/11.node-1."))
+	require.True(t, strings.HasPrefix(keys[2], "archive/logs/info-test-order-2019-07-16/12.node-1."))
+
+	buf, h, _ := server.Object(keys[0])
+	require.Equal(t, "gzip", h.Get("Content-Encoding"))
+	zr, err := gzip.NewReader(bytes.NewReader(buf))
+	require.NoError(t, err)
+	raw, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, "{\"message\":\"old\"}\n", string(raw))
+
+	buf, _, _ = server.Object(keys[1])
+	zr, err = gzip.NewReader(bytes.NewReader(buf))
+	require.NoError(t, err)
+	raw, err = ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(string(raw), "\"message\":\"hello\""))
+
+	// staging directory is empty once uploaded
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, infos, 0)
+}
+
+func TestArchiveTruncatePartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-archive-truncate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	long := strings.Repeat("x", archiveTailChunkSize*2+10)
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"a\nb\n", "a\nb\n"},
+		{"a\nb\npart", "a\nb\n"},
+		{"partial", ""},
+		{"a\n" + long, "a\n"},
+		{long + "\n" + long, long + "\n"},
+	}
+	for i, c := range cases {
+		name := filepath.Join(dir, "test.ndjson")
+		require.NoError(t, ioutil.WriteFile(name, []byte(c.in), 0644))
+		require.NoError(t, archiveTruncatePartial(name), i)
+		buf, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		require.Equal(t, c.want, string(buf), i)
+	}
+}
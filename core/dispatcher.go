@@ -2,6 +2,7 @@ package core
 
 import (
 	"errors"
+	"expvar"
 	"github.com/logtube/logtubed/types"
 	"github.com/rs/zerolog/log"
 	"go.guoyk.net/common"
@@ -15,12 +16,23 @@ type DispatcherOptions struct {
 	Priors               []string
 	EnvMappings          map[string]string
 	TopicMappings        map[string]string
+	Schemas              map[string]map[string]FieldSchema // Extra field schemas, per topic
+	Digest               DigestOptions                     // path_digest rules, route templates and limits
+
+	// VarSchemaViolations violations of schemas, per project
+	VarSchemaViolations *expvar.Map
+
+	// Enricher optional GeoIP and user agent enrichment
+	Enricher Enricher
 
 	Hostname string
 
 	Next    types.EventConsumer
 	NextStd types.OpConsumer
 	NextPri types.OpConsumer
+
+	// Observers additional consumers of every dispatched event, i.e. trace index
+	Observers []types.EventConsumer
 }
 
 type dispatcher struct {
@@ -33,9 +45,18 @@ type dispatcher struct {
 	mE   map[string]string
 	mT   map[string]string
 
+	digester *pathDigester
+
+	schemas             map[string]map[string]FieldSchema
+	varSchemaViolations *expvar.Map
+
+	enricher Enricher
+
 	next    types.EventConsumer
 	nextStd types.OpConsumer
 	nextPri types.OpConsumer
+
+	observers []types.EventConsumer
 }
 
 func NewDispatcher(opts DispatcherOptions) (types.EventConsumer, error) {
@@ -58,6 +79,13 @@ func NewDispatcher(opts DispatcherOptions) (types.EventConsumer, error) {
 		nextStd:  opts.NextStd,
 		nextPri:  opts.NextPri,
 		next:     opts.Next,
+
+		schemas:             map[string]map[string]FieldSchema{},
+		varSchemaViolations: opts.VarSchemaViolations,
+
+		enricher: opts.Enricher,
+
+		observers: opts.Observers,
 	}
 	for _, t := range opts.TopicIgnores {
 		d.tIgn[t] = true
@@ -85,6 +113,18 @@ func NewDispatcher(opts DispatcherOptions) (types.EventConsumer, error) {
 			d.mT[k] = v
 		}
 	}
+	var err error
+	if d.digester, err = newPathDigester(opts.Digest); err != nil {
+		return nil, err
+	}
+	for t, fields := range opts.Schemas {
+		for _, fs := range fields {
+			if err := fs.validate(); err != nil {
+				return nil, err
+			}
+		}
+		d.schemas[strings.TrimSpace(strings.ToLower(t))] = fields
+	}
 	return d, nil
 }
 
@@ -127,7 +167,25 @@ func (d *dispatcher) modifyEvent(e *types.Event) {
 	// regenerate path digest
 	if path, ok := e.Extra["path"]; ok {
 		if path, ok := path.(string); ok && path != "" {
-			e.Extra["path_digest"] = digestPath(path)
+			project := e.Project
+			if len(project) == 0 {
+				project = unknownProject
+			}
+			e.Extra["path_digest"] = d.digester.digest(project, path)
+		}
+	}
+	// enrich GeoIP and user agent
+	if d.enricher != nil {
+		d.enricher.Enrich(e)
+	}
+	// coerce extra fields
+	if schema, ok := d.schemas[e.Topic]; ok {
+		if n := applySchema(schema, e); n > 0 && d.varSchemaViolations != nil {
+			project := e.Project
+			if len(project) == 0 {
+				project = unknownProject
+			}
+			d.varSchemaViolations.Add(project, int64(n))
 		}
 	}
 }
@@ -140,6 +198,9 @@ func (d *dispatcher) ConsumeEvent(e types.Event) error {
 	// modify event
 	d.modifyEvent(&e)
 	eg := common.NewErrorGroup()
+	for _, o := range d.observers {
+		eg.Add(o.ConsumeEvent(e))
+	}
 	if d.next != nil {
 		// delivery to Next, i.e. LocalOutput, if set
 		eg.Add(d.next.ConsumeEvent(e))
@@ -0,0 +1,166 @@
+package core
+
+import (
+	"errors"
+	"expvar"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// path_digest of a project exceeding MaxDigests
+	digestOverflow = "/:other"
+)
+
+// DigestRule replace matches of Pattern in path with Placeholder before built-in digest rules, i.e. "[0-9]{11}" -> ":phone"
+type DigestRule struct {
+	Pattern     string
+	Placeholder string
+}
+
+// DigestOptions options of path_digest
+type DigestOptions struct {
+	// Rules user-defined rules, applied in order
+	Rules []DigestRule
+	// Routes route templates per project, i.e. "/api/orders/{id}/items", a matching path uses the template as digest
+	// "{name}" matches a single path component, a trailing "*" matches the rest
+	Routes map[string][]string
+	// MaxDigests max distinct digests per project, excluding route templates, extra digests are replaced with "/:other", 0 means no limit
+	MaxDigests int
+
+	// VarOverflows digests replaced due to MaxDigests, per project
+	VarOverflows *expvar.Map
+}
+
+type digestRule struct {
+	re          *regexp.Regexp
+	placeholder string
+}
+
+type digestRoute struct {
+	template   string
+	components []string
+}
+
+type pathDigester struct {
+	rules  []digestRule
+	routes map[string][]digestRoute
+
+	maxDigests   int
+	varOverflows *expvar.Map
+
+	lock    sync.Mutex
+	digests map[string]map[string]bool
+}
+
+func newPathDigester(opts DigestOptions) (*pathDigester, error) {
+	pd := &pathDigester{
+		routes:       map[string][]digestRoute{},
+		maxDigests:   opts.MaxDigests,
+		varOverflows: opts.VarOverflows,
+		digests:      map[string]map[string]bool{},
+	}
+	for _, r := range opts.Rules {
+		if len(r.Pattern) == 0 {
+			return nil, errors.New("Dispatcher: digest rule pattern is empty")
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, errors.New("Dispatcher: invalid digest rule pattern " + r.Pattern + ": " + err.Error())
+		}
+		pd.rules = append(pd.rules, digestRule{re: re, placeholder: r.Placeholder})
+	}
+	for project, templates := range opts.Routes {
+		project = strings.TrimSpace(project)
+		for _, t := range templates {
+			t = strings.TrimSpace(t)
+			if !strings.HasPrefix(t, "/") {
+				return nil, errors.New("Dispatcher: route template must start with '/': " + t)
+			}
+			components := splitPath(t)
+			for i, c := range components {
+				if c == "*" && i != len(components)-1 {
+					return nil, errors.New("Dispatcher: '*' must be the last component of route template: " + t)
+				}
+			}
+			pd.routes[project] = append(pd.routes[project], digestRoute{template: t, components: components})
+		}
+	}
+	return pd, nil
+}
+
+func splitPath(p string) []string {
+	ret := make([]string, 0, 8)
+	for _, c := range strings.Split(p, "/") {
+		if c != "" {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+func (r digestRoute) match(components []string) bool {
+	for i, t := range r.components {
+		if t == "*" {
+			return i < len(components)
+		}
+		if i >= len(components) {
+			return false
+		}
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			continue
+		}
+		if t != components[i] {
+			return false
+		}
+	}
+	return len(components) == len(r.components)
+}
+
+// digest calculate path_digest of a path of a project
+func (pd *pathDigester) digest(project string, p string) string {
+	if routes := pd.routes[project]; len(routes) > 0 {
+		// path may carry query string or fragment, i.e. taken from $request of nginx, routes match the path only
+		rp := p
+		if i := strings.IndexAny(rp, "?#"); i >= 0 {
+			rp = rp[:i]
+		}
+		components := splitPath(rp)
+		for _, r := range routes {
+			if r.match(components) {
+				return r.template
+			}
+		}
+	}
+	for _, r := range pd.rules {
+		p = r.re.ReplaceAllString(p, r.placeholder)
+	}
+	d := digestPath(p)
+	if pd.maxDigests > 0 && !pd.remember(project, d) {
+		if pd.varOverflows != nil {
+			pd.varOverflows.Add(project, 1)
+		}
+		return digestOverflow
+	}
+	return d
+}
+
+// remember record a digest of a project, returns false if MaxDigests is exceeded
+func (pd *pathDigester) remember(project string, d string) bool {
+	pd.lock.Lock()
+	defer pd.lock.Unlock()
+	seen := pd.digests[project]
+	if seen == nil {
+		seen = map[string]bool{}
+		pd.digests[project] = seen
+	}
+	if seen[d] {
+		return true
+	}
+	if len(seen) >= pd.maxDigests {
+		return false
+	}
+	seen[d] = true
+	return true
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/logtube/logtubed/types"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	FieldTypeString  = "string"
+	FieldTypeInteger = "integer"
+	FieldTypeNumber  = "number"
+	FieldTypeBoolean = "boolean"
+	FieldTypeObject  = "object"
+
+	// suffix of the Extra key holding a value conflicting with schema, as string
+	fieldRawSuffix = "_raw"
+)
+
+// FieldSchema schema of a Extra field, values are coerced to Type, conflicting values are moved to "<field>_raw"
+type FieldSchema struct {
+	Type      string // string, integer, number, boolean or object, empty means any type
+	Required  bool   // count a violation if missing
+	MaxLength int    // truncate string values longer than this, 0 means no limit
+}
+
+func (fs FieldSchema) validate() error {
+	switch fs.Type {
+	case "", FieldTypeString, FieldTypeInteger, FieldTypeNumber, FieldTypeBoolean, FieldTypeObject:
+		return nil
+	default:
+		return errors.New("Dispatcher: unknown field type " + fs.Type)
+	}
+}
+
+// applySchema coerce Extra fields of a event by schema of its topic, returns number of violations
+func applySchema(schema map[string]FieldSchema, e *types.Event) (violations int) {
+	for field, fs := range schema {
+		v, ok := e.Extra[field]
+		if !ok || v == nil {
+			if fs.Required {
+				violations++
+			}
+			continue
+		}
+		c, ok := coerceFieldValue(v, fs.Type)
+		if !ok {
+			delete(e.Extra, field)
+			e.Extra[field+fieldRawSuffix] = fieldValueString(v)
+			violations++
+			continue
+		}
+		if s, isStr := c.(string); isStr && fs.MaxLength > 0 && len(s) > fs.MaxLength {
+			c = truncateUTF8(s, fs.MaxLength)
+			violations++
+		}
+		e.Extra[field] = c
+	}
+	return
+}
+
+// coerceFieldValue convert a JSON decoded value to typ if possible
+func coerceFieldValue(v interface{}, typ string) (interface{}, bool) {
+	switch typ {
+	case "":
+		return v, true
+	case FieldTypeString:
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, false
+		}
+		return fieldValueString(v), true
+	case FieldTypeInteger:
+		switch n := v.(type) {
+		case int:
+			return int64(n), true
+		case int64:
+			return n, true
+		case float64:
+			if n == math.Trunc(n) && math.Abs(n) < 1<<53 {
+				return int64(n), true
+			}
+		case string:
+			if i, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64); err == nil {
+				return i, true
+			}
+		}
+	case FieldTypeNumber:
+		switch n := v.(type) {
+		case int:
+			return float64(n), true
+		case int64:
+			return float64(n), true
+		case float64:
+			return n, true
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(n), 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+				return f, true
+			}
+		}
+	case FieldTypeBoolean:
+		switch b := v.(type) {
+		case bool:
+			return b, true
+		case string:
+			if p, err := strconv.ParseBool(strings.TrimSpace(b)); err == nil {
+				return p, true
+			}
+		case float64:
+			if b == 0 || b == 1 {
+				return b == 1, true
+			}
+		}
+	case FieldTypeObject:
+		if m, ok := v.(map[string]interface{}); ok {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// fieldValueString format a value as string, objects and arrays as JSON
+func fieldValueString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	case bool, int, int64:
+		return fmt.Sprint(s)
+	}
+	buf, _ := json.Marshal(v)
+	return string(buf)
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"expvar"
 	"github.com/logtube/logtubed/types"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -71,3 +72,102 @@ func TestDispatcher_ConsumeEvent(t *testing.T) {
 	e := <-nxt.data
 	assert.Equal(t, "test-host", e.Via)
 }
+
+func TestDispatcher_Schemas(t *testing.T) {
+	nxt := &testEventConsumer{data: make(chan types.Event, 10)}
+	violations := &expvar.Map{}
+
+	_, err := NewDispatcher(DispatcherOptions{
+		Next:    nxt,
+		Schemas: map[string]map[string]FieldSchema{"x-access": {"duration": {Type: "date"}}},
+	})
+	assert.Error(t, err, "should reject unknown field type")
+
+	d, err := NewDispatcher(DispatcherOptions{
+		Next: nxt,
+		Schemas: map[string]map[string]FieldSchema{
+			"X-Access": {
+				"duration": {Type: FieldTypeInteger, Required: true},
+				"status":   {Type: FieldTypeString},
+				"ok":       {Type: FieldTypeBoolean},
+				"ratio":    {Type: FieldTypeNumber},
+				"agent":    {Type: FieldTypeString, MaxLength: 4},
+				"trace":    {Required: true},
+			},
+		},
+		VarSchemaViolations: violations,
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, d.ConsumeEvent(types.Event{
+		Topic:   "x-access",
+		Project: "ms-order",
+		Extra: map[string]interface{}{
+			"duration": "120",
+			"status":   float64(200),
+			"ok":       "true",
+			"ratio":    "0.5",
+			"agent":    "curl/7.0",
+			"trace":    "abc",
+		},
+	}))
+	e := <-nxt.data
+	assert.Equal(t, int64(120), e.Extra["duration"])
+	assert.Equal(t, "200", e.Extra["status"])
+	assert.Equal(t, true, e.Extra["ok"])
+	assert.Equal(t, 0.5, e.Extra["ratio"])
+	assert.Equal(t, "curl", e.Extra["agent"])
+	assert.Equal(t, "1", violations.Get("ms-order").String())
+
+	assert.NoError(t, d.ConsumeEvent(types.Event{
+		Topic: "x-access",
+		Extra: map[string]interface{}{
+			"duration": "slow",
+			"status":   map[string]interface{}{"code": float64(200)},
+		},
+	}))
+	e = <-nxt.data
+	assert.NotContains(t, e.Extra, "duration")
+	assert.Equal(t, "slow", e.Extra["duration_raw"])
+	assert.Equal(t, `{"code":200}`, e.Extra["status_raw"])
+	assert.Equal(t, "3", violations.Get("unknown").String())
+}
+
+func TestDispatcher_Digest(t *testing.T) {
+	nxt := &testEventConsumer{data: make(chan types.Event, 10)}
+	overflows := new(expvar.Map).Init()
+
+	_, err := NewDispatcher(DispatcherOptions{Next: nxt, Digest: DigestOptions{Rules: []DigestRule{{Pattern: "("}}}})
+	assert.Error(t, err)
+	_, err = NewDispatcher(DispatcherOptions{Next: nxt, Digest: DigestOptions{Routes: map[string][]string{"p": {"/a/*/b"}}}})
+	assert.Error(t, err)
+
+	d, err := NewDispatcher(DispatcherOptions{
+		Next: nxt,
+		Digest: DigestOptions{
+			Rules: []DigestRule{{Pattern: "[0-9]{11}", Placeholder: ":phone"}},
+			Routes: map[string][]string{
+				"ms-order": {"/api/orders/{id}/items", "/static/*"},
+			},
+			MaxDigests:   2,
+			VarOverflows: overflows,
+		},
+	})
+	assert.NoError(t, err)
+
+	digest := func(project, path string) string {
+		assert.NoError(t, d.ConsumeEvent(types.Event{Project: project, Topic: "x-access", Extra: map[string]interface{}{"path": path}}))
+		return (<-nxt.data).Extra["path_digest"].(string)
+	}
+
+	assert.Equal(t, "/api/orders/{id}/items", digest("ms-order", "/api/orders/abc/items"))
+	assert.Equal(t, "/api/orders/{id}/items", digest("ms-order", "/api/orders/abc/items?page=1"))
+	assert.Equal(t, "/api/orders/{id}/items", digest("ms-order", "/api/orders/abc/items#top"))
+	assert.Equal(t, "/static/*", digest("ms-order", "/static/js/app.js"))
+	assert.Equal(t, "/api/orders/:dec", digest("ms-order", "/api/orders/123"))
+	assert.Equal(t, "/users/:phone", digest("ms-order", "/users/13800138000"))
+	assert.Equal(t, "/users/:phone", digest("ms-order", "/users/13900139000"))
+	assert.Equal(t, "/:other", digest("ms-order", "/users"))
+	assert.Equal(t, "/api/orders/:dec/items", digest("ms-user", "/api/orders/123/items"))
+	assert.Equal(t, "1", overflows.Get("ms-order").String())
+}
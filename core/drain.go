@@ -0,0 +1,74 @@
+package core
+
+import (
+	"time"
+)
+
+const (
+	drainCheckInterval = time.Millisecond * 500
+
+	// consecutive zero readings required, ops moving between stages may be missed by a single reading
+	drainConfirmations = 2
+)
+
+// Drainable reports how many ops are accepted but not yet delivered
+type Drainable interface {
+	Pending() int64
+}
+
+// PendingOf sum pending ops of all non-nil Drainables
+func PendingOf(ds ...Drainable) (n int64) {
+	for _, d := range ds {
+		if d != nil {
+			n += d.Pending()
+		}
+	}
+	return
+}
+
+// drainChecker counts consecutive zero readings of pending ops
+type drainChecker struct {
+	ds    []Drainable
+	zeros int
+}
+
+// check returns pending ops and whether drained is confirmed
+func (c *drainChecker) check() (n int64, drained bool) {
+	if n = PendingOf(c.ds...); n == 0 {
+		c.zeros++
+	} else {
+		c.zeros = 0
+	}
+	drained = c.zeros >= drainConfirmations
+	return
+}
+
+// WaitDrained wait until all Drainables have nothing pending, or timeout, returns ops still pending
+func WaitDrained(timeout time.Duration, ds ...Drainable) int64 {
+	deadline := time.Now().Add(timeout)
+	c := &drainChecker{ds: ds}
+	for {
+		n, drained := c.check()
+		if drained || !time.Now().Before(deadline) {
+			return n
+		}
+		time.Sleep(drainCheckInterval)
+	}
+}
+
+// NotifyDrained close returned channel once all Drainables have nothing pending
+func NotifyDrained(ds ...Drainable) chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		tk := time.NewTicker(drainCheckInterval)
+		defer tk.Stop()
+		c := &drainChecker{ds: ds}
+		for range tk.C {
+			if _, drained := c.check(); drained {
+				close(ch)
+				return
+			}
+		}
+	}()
+	return ch
+}
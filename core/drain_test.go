@@ -0,0 +1,58 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDrainable reports pending values in order, the last one repeats
+type testDrainable struct {
+	lock   sync.Mutex
+	values []int64
+}
+
+func (d *testDrainable) Pending() int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	n := d.values[0]
+	if len(d.values) > 1 {
+		d.values = d.values[1:]
+	}
+	return n
+}
+
+func TestDrainChecker(t *testing.T) {
+	c := &drainChecker{ds: []Drainable{&testDrainable{values: []int64{0, 3, 0, 0}}, nil}}
+	n, drained := c.check()
+	assert.Equal(t, int64(0), n)
+	assert.False(t, drained, "single zero reading should not be drained")
+	n, drained = c.check()
+	assert.Equal(t, int64(3), n)
+	assert.False(t, drained)
+	_, drained = c.check()
+	assert.False(t, drained)
+	_, drained = c.check()
+	assert.True(t, drained, "two zero readings in a row should be drained")
+}
+
+func TestWaitDrained(t *testing.T) {
+	d := &testDrainable{values: []int64{0, 1, 0}}
+	start := time.Now()
+	assert.Equal(t, int64(0), WaitDrained(time.Second*5, d))
+	assert.True(t, time.Since(start) >= drainCheckInterval*2, "should wait for confirmation")
+
+	d = &testDrainable{values: []int64{2}}
+	assert.Equal(t, int64(2), WaitDrained(drainCheckInterval, d))
+}
+
+func TestNotifyDrained(t *testing.T) {
+	d := &testDrainable{values: []int64{0, 1, 0, 0}}
+	select {
+	case <-NotifyDrained(d):
+	case <-time.After(time.Second * 5):
+		t.Fatal("should be drained")
+	}
+	assert.Equal(t, []int64{0}, d.values)
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/olivere/elastic"
 	"github.com/rs/zerolog/log"
 	"go.guoyk.net/common"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,19 +15,49 @@ var (
 	elasticIgnoredErrorTypes = []string{"mapper_parsing_exception", "index_closed_exception"}
 )
 
+// elasticBatch a batch of Ops to commit, ack is invoked once committed or given up, if set
+type elasticBatch struct {
+	ops []types.Op
+	ack func(err error)
+}
+
 type elasticCommitter struct {
 	name           string
 	idx            int
 	noMappingTypes bool
 	client         *elastic.Client
-	opCh           chan []types.Op
+	opCh           chan elasticBatch
+	pending        *int64
+}
+
+// release a finished batch, err is nil if delivered
+func (c *elasticCommitter) release(b elasticBatch, err error) {
+	atomic.AddInt64(c.pending, -int64(len(b.ops)))
+	if b.ack != nil {
+		b.ack(err)
+	}
+}
+
+func (c *elasticCommitter) bulkRequest(op types.Op) *elastic.BulkIndexRequest {
+	req := elastic.NewBulkIndexRequest().Index(op.Index).Doc(string(op.Body))
+	if !c.noMappingTypes {
+		req.Type("_doc")
+	}
+	if len(op.ID) > 0 {
+		req.Id(op.ID)
+	}
+	if len(op.Routing) > 0 {
+		req.Routing(op.Routing)
+	}
+	return req
 }
 
 func (c *elasticCommitter) Run(ctx context.Context) error {
 	log.Info().Int("idx", c.idx).Str("name", c.name).Str("output", "elastic").Msg("committer started")
 	for {
 		select {
-		case ops := <-c.opCh:
+		case b := <-c.opCh:
+			ops := b.ops
 			var err error
 			var res *elastic.BulkResponse
 			var retryCount int
@@ -34,16 +66,13 @@ func (c *elasticCommitter) Run(ctx context.Context) error {
 			bs := elastic.NewBulkService(c.client)
 			bs.Retrier(elastic.NewBackoffRetrier(elastic.NewExponentialBackoff(time.Second*5, time.Hour*24)))
 			for _, op := range ops {
-				if c.noMappingTypes {
-					bs.Add(elastic.NewBulkIndexRequest().Index(op.Index).Doc(string(op.Body)))
-				} else {
-					bs.Add(elastic.NewBulkIndexRequest().Index(op.Index).Type("_doc").Doc(string(op.Body)))
-				}
+				bs.Add(c.bulkRequest(op))
 			}
 			// execute bulk
 			if res, err = bs.Do(ctx); err != nil {
 				// connection error, already retried
 				log.Error().Int("idx", c.idx).Str("name", c.name).Str("output", "elastic").Int("total_count", len(ops)).Int("retried", retryCount).Err(err).Msg("bulk failed to commit")
+				c.release(b, err)
 			} else if res.Errors {
 				// filter out failed
 				failed := res.Failed()
@@ -71,6 +100,7 @@ func (c *elasticCommitter) Run(ctx context.Context) error {
 				log.Error().Int("idx", c.idx).Str("name", c.name).Str("output", "elastic").Int("should-retries", len(shouldRetries)).Msg("bulk should retries")
 				// continue if no retries needed
 				if len(shouldRetries) == 0 {
+					c.release(b, nil)
 					continue
 				}
 				// rebuild ops
@@ -86,10 +116,12 @@ func (c *elasticCommitter) Run(ctx context.Context) error {
 				case <-retryTimer.C:
 					goto retry
 				case <-ctx.Done():
+					c.release(b, ctx.Err())
 					return nil
 				}
 			} else {
 				log.Debug().Int("idx", c.idx).Str("name", c.name).Str("output", "elastic").Int("count", len(ops)).Msg("bulk committed")
+				c.release(b, nil)
 			}
 		case <-ctx.Done():
 			log.Info().Int("idx", c.idx).Str("name", c.name).Msg("committer exited")
@@ -109,12 +141,15 @@ type ElasticOutputOptions struct {
 }
 
 type ElasticOutput interface {
-	types.OpConsumer
+	types.AckOpConsumer
 	common.Runnable
+	Drainable
 }
 
 // ElasticOutput implements OpConsumer and Runnable
 type elasticOutput struct {
+	pending int64 // ops accepted but not yet committed, first for 64-bit alignment
+
 	optName           string
 	optConcurrency    int
 	optBatchSize      int
@@ -122,6 +157,7 @@ type elasticOutput struct {
 	optNoMappingTypes bool
 
 	och chan types.Op
+	bch chan elasticBatch
 
 	c *elastic.Client
 }
@@ -152,6 +188,7 @@ func NewElasticOutput(opts ElasticOutputOptions) (ElasticOutput, error) {
 		optBatchTimeout:   opts.BatchTimeout,
 		optNoMappingTypes: opts.NoMappingTypes,
 		och:               make(chan types.Op),
+		bch:               make(chan elasticBatch),
 		c:                 c,
 	}
 	log.Info().Str("output", "elastic").Str("name", eo.optName).Interface("opts", opts).Msg("output created")
@@ -159,21 +196,66 @@ func NewElasticOutput(opts ElasticOutputOptions) (ElasticOutput, error) {
 }
 
 func (e *elasticOutput) ConsumeOp(op types.Op) error {
+	atomic.AddInt64(&e.pending, 1)
 	e.och <- op
 	return nil
 }
 
+// ConsumeOps hands batches directly to committers, skipping re-batching
+func (e *elasticOutput) ConsumeOps(ops []types.Op) error {
+	return e.ConsumeOpsAck(ops, nil)
+}
+
+// ConsumeOpsAck hands batches directly to committers, ack is invoked once all of them are committed or given up,
+// batches larger than BatchSize are split, the whole batch fails if any part failed
+func (e *elasticOutput) ConsumeOpsAck(ops []types.Op, ack func(err error)) error {
+	if len(ops) == 0 {
+		if ack != nil {
+			ack(nil)
+		}
+		return nil
+	}
+	atomic.AddInt64(&e.pending, int64(len(ops)))
+	if ack != nil && len(ops) > e.optBatchSize {
+		remaining := (len(ops) + e.optBatchSize - 1) / e.optBatchSize
+		whole := ack
+		lock := &sync.Mutex{}
+		var failed error
+		ack = func(err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil && failed == nil {
+				failed = err
+			}
+			if remaining--; remaining == 0 {
+				whole(failed)
+			}
+		}
+	}
+	for len(ops) > e.optBatchSize {
+		e.bch <- elasticBatch{ops: ops[:e.optBatchSize:e.optBatchSize], ack: ack}
+		ops = ops[e.optBatchSize:]
+	}
+	e.bch <- elasticBatch{ops: ops, ack: ack}
+	return nil
+}
+
+// Pending ops accepted but not yet committed
+func (e *elasticOutput) Pending() int64 {
+	return atomic.LoadInt64(&e.pending)
+}
+
 func (e *elasticOutput) Run(ctx context.Context) error {
 	log.Info().Str("output", "elastic").Str("name", e.optName).Msg("started")
 	defer log.Info().Str("output", "elastic").Str("name", e.optName).Msg("stopped")
 
-	// bulk channel
-	opCh := make(chan []types.Op)
+	// bulk channel, shared with ConsumeOps
+	opCh := e.bch
 
 	// create committer
 	cs := make([]common.Runnable, 0, e.optConcurrency)
 	for i := 0; i < e.optConcurrency; i++ {
-		cs = append(cs, &elasticCommitter{idx: i + 1, opCh: opCh, client: e.c, name: e.optName, noMappingTypes: e.optNoMappingTypes})
+		cs = append(cs, &elasticCommitter{idx: i + 1, opCh: opCh, client: e.c, name: e.optName, noMappingTypes: e.optNoMappingTypes, pending: &e.pending})
 	}
 
 	// wait committer done on exit
@@ -195,7 +277,7 @@ func (e *elasticOutput) Run(ctx context.Context) error {
 		// execute batch if not empty
 		if len(ops) > 0 {
 			log.Debug().Str("output", "elastic").Str("name", e.optName).Interface("actions", len(ops)).Msg("bulk submitted")
-			opCh <- ops
+			opCh <- elasticBatch{ops: ops}
 			ops = nil
 		}
 	}
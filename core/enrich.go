@@ -0,0 +1,270 @@
+package core
+
+import (
+	"container/list"
+	"errors"
+	"github.com/logtube/logtubed/geoip"
+	"github.com/logtube/logtubed/types"
+	"github.com/rs/zerolog/log"
+	"net"
+	"strings"
+	"sync"
+)
+
+var (
+	// hops in these networks are skipped when searching for the client IP
+	enrichNonPublicNetworks = mustParseCIDRs(
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7", "fe80::/10",
+	)
+
+	enrichDefaultIPFields = []string{"http_x_forwarded_for", "remote_addr"}
+)
+
+const (
+	enrichDefaultUAField   = "http_user_agent"
+	enrichDefaultCacheSize = 10000
+)
+
+func mustParseCIDRs(cidrs ...string) (out []*net.IPNet) {
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		out = append(out, n)
+	}
+	return
+}
+
+// EnrichTopic enrichment of a topic
+type EnrichTopic struct {
+	GeoIP     bool     // resolve client IP against GeoIP databases
+	UserAgent bool     // parse user agent
+	IPFields  []string // Extra fields containing client IP, first public hop wins, default http_x_forwarded_for, remote_addr
+	UAField   string   // Extra field containing user agent, default http_user_agent
+}
+
+type EnricherOptions struct {
+	GeoIPFile string // MaxMind DB file of GeoIP2 / GeoLite2 City
+	ASNFile   string // MaxMind DB file of GeoLite2 ASN
+	CacheSize int    // size of LRU caches of IP and user agent lookups, default 10000
+	Topics    map[string]EnrichTopic
+}
+
+// Enricher adds GeoIP and user agent fields to Extra of events
+type Enricher interface {
+	Enrich(e *types.Event)
+}
+
+type enricher struct {
+	topics map[string]EnrichTopic
+
+	city *geoip.Reader
+	asn  *geoip.Reader
+
+	geoCache *enrichCache
+	uaCache  *enrichCache
+}
+
+func NewEnricher(opts EnricherOptions) (Enricher, error) {
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = enrichDefaultCacheSize
+	}
+	en := &enricher{
+		topics:   map[string]EnrichTopic{},
+		geoCache: newEnrichCache(opts.CacheSize),
+		uaCache:  newEnrichCache(opts.CacheSize),
+	}
+	var err error
+	if len(opts.GeoIPFile) > 0 {
+		if en.city, err = geoip.Open(opts.GeoIPFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.ASNFile) > 0 {
+		if en.asn, err = geoip.Open(opts.ASNFile); err != nil {
+			return nil, err
+		}
+	}
+	for topic, t := range opts.Topics {
+		if t.GeoIP && en.city == nil && en.asn == nil {
+			return nil, errors.New("Enricher: GeoIPFile or ASNFile is not set")
+		}
+		if len(t.IPFields) == 0 {
+			t.IPFields = enrichDefaultIPFields
+		}
+		if len(t.UAField) == 0 {
+			t.UAField = enrichDefaultUAField
+		}
+		en.topics[strings.TrimSpace(strings.ToLower(topic))] = t
+	}
+	log.Info().Interface("opts", opts).Msg("enricher created")
+	return en, nil
+}
+
+func (en *enricher) Enrich(e *types.Event) {
+	t, ok := en.topics[e.Topic]
+	if !ok || e.Extra == nil {
+		return
+	}
+	if t.GeoIP {
+		if ip := clientIP(e.Extra, t.IPFields); ip != nil {
+			e.Extra["client_ip"] = ip.String()
+			en.enrichGeoIP(e.Extra, ip)
+		}
+	}
+	if t.UserAgent {
+		if s, _ := e.Extra[t.UAField].(string); len(s) > 0 && s != "-" {
+			en.enrichUserAgent(e.Extra, s)
+		}
+	}
+}
+
+func (en *enricher) enrichGeoIP(extra map[string]interface{}, ip net.IP) {
+	key := ip.String()
+	v, ok := en.geoCache.Get(key)
+	if !ok {
+		var rec geoip.Record
+		if en.city != nil {
+			if r, found, err := en.city.LookupRecord(ip); err != nil {
+				log.Debug().Err(err).Str("ip", key).Msg("failed to lookup GeoIP database")
+			} else if found {
+				rec.Country, rec.Region, rec.City = r.Country, r.Region, r.City
+			}
+		}
+		if en.asn != nil {
+			if r, found, err := en.asn.LookupRecord(ip); err != nil {
+				log.Debug().Err(err).Str("ip", key).Msg("failed to lookup ASN database")
+			} else if found {
+				rec.ASN, rec.ASOrg = r.ASN, r.ASOrg
+			}
+		}
+		v = rec
+		en.geoCache.Put(key, v)
+	}
+	rec := v.(geoip.Record)
+	setExtraString(extra, "geo_country", rec.Country)
+	setExtraString(extra, "geo_region", rec.Region)
+	setExtraString(extra, "geo_city", rec.City)
+	if rec.ASN > 0 {
+		extra["geo_asn"] = int64(rec.ASN)
+	}
+	setExtraString(extra, "geo_as_org", rec.ASOrg)
+}
+
+func (en *enricher) enrichUserAgent(extra map[string]interface{}, s string) {
+	v, ok := en.uaCache.Get(s)
+	if !ok {
+		v = ParseUserAgent(s)
+		en.uaCache.Put(s, v)
+	}
+	ua := v.(UserAgent)
+	setExtraString(extra, "ua_browser", ua.Browser)
+	setExtraString(extra, "ua_browser_version", ua.BrowserVersion)
+	setExtraString(extra, "ua_os", ua.OS)
+	setExtraString(extra, "ua_os_version", ua.OSVersion)
+	setExtraString(extra, "ua_device", ua.Device)
+}
+
+func setExtraString(extra map[string]interface{}, key string, value string) {
+	if len(value) > 0 {
+		extra[key] = value
+	}
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range enrichNonPublicNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHop parse a hop of X-Forwarded-For, with optional port
+func parseHop(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// clientIP find the first public hop in fields, X-Forwarded-For lists the client first
+func clientIP(extra map[string]interface{}, fields []string) net.IP {
+	for _, f := range fields {
+		var hops []string
+		switch v := extra[f].(type) {
+		case string:
+			hops = strings.Split(v, ",")
+		case []interface{}:
+			for _, h := range v {
+				if s, ok := h.(string); ok {
+					hops = append(hops, s)
+				}
+			}
+		}
+		for _, h := range hops {
+			if ip := parseHop(h); ip != nil && isPublicIP(ip) {
+				return ip
+			}
+		}
+	}
+	return nil
+}
+
+type enrichCacheItem struct {
+	key   string
+	value interface{}
+}
+
+// enrichCache a LRU cache, safe for concurrent use
+type enrichCache struct {
+	size int
+
+	lock  sync.Mutex
+	items map[string]*list.Element
+	order *list.List // front is the least recently used
+}
+
+func newEnrichCache(size int) *enrichCache {
+	return &enrichCache{
+		size:  size,
+		items: map[string]*list.Element{},
+		order: list.New(),
+	}
+}
+
+func (c *enrichCache) Get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToBack(el)
+	return el.Value.(*enrichCacheItem).value, true
+}
+
+func (c *enrichCache) Put(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*enrichCacheItem).value = value
+		c.order.MoveToBack(el)
+		return
+	}
+	c.items[key] = c.order.PushBack(&enrichCacheItem{key: key, value: value})
+	for c.order.Len() > c.size {
+		el := c.order.Front()
+		c.order.Remove(el)
+		delete(c.items, el.Value.(*enrichCacheItem).key)
+	}
+}
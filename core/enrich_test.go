@@ -0,0 +1,150 @@
+package core
+
+import (
+	"github.com/logtube/logtubed/geoip"
+	"github.com/logtube/logtubed/types"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	cases := map[string]UserAgent{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/79.0.3945.88 Safari/537.36": {
+			Browser: "Chrome", BrowserVersion: "79.0.3945.88", OS: "Windows", OSVersion: "10", Device: DeviceDesktop,
+		},
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/79.0.3945.88 Safari/537.36 Edg/79.0.309.56": {
+			Browser: "Edge", BrowserVersion: "79.0.309.56", OS: "Windows", OSVersion: "10", Device: DeviceDesktop,
+		},
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 13_3 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0.4 Mobile/15E148 Safari/604.1": {
+			Browser: "Safari", BrowserVersion: "13.0.4", OS: "iOS", OSVersion: "13.3", Device: DeviceMobile,
+		},
+		"Mozilla/5.0 (iPad; CPU OS 12_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 MicroMessenger/7.0.9(0x17000929) NetType/WIFI": {
+			Browser: "WeChat", BrowserVersion: "7.0.9", OS: "iOS", OSVersion: "12.2", Device: DeviceTablet,
+		},
+		"Mozilla/5.0 (Linux; Android 9; SM-G960F) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/10.1 Chrome/71.0.3578.99 Mobile Safari/537.36": {
+			Browser: "Samsung Internet", BrowserVersion: "10.1", OS: "Android", OSVersion: "9", Device: DeviceMobile,
+		},
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:71.0) Gecko/20100101 Firefox/71.0": {
+			Browser: "Firefox", BrowserVersion: "71.0", OS: "macOS", OSVersion: "10.15", Device: DeviceDesktop,
+		},
+		"Mozilla/5.0 (Windows NT 6.1; WOW64; Trident/7.0; rv:11.0) like Gecko": {
+			Browser: "IE", BrowserVersion: "11.0", OS: "Windows", OSVersion: "7", Device: DeviceDesktop,
+		},
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)": {
+			Device: DeviceBot,
+		},
+		"curl/7.64.1": {
+			Device: DeviceBot,
+		},
+		"": {},
+	}
+	for ua, expected := range cases {
+		require.Equal(t, expected, ParseUserAgent(ua), ua)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	extra := map[string]interface{}{
+		"http_x_forwarded_for": "10.0.0.1, 100.64.1.1 , 1.2.3.4:5678, 8.8.8.8",
+		"remote_addr":          "172.16.0.1",
+	}
+	require.Equal(t, "1.2.3.4", clientIP(extra, enrichDefaultIPFields).String())
+
+	extra = map[string]interface{}{
+		"http_x_forwarded_for": "-",
+		"remote_addr":          "[2001:db8::1]:80",
+	}
+	require.Equal(t, "2001:db8::1", clientIP(extra, enrichDefaultIPFields).String())
+
+	extra = map[string]interface{}{
+		"http_x_forwarded_for": "192.168.1.1, fd00::1",
+		"remote_addr":          "127.0.0.1",
+	}
+	require.Nil(t, clientIP(extra, enrichDefaultIPFields))
+}
+
+func TestEnricher_Enrich(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-enrich-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w := &geoip.Writer{DatabaseType: "GeoLite2-City"}
+	_, n, _ := net.ParseCIDR("1.2.3.0/24")
+	require.NoError(t, w.Insert(n, map[string]interface{}{
+		"country":      map[string]interface{}{"iso_code": "CN"},
+		"subdivisions": []interface{}{map[string]interface{}{"names": map[string]interface{}{"en": "Zhejiang"}}},
+		"city":         map[string]interface{}{"names": map[string]interface{}{"en": "Hangzhou"}},
+	}))
+	buf, err := w.Bytes()
+	require.NoError(t, err)
+	cityFile := filepath.Join(dir, "city.mmdb")
+	require.NoError(t, ioutil.WriteFile(cityFile, buf, 0644))
+
+	w = &geoip.Writer{DatabaseType: "GeoLite2-ASN"}
+	require.NoError(t, w.Insert(n, map[string]interface{}{
+		"autonomous_system_number":       uint(4134),
+		"autonomous_system_organization": "Chinanet",
+	}))
+	buf, err = w.Bytes()
+	require.NoError(t, err)
+	asnFile := filepath.Join(dir, "asn.mmdb")
+	require.NoError(t, ioutil.WriteFile(asnFile, buf, 0644))
+
+	_, err = NewEnricher(EnricherOptions{Topics: map[string]EnrichTopic{"x-access": {GeoIP: true}}})
+	require.Error(t, err)
+
+	en, err := NewEnricher(EnricherOptions{
+		GeoIPFile: cityFile,
+		ASNFile:   asnFile,
+		CacheSize: 1,
+		Topics: map[string]EnrichTopic{
+			"X-Access": {GeoIP: true, UserAgent: true},
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		e := types.Event{Topic: "x-access", Extra: map[string]interface{}{
+			"http_x_forwarded_for": "10.1.1.1, 1.2.3.4",
+			"remote_addr":          "10.2.2.2",
+			"http_user_agent":      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:71.0) Gecko/20100101 Firefox/71.0",
+		}}
+		en.Enrich(&e)
+		require.Equal(t, "1.2.3.4", e.Extra["client_ip"])
+		require.Equal(t, "CN", e.Extra["geo_country"])
+		require.Equal(t, "Zhejiang", e.Extra["geo_region"])
+		require.Equal(t, "Hangzhou", e.Extra["geo_city"])
+		require.Equal(t, int64(4134), e.Extra["geo_asn"])
+		require.Equal(t, "Chinanet", e.Extra["geo_as_org"])
+		require.Equal(t, "Firefox", e.Extra["ua_browser"])
+		require.Equal(t, "macOS", e.Extra["ua_os"])
+		require.Equal(t, DeviceDesktop, e.Extra["ua_device"])
+	}
+
+	e := types.Event{Topic: "x-access", Extra: map[string]interface{}{"remote_addr": "9.9.9.9"}}
+	en.Enrich(&e)
+	require.Equal(t, "9.9.9.9", e.Extra["client_ip"])
+	_, ok := e.Extra["geo_country"]
+	require.False(t, ok)
+
+	e = types.Event{Topic: "info", Extra: map[string]interface{}{"remote_addr": "1.2.3.4"}}
+	en.Enrich(&e)
+	require.Len(t, e.Extra, 1)
+}
+
+func TestEnrichCache(t *testing.T) {
+	c := newEnrichCache(2)
+	c.Put("a", 1)
+	c.Put("b", 2)
+	_, _ = c.Get("a")
+	c.Put("c", 3)
+	_, ok := c.Get("b")
+	require.False(t, ok)
+	v, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+}
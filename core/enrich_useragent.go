@@ -0,0 +1,132 @@
+package core
+
+import (
+	"strings"
+)
+
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+)
+
+// UserAgent browser, OS and device parsed from a User-Agent header
+type UserAgent struct {
+	Browser        string
+	BrowserVersion string
+	OS             string
+	OSVersion      string
+	Device         string
+}
+
+type uaRule struct {
+	marker string
+	name   string
+}
+
+var (
+	uaBotMarkers = []string{"bot", "spider", "crawl", "slurp", "curl/", "wget/", "python-requests", "go-http-client", "java/", "apache-httpclient"}
+
+	// order matters, i.e. Edge and Opera also contain "Chrome/", Chrome also contains "Safari/"
+	uaBrowserRules = []uaRule{
+		{marker: "MicroMessenger/", name: "WeChat"},
+		{marker: "DingTalk/", name: "DingTalk"},
+		{marker: "Edg/", name: "Edge"},
+		{marker: "Edge/", name: "Edge"},
+		{marker: "EdgA/", name: "Edge"},
+		{marker: "EdgiOS/", name: "Edge"},
+		{marker: "OPR/", name: "Opera"},
+		{marker: "SamsungBrowser/", name: "Samsung Internet"},
+		{marker: "UCBrowser/", name: "UC Browser"},
+		{marker: "Firefox/", name: "Firefox"},
+		{marker: "FxiOS/", name: "Firefox"},
+		{marker: "CriOS/", name: "Chrome"},
+		{marker: "Chrome/", name: "Chrome"},
+		{marker: "Version/", name: "Safari"},
+		{marker: "MSIE ", name: "IE"},
+		{marker: "rv:", name: "IE"}, // IE 11, only with Trident
+	}
+
+	uaWindowsVersions = map[string]string{
+		"10.0": "10",
+		"6.3":  "8.1",
+		"6.2":  "8",
+		"6.1":  "7",
+		"6.0":  "Vista",
+		"5.1":  "XP",
+	}
+)
+
+// uaVersionAfter extract version following marker, i.e. "79.0.3945.88" of "Chrome/79.0.3945.88"
+func uaVersionAfter(ua string, marker string) (string, bool) {
+	i := strings.Index(ua, marker)
+	if i < 0 {
+		return "", false
+	}
+	v := ua[i+len(marker):]
+	end := 0
+	for end < len(v) && (v[end] == '.' || v[end] == '_' || (v[end] >= '0' && v[end] <= '9')) {
+		end++
+	}
+	return strings.Replace(v[:end], "_", ".", -1), true
+}
+
+// ParseUserAgent parse browser, OS and device from a User-Agent header, unknown parts are left empty
+func ParseUserAgent(ua string) (r UserAgent) {
+	lower := strings.ToLower(ua)
+	for _, m := range uaBotMarkers {
+		if strings.Contains(lower, m) {
+			r.Device = DeviceBot
+			break
+		}
+	}
+
+	for _, rule := range uaBrowserRules {
+		if rule.marker == "rv:" && !strings.Contains(ua, "Trident/") {
+			continue
+		}
+		if rule.name == "Safari" && !strings.Contains(ua, "Safari/") {
+			continue
+		}
+		if v, ok := uaVersionAfter(ua, rule.marker); ok {
+			r.Browser, r.BrowserVersion = rule.name, v
+			break
+		}
+	}
+
+	switch {
+	case strings.Contains(ua, "Windows"):
+		r.OS = "Windows"
+		if v, ok := uaVersionAfter(ua, "Windows NT "); ok {
+			r.OSVersion = uaWindowsVersions[v]
+		}
+	case strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPad") || strings.Contains(ua, "iPod"):
+		r.OS = "iOS"
+		if v, ok := uaVersionAfter(ua, " OS "); ok {
+			r.OSVersion = v
+		}
+	case strings.Contains(ua, "Android"):
+		r.OS = "Android"
+		r.OSVersion, _ = uaVersionAfter(ua, "Android ")
+	case strings.Contains(ua, "Mac OS X"):
+		r.OS = "macOS"
+		r.OSVersion, _ = uaVersionAfter(ua, "Mac OS X ")
+	case strings.Contains(ua, "CrOS"):
+		r.OS = "Chrome OS"
+	case strings.Contains(ua, "Linux"):
+		r.OS = "Linux"
+	}
+
+	if len(r.Device) == 0 {
+		switch {
+		case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet") || (r.OS == "Android" && !strings.Contains(ua, "Mobile")):
+			r.Device = DeviceTablet
+		case strings.Contains(ua, "Mobile") || strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPod") || r.OS == "Android":
+			r.Device = DeviceMobile
+		case len(r.OS) > 0:
+			r.Device = DeviceDesktop
+		}
+	}
+	return
+}
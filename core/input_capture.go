@@ -0,0 +1,119 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"github.com/rs/zerolog/log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	InputStatDecoded = "decoded"
+	InputStatFailed  = "failed"
+	InputStatDropped = "dropped"
+)
+
+// inputStatAdd increase a "<pipeline>.<stat>" counter of a per-input expvar.Map, nil map does nothing
+func inputStatAdd(m *expvar.Map, pipeline string, stat string) {
+	if m == nil {
+		return
+	}
+	m.Add(pipeline+"."+stat, 1)
+}
+
+type RawCaptureOptions struct {
+	File    string // NDJSON file to append unparsable raw payloads
+	Sample  int    // capture one of every Sample failures, default 1
+	MaxSize int64  // stop capturing once file exceeds this size, default 100mb
+}
+
+// RawCapture records a sample of unparsable raw payloads for offline debugging
+type RawCapture interface {
+	Capture(input string, pipeline string, raw []byte, err error)
+	Close() error
+}
+
+type rawCapture struct {
+	optSample  int64
+	optMaxSize int64
+
+	count int64
+
+	lock sync.Mutex
+	f    *os.File
+	size int64
+}
+
+type rawCaptureRecord struct {
+	Time     time.Time `json:"time"`
+	Input    string    `json:"input"`
+	Pipeline string    `json:"pipeline"`
+	Error    string    `json:"error,omitempty"`
+	Raw      string    `json:"raw"`
+}
+
+func NewRawCapture(opts RawCaptureOptions) (RawCapture, error) {
+	if len(opts.File) == 0 {
+		return nil, errors.New("RawCapture: File is not set")
+	}
+	if opts.Sample <= 0 {
+		opts.Sample = 1
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 100 * 1024 * 1024
+	}
+	f, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var info os.FileInfo
+	if info, err = f.Stat(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	log.Info().Interface("opts", opts).Msg("raw capture created")
+	return &rawCapture{
+		optSample:  int64(opts.Sample),
+		optMaxSize: opts.MaxSize,
+		f:          f,
+		size:       info.Size(),
+	}, nil
+}
+
+func (c *rawCapture) Capture(input string, pipeline string, raw []byte, err error) {
+	if (atomic.AddInt64(&c.count, 1)-1)%c.optSample != 0 {
+		return
+	}
+	rec := rawCaptureRecord{Time: time.Now(), Input: input, Pipeline: pipeline, Raw: string(raw)}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	buf, _ := json.Marshal(rec)
+	buf = append(buf, '\n')
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.f == nil || c.size+int64(len(buf)) > c.optMaxSize {
+		return
+	}
+	if _, err = c.f.Write(buf); err != nil {
+		log.Error().Err(err).Msg("failed to write raw capture")
+		return
+	}
+	c.size += int64(len(buf))
+}
+
+func (c *rawCapture) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
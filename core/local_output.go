@@ -1,20 +1,75 @@
 package core
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
+	"expvar"
 	"github.com/logtube/logtubed/types"
 	"github.com/rs/zerolog/log"
 	"go.guoyk.net/common"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	LocalOutputQueueBlock = "block" // ConsumeEvent blocks when queue is full
+	LocalOutputQueueDrop  = "drop"  // ConsumeEvent drops event when queue is full
+
+	LocalOutputFsyncNone     = "none"     // leave it to OS
+	LocalOutputFsyncInterval = "interval" // fsync on every periodic flush
+	LocalOutputFsyncAlways   = "always"   // flush and fsync after every event
+
+	localOutputMaintainInterval = time.Minute
+	localOutputFinishGrace      = time.Minute * 10
+
+	// active file has no seq, sorted after all segments of the same day
+	localOutputActiveSeq = int(^uint(0) >> 1)
+
+	// <topic>-<env>-<project>.meta.json, stored beside files of a prefix
+	localOutputMetaExt = ".meta.json"
+)
+
+var (
+	// <topic>-<env>-<project>-<date>[.<seq>].log[.gz]
+	localOutputFilePattern = regexp.MustCompile(`^(.+)-(\d{4}-\d{2}-\d{2})(\.(\d+))?\.log(\.gz)?$`)
+
+	localOutputKnownEnvs = []string{"dev", "test", "staging", "uat", "drill", "prod"}
+)
+
 type LocalOutputOptions struct {
-	Dir string
+	Dir      string
+	Format   string // text, json, logfmt, logtube or template
+	Template string // Go text/template for template format
+
+	MaxFileSize    int64         // rotate a file to a numbered segment once it exceeds this size
+	RotateInterval time.Duration // rotate a file to a numbered segment once wall clock enters a new interval
+	MaxOpenFiles   int           // least recently used files are closed beyond this limit
+	Compress       bool          // gzip rotated segments and files of finished days
+	MaxAge         int           // remove files of days older than this, in days
+	MaxProjectSize int64         // remove oldest files of a project once total size exceeds this
+
+	Shards        int           // number of writer goroutines, indices are sharded by hash
+	QueueSize     int           // max events queued in memory, shared by all shards
+	QueuePolicy   string        // block or drop, when queue is full
+	BufferSize    int           // write buffer size of each file
+	FlushInterval time.Duration // interval to flush write buffers
+	Fsync         string        // none, interval or always
+
+	VarInput   *expvar.Int
+	VarOutput  *expvar.Int
+	VarDropped *expvar.Int
+	VarDepth   *expvar.Int
 }
 
 type LocalOutput interface {
@@ -22,119 +77,465 @@ type LocalOutput interface {
 	types.EventConsumer
 }
 
+type localOutputFileInfo struct {
+	name   string
+	prefix string // <topic>-<env>-<project>
+	index  string
+	date   string
+	seq    int
+	gz     bool
+	size   int64
+	mod    time.Time
+}
+
 // LocalOutput implements EventConsumer and Runnable
 type localOutput struct {
-	optDir string
+	optDir            string
+	optMaxFileSize    int64
+	optRotateInterval time.Duration
+	optMaxOpenFiles   int // per shard
+	optCompress       bool
+	optMaxAge         int
+	optMaxProjectSize int64
+	optDrop           bool
+	optBufferSize     int
+	optFlushInterval  time.Duration
+	optFsync          string
 
-	fs map[string]*os.File
+	serialize localOutputSerializer
 
-	ch chan types.Event
+	shards []*localShard
+
+	projectsLock sync.RWMutex
+	projects     map[string]bool
+
+	varInput   *expvar.Int
+	varOutput  *expvar.Int
+	varDropped *expvar.Int
+	varDepth   *expvar.Int
 }
 
 func NewLocalOutput(opts LocalOutputOptions) (LocalOutput, error) {
 	if len(opts.Dir) == 0 {
 		return nil, errors.New("LocalOutput: Dir is not set")
 	}
-	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+	if opts.MaxOpenFiles <= 0 {
+		opts.MaxOpenFiles = 2000
+	}
+	if opts.Shards <= 0 {
+		opts.Shards = 4
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 10000
+	}
+	if len(opts.QueuePolicy) == 0 {
+		opts.QueuePolicy = LocalOutputQueueBlock
+	}
+	if opts.QueuePolicy != LocalOutputQueueBlock && opts.QueuePolicy != LocalOutputQueueDrop {
+		return nil, errors.New("LocalOutput: unknown queue policy " + opts.QueuePolicy)
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 16 * 1024
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	if len(opts.Fsync) == 0 {
+		opts.Fsync = LocalOutputFsyncNone
+	}
+	if opts.Fsync != LocalOutputFsyncNone && opts.Fsync != LocalOutputFsyncInterval && opts.Fsync != LocalOutputFsyncAlways {
+		return nil, errors.New("LocalOutput: unknown fsync policy " + opts.Fsync)
+	}
+	serialize, err := newLocalOutputSerializer(opts.Format, opts.Template)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(opts.Dir, 0755); err != nil {
 		return nil, err
 	}
 	log.Info().Str("output", "local").Interface("opts", opts).Msg("output created")
 	lo := &localOutput{
-		optDir: opts.Dir,
-		fs:     make(map[string]*os.File),
-		ch:     make(chan types.Event),
+		optDir:            opts.Dir,
+		optMaxFileSize:    opts.MaxFileSize,
+		optRotateInterval: opts.RotateInterval,
+		optMaxOpenFiles:   (opts.MaxOpenFiles + opts.Shards - 1) / opts.Shards,
+		optCompress:       opts.Compress,
+		optMaxAge:         opts.MaxAge,
+		optMaxProjectSize: opts.MaxProjectSize,
+		optDrop:           opts.QueuePolicy == LocalOutputQueueDrop,
+		optBufferSize:     opts.BufferSize,
+		optFlushInterval:  opts.FlushInterval,
+		optFsync:          opts.Fsync,
+		serialize:         serialize,
+		projects:          map[string]bool{},
+		varInput:          opts.VarInput,
+		varOutput:         opts.VarOutput,
+		varDropped:        opts.VarDropped,
+		varDepth:          opts.VarDepth,
+	}
+	queueSize := (opts.QueueSize + opts.Shards - 1) / opts.Shards
+	for i := 0; i < opts.Shards; i++ {
+		lo.shards = append(lo.shards, newLocalShard(lo, i, queueSize))
 	}
 	return lo, nil
 }
 
-func localOutputSerialize(e types.Event) string {
-	var x string
-	for k, v := range e.Extra {
-		if len(x) > 0 {
-			x = x + ", "
-		}
-		x = x + fmt.Sprintf("%s = %v", k, v)
+func parseLocalOutputFileName(name string) (fi localOutputFileInfo, ok bool) {
+	m := localOutputFilePattern.FindStringSubmatch(name)
+	if m == nil {
+		return
 	}
-	if len(x) > 0 {
-		x = " {" + x + "}"
+	fi.name = name
+	fi.prefix = m[1]
+	fi.date = m[2]
+	fi.index = m[1] + "-" + m[2]
+	fi.seq = localOutputActiveSeq
+	if len(m[4]) > 0 {
+		fi.seq, _ = strconv.Atoi(m[4])
 	}
-	return fmt.Sprintf(
-		"[%s] (%s) [%s] %s%s\r\n",
-		e.Timestamp.Format(time.RFC3339),
-		e.Crid,
-		e.Keyword,
-		e.Message,
-		x,
-	)
+	fi.gz = len(m[5]) > 0
+	ok = true
+	return
+}
+
+// localOutputMeta topic, env and project of a file prefix, a prefix can not always be split by dashes
+type localOutputMeta struct {
+	Topic   string `json:"topic"`
+	Env     string `json:"env"`
+	Project string `json:"project"`
+}
+
+func (m localOutputMeta) prefix() string {
+	return m.Topic + "-" + m.Env + "-" + m.Project
 }
 
-func (l *localOutput) takeFile(index string) (f *os.File, err error) {
-	// close all if opened too much
-	if len(l.fs) > 2000 {
-		if err = l.closeFiles(); err != nil {
+// writeLocalOutputMeta create meta file of a prefix if not existed
+func writeLocalOutputMeta(dir string, m localOutputMeta) (err error) {
+	name := filepath.Join(dir, m.prefix()+localOutputMetaExt)
+	if _, err = os.Stat(name); err == nil || !os.IsNotExist(err) {
+		return
+	}
+	var buf []byte
+	if buf, err = json.Marshal(m); err != nil {
+		return
+	}
+	tmp := name + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, name)
+}
+
+// resolveLocalOutputMeta find topic, env and project of a prefix, by meta file or by splitting the prefix
+func resolveLocalOutputMeta(dir string, prefix string) (m localOutputMeta, ok bool) {
+	if buf, err := ioutil.ReadFile(filepath.Join(dir, prefix+localOutputMetaExt)); err == nil {
+		if json.Unmarshal(buf, &m) == nil && m.prefix() == prefix {
+			ok = true
 			return
 		}
 	}
+	m.Topic, m.Env, m.Project, ok = splitLocalOutputPrefix(prefix)
+	return
+}
 
-	// find
-	if f = l.fs[index]; f != nil {
+// splitLocalOutputPrefix split <topic>-<env>-<project> without meta file, ok is false if the prefix is ambiguous
+//
+// a topic is either a single word, or starts with "x-" and may contain dashes, in which case env is located by known envs
+func splitLocalOutputPrefix(prefix string) (topic, env, project string, ok bool) {
+	splits := strings.Split(prefix, "-")
+	if len(splits) < 3 || splits[0] == "" {
 		return
 	}
+	if splits[0] != "x" {
+		return splits[0], splits[1], strings.Join(splits[2:], "-"), splits[1] != "" && splits[2] != ""
+	}
+	if len(splits) == 4 {
+		// x-<name>-<env>-<project>
+		return splits[0] + "-" + splits[1], splits[2], splits[3], splits[1] != "" && splits[2] != "" && splits[3] != ""
+	}
+	// exactly one known env in the middle, beyond "x-<name>"
+	found := 0
+	for i := 2; i < len(splits)-1; i++ {
+		for _, e := range localOutputKnownEnvs {
+			if splits[i] == e {
+				topic, env, project = strings.Join(splits[:i], "-"), e, strings.Join(splits[i+1:], "-")
+				found++
+			}
+		}
+	}
+	if found != 1 {
+		return "", "", "", false
+	}
+	ok = project != ""
+	return
+}
+
+func (l *localOutput) varAdd(v *expvar.Int, n int64) {
+	if v != nil {
+		v.Add(n)
+	}
+}
 
-	// create
-	if f, err = os.OpenFile(
-		filepath.Join(l.optDir, index+".log"),
-		os.O_CREATE|os.O_RDWR|os.O_APPEND,
-		0644,
-	); err != nil {
+func (l *localOutput) shardOf(index string) *localShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(index))
+	return l.shards[h.Sum32()%uint32(len(l.shards))]
+}
+
+func (l *localOutput) addProject(project string) {
+	l.projectsLock.RLock()
+	ok := l.projects[project]
+	l.projectsLock.RUnlock()
+	if ok {
 		return
 	}
+	l.projectsLock.Lock()
+	l.projects[project] = true
+	l.projectsLock.Unlock()
+}
 
-	log.Debug().Str("output", "local").Str("file", f.Name()).Msg("file opened")
+func (l *localOutput) ConsumeEvent(e types.Event) error {
+	l.addProject(e.Project)
+	s := l.shardOf(e.FullIndex())
+	l.varAdd(l.varInput, 1)
+	l.varAdd(l.varDepth, 1)
+	if l.optDrop {
+		select {
+		case s.ch <- e:
+		default:
+			l.varAdd(l.varDepth, -1)
+			l.varAdd(l.varDropped, 1)
+		}
+	} else {
+		s.ch <- e
+	}
+	return nil
+}
 
-	// set
-	l.fs[index] = f
+func compressLocalOutputFile(name string) (err error) {
+	var src *os.File
+	if src, err = os.Open(name); err != nil {
+		return
+	}
+	defer src.Close()
 
+	tmp := name + ".gz.tmp"
+	var dst *os.File
+	if dst, err = os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
+		return
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err != nil {
+		_ = dst.Close()
+		return
+	}
+	if err = zw.Close(); err != nil {
+		_ = dst.Close()
+		return
+	}
+	if err = dst.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, name+".gz"); err != nil {
+		return
+	}
+	log.Debug().Str("output", "local").Str("file", name+".gz").Msg("file compressed")
+	return os.Remove(name)
+}
+
+// projectOf find the longest known project a file prefix ends with
+func (l *localOutput) projectOf(prefix string) (project string) {
+	l.projectsLock.RLock()
+	defer l.projectsLock.RUnlock()
+	for p := range l.projects {
+		if len(p) > len(project) && strings.HasSuffix(prefix, "-"+p) {
+			project = p
+		}
+	}
 	return
 }
 
-func (l *localOutput) closeFiles() error {
-	eg := common.NewErrorGroup()
-	for _, f := range l.fs {
-		log.Debug().Str("output", "local").Str("file", f.Name()).Msg("file closed")
-		eg.Add(f.Close())
+// removeFile remove a file, closing it first if it is the active file of a opened index
+func (l *localOutput) removeFile(fi localOutputFileInfo) (err error) {
+	s := l.shardOf(fi.index)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if el := s.files[fi.index]; el != nil && fi.seq == localOutputActiveSeq && !fi.gz {
+		if err = s.closeFile(el); err != nil {
+			return
+		}
 	}
-	l.fs = map[string]*os.File{}
-	return eg.Err()
+	log.Debug().Str("output", "local").Str("file", fi.name).Msg("file removed")
+	return os.Remove(filepath.Join(l.optDir, fi.name))
 }
 
-func (l *localOutput) ConsumeEvent(e types.Event) error {
-	l.ch <- e
-	return nil
+// finishFile close and rename active file of a finished day to a segment
+func (l *localOutput) finishFile(fi localOutputFileInfo) (name string, err error) {
+	s := l.shardOf(fi.index)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if el := s.files[fi.index]; el != nil {
+		if err = s.closeFile(el); err != nil {
+			return
+		}
+	}
+	return s.segmentFile(fi.index)
 }
 
-func (l *localOutput) Run(ctx context.Context) error {
-	log.Info().Str("output", "local").Msg("started")
-	defer log.Info().Str("output", "local").Msg("stopped")
-loop:
-	for {
-		select {
-		case e := <-l.ch:
-			var f *os.File
-			var err error
-			if f, err = l.takeFile(e.FullIndex()); err != nil {
-				log.Error().Err(err).Msg("LocalOutput: failed to take file")
+func (l *localOutput) listFiles() (fis []localOutputFileInfo, err error) {
+	var infos []os.FileInfo
+	if infos, err = ioutil.ReadDir(l.optDir); err != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		fi, ok := parseLocalOutputFileName(info.Name())
+		if !ok {
+			continue
+		}
+		fi.size = info.Size()
+		fi.mod = info.ModTime()
+		fis = append(fis, fi)
+	}
+	return
+}
+
+// maintain compress finished files and apply retention
+func (l *localOutput) maintain(now time.Time) {
+	var err error
+	var fis []localOutputFileInfo
+	if fis, err = l.listFiles(); err != nil {
+		log.Error().Err(err).Msg("LocalOutput: failed to list files")
+		return
+	}
+
+	today := now.Format("2006-01-02")
+
+	// compress
+	if l.optCompress {
+		for _, fi := range fis {
+			if fi.gz {
 				continue
 			}
-			if _, err = io.WriteString(f, localOutputSerialize(e)); err != nil {
-				log.Error().Err(err).Msg("LocalOutput: failed to output file")
+			name := filepath.Join(l.optDir, fi.name)
+			if fi.seq == localOutputActiveSeq {
+				// active file of a finished day, leave some time for late events
+				if fi.date >= today || now.Sub(fi.mod) < localOutputFinishGrace {
+					continue
+				}
+				if name, err = l.finishFile(fi); err != nil {
+					log.Error().Err(err).Str("file", fi.name).Msg("LocalOutput: failed to finish file")
+					continue
+				}
+			}
+			if err = compressLocalOutputFile(name); err != nil {
+				log.Error().Err(err).Str("file", fi.name).Msg("LocalOutput: failed to compress file")
 				continue
 			}
+		}
+		if fis, err = l.listFiles(); err != nil {
+			log.Error().Err(err).Msg("LocalOutput: failed to list files")
+			return
+		}
+	}
+
+	// retention by age
+	if l.optMaxAge > 0 {
+		deadline := now.AddDate(0, 0, -l.optMaxAge).Format("2006-01-02")
+		var kept []localOutputFileInfo
+		for _, fi := range fis {
+			if fi.date >= deadline {
+				kept = append(kept, fi)
+				continue
+			}
+			if err = l.removeFile(fi); err != nil {
+				log.Error().Err(err).Str("file", fi.name).Msg("LocalOutput: failed to remove file")
+			}
+		}
+		fis = kept
+	}
+
+	// retention by total size per project, active file of today is never removed
+	if l.optMaxProjectSize > 0 {
+		// projects are found from files on disk, including projects quiet since startup
+		projects := map[string]string{}
+		groups := map[string][]localOutputFileInfo{}
+		for _, fi := range fis {
+			project, ok := projects[fi.prefix]
+			if !ok {
+				if m, found := resolveLocalOutputMeta(l.optDir, fi.prefix); found {
+					project = m.Project
+				} else if project = l.projectOf(fi.prefix); project == "" {
+					log.Debug().Str("output", "local").Str("file", fi.name).Msg("project of file is unknown, skipped by retention")
+				}
+				projects[fi.prefix] = project
+			}
+			if project != "" {
+				groups[project] = append(groups[project], fi)
+			}
+		}
+		for _, group := range groups {
+			sort.Slice(group, func(i, j int) bool {
+				if group[i].date != group[j].date {
+					return group[i].date < group[j].date
+				}
+				return group[i].seq < group[j].seq
+			})
+			var total int64
+			for _, fi := range group {
+				total += fi.size
+			}
+			for _, fi := range group {
+				if total <= l.optMaxProjectSize {
+					break
+				}
+				if fi.seq == localOutputActiveSeq && !fi.gz && fi.date >= today {
+					continue
+				}
+				if err = l.removeFile(fi); err != nil {
+					log.Error().Err(err).Str("file", fi.name).Msg("LocalOutput: failed to remove file")
+					continue
+				}
+				total -= fi.size
+			}
+		}
+	}
+}
+
+func (l *localOutput) runMaintain(ctx context.Context) {
+	if !l.optCompress && l.optMaxAge <= 0 && l.optMaxProjectSize <= 0 {
+		return
+	}
+	tk := time.NewTicker(localOutputMaintainInterval)
+	defer tk.Stop()
+	for {
+		l.maintain(time.Now())
+		select {
+		case <-tk.C:
 		case <-ctx.Done():
-			break loop
+			return
 		}
 	}
+}
+
+func (l *localOutput) Run(ctx context.Context) error {
+	log.Info().Str("output", "local").Msg("started")
+	defer log.Info().Str("output", "local").Msg("stopped")
 
-	_ = l.closeFiles()
+	wg := &sync.WaitGroup{}
+	wg.Add(len(l.shards) + 1)
+	go func() {
+		l.runMaintain(ctx)
+		wg.Done()
+	}()
+	for _, s := range l.shards {
+		go func(s *localShard) {
+			s.run(ctx)
+			wg.Done()
+		}(s)
+	}
+	wg.Wait()
 	return nil
 }
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/logtube/logtubed/beat"
+	"github.com/logtube/logtubed/types"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	LocalOutputFormatText     = "text"     // [time] (crid) [keyword] message {k = v, ...}
+	LocalOutputFormatJSON     = "json"     // NDJSON of Event.ToMap()
+	LocalOutputFormatLogfmt   = "logfmt"   // key=value pairs
+	LocalOutputFormatLogtube  = "logtube"  // Logtube V2 message, replayable through logtube pipeline
+	LocalOutputFormatTemplate = "template" // Go text/template, executed with types.Event
+)
+
+type localOutputSerializer func(e types.Event) ([]byte, error)
+
+func newLocalOutputSerializer(format string, tpl string) (localOutputSerializer, error) {
+	switch format {
+	case "", LocalOutputFormatText:
+		return localOutputSerializeText, nil
+	case LocalOutputFormatJSON:
+		return localOutputSerializeJSON, nil
+	case LocalOutputFormatLogfmt:
+		return localOutputSerializeLogfmt, nil
+	case LocalOutputFormatLogtube:
+		return localOutputSerializeLogtube, nil
+	case LocalOutputFormatTemplate:
+		if len(tpl) == 0 {
+			return nil, errors.New("LocalOutput: Template is not set")
+		}
+		t, err := template.New("local").Parse(tpl)
+		if err != nil {
+			return nil, err
+		}
+		return func(e types.Event) ([]byte, error) {
+			buf := &bytes.Buffer{}
+			if err := t.Execute(buf, e); err != nil {
+				return nil, err
+			}
+			if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+				buf.WriteByte('\n')
+			}
+			return buf.Bytes(), nil
+		}, nil
+	default:
+		return nil, errors.New("LocalOutput: unknown format " + format)
+	}
+}
+
+func sortedExtraKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func localOutputSerializeText(e types.Event) ([]byte, error) {
+	var x []string
+	for _, k := range sortedExtraKeys(e.Extra) {
+		x = append(x, fmt.Sprintf("%s = %v", k, e.Extra[k]))
+	}
+	var xs string
+	if len(x) > 0 {
+		xs = " {" + strings.Join(x, ", ") + "}"
+	}
+	return []byte(fmt.Sprintf(
+		"[%s] (%s) [%s] %s%s\n",
+		e.Timestamp.Format(time.RFC3339),
+		e.Crid,
+		e.Keyword,
+		e.Message,
+		xs,
+	)), nil
+}
+
+func localOutputSerializeJSON(e types.Event) ([]byte, error) {
+	// encoding/json sorts map keys
+	buf, err := json.Marshal(e.ToMap())
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+func appendLogfmt(buf []byte, k string, v interface{}) []byte {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case nil:
+		s = ""
+	default:
+		if j, err := json.Marshal(v); err == nil {
+			s = string(j)
+		} else {
+			s = fmt.Sprint(v)
+		}
+	}
+	if len(buf) > 0 {
+		buf = append(buf, ' ')
+	}
+	buf = append(buf, k...)
+	buf = append(buf, '=')
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\r\n") {
+		return strconv.AppendQuote(buf, s)
+	}
+	return append(buf, s...)
+}
+
+func localOutputSerializeLogfmt(e types.Event) ([]byte, error) {
+	var buf []byte
+	buf = appendLogfmt(buf, "timestamp", e.Timestamp.Format(time.RFC3339Nano))
+	buf = appendLogfmt(buf, "hostname", e.Hostname)
+	buf = appendLogfmt(buf, "env", e.Env)
+	buf = appendLogfmt(buf, "project", e.Project)
+	buf = appendLogfmt(buf, "topic", e.Topic)
+	buf = appendLogfmt(buf, "crid", e.Crid)
+	buf = appendLogfmt(buf, "crsrc", e.Crsrc)
+	buf = appendLogfmt(buf, "keyword", e.Keyword)
+	buf = appendLogfmt(buf, "message", e.Message)
+	for _, k := range sortedExtraKeys(e.Extra) {
+		buf = appendLogfmt(buf, "x_"+k, e.Extra[k])
+	}
+	return append(buf, '\n'), nil
+}
+
+// localOutputLogtubeHead json head of a Logtube V2 message, same keys as beat.PartialEvent
+type localOutputLogtubeHead struct {
+	Crid    string                 `json:"c,omitempty"`
+	Crsrc   string                 `json:"s,omitempty"`
+	Keyword string                 `json:"k,omitempty"`
+	Extra   map[string]interface{} `json:"x,omitempty"`
+}
+
+func localOutputSerializeLogtube(e types.Event) ([]byte, error) {
+	// env, topic and project are carried by file name, hostname is not part of the format
+	p := localOutputLogtubeHead{
+		Crid:    e.Crid,
+		Crsrc:   e.Crsrc,
+		Keyword: e.Keyword,
+		Extra:   e.Extra,
+	}
+	pj, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, len(pj)+len(e.Message)+40)
+	buf = append(buf, '[')
+	buf = append(buf, e.Timestamp.Format(beat.LogtubeV2TimestampLayout)...)
+	buf = append(buf, "] ["...)
+	buf = append(buf, pj...)
+	buf = append(buf, "] "...)
+	buf = append(buf, e.Message...)
+	return append(buf, '\n'), nil
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"github.com/logtube/logtubed/beat"
+	"github.com/logtube/logtubed/types"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+var testLocalOutputEvent = types.Event{
+	Timestamp: time.Date(2019, 7, 16, 11, 59, 53, 0, time.FixedZone("", 8*3600)),
+	Hostname:  "node-1",
+	Env:       "test",
+	Project:   "ms-order",
+	Topic:     "info",
+	Crid:      "aaaa",
+	Crsrc:     "gateway",
+	Keyword:   "kkkk",
+	Message:   "hello world",
+	Extra:     map[string]interface{}{"b": "two words", "a": 1},
+}
+
+func TestLocalOutputSerializers(t *testing.T) {
+	var s localOutputSerializer
+	var buf []byte
+	var err error
+
+	s, err = newLocalOutputSerializer(LocalOutputFormatText, "")
+	require.NoError(t, err)
+	buf, err = s(testLocalOutputEvent)
+	require.NoError(t, err)
+	require.Equal(t, "[2019-07-16T11:59:53+08:00] (aaaa) [kkkk] hello world {a = 1, b = two words}\n", string(buf))
+
+	s, err = newLocalOutputSerializer(LocalOutputFormatJSON, "")
+	require.NoError(t, err)
+	buf, err = s(testLocalOutputEvent)
+	require.NoError(t, err)
+	require.Equal(t, `{"crid":"aaaa","crsrc":"gateway","env":"test","hostname":"node-1","keyword":"kkkk","message":"hello world","project":"ms-order","raw_size":0,"timestamp":"2019-07-16T11:59:53+08:00","topic":"info","via":"","x_a":1,"x_b":"two words"}`+"\n", string(buf))
+
+	s, err = newLocalOutputSerializer(LocalOutputFormatLogfmt, "")
+	require.NoError(t, err)
+	buf, err = s(testLocalOutputEvent)
+	require.NoError(t, err)
+	require.Equal(t, `timestamp=2019-07-16T11:59:53+08:00 hostname=node-1 env=test project=ms-order topic=info crid=aaaa crsrc=gateway keyword=kkkk message="hello world" x_a=1 x_b="two words"`+"\n", string(buf))
+
+	s, err = newLocalOutputSerializer(LocalOutputFormatTemplate, "{{.Project}} {{.Message}}{{range $k, $v := .Extra}} {{$k}}={{$v}}{{end}}")
+	require.NoError(t, err)
+	buf, err = s(testLocalOutputEvent)
+	require.NoError(t, err)
+	require.Equal(t, "ms-order hello world a=1 b=two words\n", string(buf))
+
+	_, err = newLocalOutputSerializer(LocalOutputFormatTemplate, "")
+	require.Error(t, err)
+	_, err = newLocalOutputSerializer("xml", "")
+	require.Error(t, err)
+}
+
+func TestLocalOutputSerializeLogtube_Replay(t *testing.T) {
+	buf, err := localOutputSerializeLogtube(testLocalOutputEvent)
+	require.NoError(t, err)
+	require.Equal(t, `[2019-07-16 11:59:53.000 +0800] [{"c":"aaaa","s":"gateway","k":"kkkk","x":{"a":1,"b":"two words"}}] hello world`+"\n", string(buf))
+
+	var b beat.Event
+	b.Source = "/var/log/test/info/ms-order.log"
+	b.Message = string(buf)
+	var r types.Event
+	require.True(t, beat.NewLogtubePipeline(beat.LogtubePipelineOptions{}).Process(b, &r))
+	require.True(t, r.Timestamp.Equal(testLocalOutputEvent.Timestamp))
+	require.Equal(t, "aaaa", r.Crid)
+	require.Equal(t, "gateway", r.Crsrc)
+	require.Equal(t, "kkkk", r.Keyword)
+	require.Equal(t, "hello world", r.Message)
+	require.Equal(t, "two words", r.Extra["b"])
+}
@@ -0,0 +1,279 @@
+package core
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"github.com/logtube/logtubed/types"
+	"github.com/rs/zerolog/log"
+	"go.guoyk.net/common"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type localFile struct {
+	index string
+	file  *os.File
+	w     *bufio.Writer
+	size  int64
+	slot  time.Time
+	dirty bool // written since last sync
+}
+
+// localShard owns a subset of indices, files of a index are only written by it's shard
+type localShard struct {
+	out *localOutput
+	id  int
+
+	// lock guards files and order, maintenance routine renames files concurrently
+	lock  sync.Mutex
+	files map[string]*list.Element
+	order *list.List // front is the least recently used
+
+	ch chan types.Event
+}
+
+func newLocalShard(out *localOutput, id int, queueSize int) *localShard {
+	return &localShard{
+		out:   out,
+		id:    id,
+		files: map[string]*list.Element{},
+		order: list.New(),
+		ch:    make(chan types.Event, queueSize),
+	}
+}
+
+func (s *localShard) rotateSlot(now time.Time) time.Time {
+	if s.out.optRotateInterval <= 0 {
+		return time.Time{}
+	}
+	return now.Truncate(s.out.optRotateInterval)
+}
+
+// nextSegment find next unused segment name of a index, lock must be held
+func (s *localShard) nextSegment(index string) string {
+	for seq := 1; ; seq++ {
+		name := filepath.Join(s.out.optDir, index+"."+strconv.Itoa(seq)+".log")
+		if _, err := os.Stat(name); err == nil {
+			continue
+		}
+		if _, err := os.Stat(name + ".gz"); err == nil {
+			continue
+		}
+		return name
+	}
+}
+
+// segmentFile rename active file of a index to next segment, lock must be held and file must be closed
+func (s *localShard) segmentFile(index string) (name string, err error) {
+	name = s.nextSegment(index)
+	if err = os.Rename(filepath.Join(s.out.optDir, index+".log"), name); err != nil {
+		return
+	}
+	log.Debug().Str("output", "local").Str("file", name).Msg("file rotated")
+	return
+}
+
+// syncFile flush buffered data and fsync if required by policy, lock must be held
+func (s *localShard) syncFile(lf *localFile, fsync bool) (err error) {
+	if err = lf.w.Flush(); err != nil {
+		return
+	}
+	if fsync && lf.dirty {
+		if err = lf.file.Sync(); err != nil {
+			return
+		}
+	}
+	lf.dirty = false
+	return
+}
+
+// closeFile flush, close and forget a opened file, lock must be held
+func (s *localShard) closeFile(el *list.Element) error {
+	lf := s.order.Remove(el).(*localFile)
+	delete(s.files, lf.index)
+	eg := common.NewErrorGroup()
+	eg.Add(s.syncFile(lf, s.out.optFsync != LocalOutputFsyncNone))
+	eg.Add(lf.file.Close())
+	log.Debug().Str("output", "local").Str("file", lf.file.Name()).Msg("file closed")
+	return eg.Err()
+}
+
+// takeFile find or open file of a index, lock must be held
+func (s *localShard) takeFile(index string, meta localOutputMeta) (lf *localFile, err error) {
+	now := time.Now()
+
+	// find
+	if el := s.files[index]; el != nil {
+		lf = el.Value.(*localFile)
+		if s.out.optRotateInterval <= 0 || lf.slot.Equal(s.rotateSlot(now)) {
+			s.order.MoveToBack(el)
+			return
+		}
+		// rotate if wall clock entered a new interval
+		if err = s.closeFile(el); err != nil {
+			return
+		}
+		if _, err = s.segmentFile(index); err != nil {
+			return
+		}
+	}
+
+	// close least recently used if opened too much
+	for s.order.Len() >= s.out.optMaxOpenFiles {
+		if err = s.closeFile(s.order.Front()); err != nil {
+			return
+		}
+	}
+
+	name := filepath.Join(s.out.optDir, index+".log")
+
+	// rotate existing file last modified in a previous interval
+	if s.out.optRotateInterval > 0 {
+		if info, err1 := os.Stat(name); err1 == nil && info.Size() > 0 && !s.rotateSlot(info.ModTime()).Equal(s.rotateSlot(now)) {
+			if _, err = s.segmentFile(index); err != nil {
+				return
+			}
+		}
+	}
+
+	// meta file, resolves topic, env and project for retention and replay
+	if err1 := writeLocalOutputMeta(s.out.optDir, meta); err1 != nil {
+		log.Error().Err(err1).Str("prefix", meta.prefix()).Msg("LocalOutput: failed to write meta file")
+	}
+
+	// create
+	var f *os.File
+	if f, err = os.OpenFile(
+		name,
+		os.O_CREATE|os.O_RDWR|os.O_APPEND,
+		0644,
+	); err != nil {
+		return
+	}
+	var info os.FileInfo
+	if info, err = f.Stat(); err != nil {
+		_ = f.Close()
+		return
+	}
+
+	log.Debug().Str("output", "local").Str("file", f.Name()).Msg("file opened")
+
+	// set
+	lf = &localFile{
+		index: index,
+		file:  f,
+		w:     bufio.NewWriterSize(f, s.out.optBufferSize),
+		size:  info.Size(),
+		slot:  s.rotateSlot(now),
+	}
+	s.files[index] = s.order.PushBack(lf)
+
+	return
+}
+
+func (s *localShard) closeFiles() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	eg := common.NewErrorGroup()
+	for s.order.Len() > 0 {
+		eg.Add(s.closeFile(s.order.Front()))
+	}
+	return eg.Err()
+}
+
+// flushFiles flush all opened files, fsync if policy is interval
+func (s *localShard) flushFiles() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	eg := common.NewErrorGroup()
+	for el := s.order.Front(); el != nil; el = el.Next() {
+		eg.Add(s.syncFile(el.Value.(*localFile), s.out.optFsync == LocalOutputFsyncInterval))
+	}
+	return eg.Err()
+}
+
+func (s *localShard) write(e types.Event) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	index := e.FullIndex()
+
+	var buf []byte
+	if buf, err = s.out.serialize(e); err != nil {
+		return
+	}
+
+	var lf *localFile
+	if lf, err = s.takeFile(index, localOutputMeta{Topic: e.Topic, Env: e.EnvForIndex(), Project: e.Project}); err != nil {
+		return
+	}
+	var n int
+	n, err = lf.w.Write(buf)
+	lf.size += int64(n)
+	lf.dirty = true
+	if err != nil {
+		return
+	}
+
+	if s.out.optFsync == LocalOutputFsyncAlways {
+		if err = s.syncFile(lf, true); err != nil {
+			return
+		}
+	}
+
+	// rotate if exceeded size
+	if s.out.optMaxFileSize > 0 && lf.size >= s.out.optMaxFileSize {
+		if err = s.closeFile(s.files[index]); err != nil {
+			return
+		}
+		if _, err = s.segmentFile(index); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *localShard) handle(e types.Event) {
+	s.out.varAdd(s.out.varDepth, -1)
+	if err := s.write(e); err != nil {
+		log.Error().Err(err).Int("shard", s.id).Msg("LocalOutput: failed to output file")
+		return
+	}
+	s.out.varAdd(s.out.varOutput, 1)
+}
+
+func (s *localShard) run(ctx context.Context) {
+	tk := time.NewTicker(s.out.optFlushInterval)
+	defer tk.Stop()
+
+loop:
+	for {
+		select {
+		case e := <-s.ch:
+			s.handle(e)
+		case <-tk.C:
+			if err := s.flushFiles(); err != nil {
+				log.Error().Err(err).Int("shard", s.id).Msg("LocalOutput: failed to flush files")
+			}
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	// drain queued events
+	for {
+		select {
+		case e := <-s.ch:
+			s.handle(e)
+		default:
+			if err := s.closeFiles(); err != nil {
+				log.Error().Err(err).Int("shard", s.id).Msg("LocalOutput: failed to close files")
+			}
+			return
+		}
+	}
+}
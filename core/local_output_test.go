@@ -2,10 +2,14 @@ package core
 
 import (
 	"context"
+	"expvar"
 	"github.com/logtube/logtubed/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -59,5 +63,192 @@ func TestLocalOutput_Run(t *testing.T) {
 	if !assert.NoError(t, err, "should not fail on reading output file") {
 		return
 	}
-	assert.Equal(t, "[2019-07-16T11:59:53+08:00] (aaaa) [kkkk] hello world {key1 = val2}\r\n", string(buf))
+	assert.Equal(t, "[2019-07-16T11:59:53+08:00] (aaaa) [kkkk] hello world {key1 = val2}\n", string(buf))
+}
+
+func TestLocalOutput_Rotate(t *testing.T) {
+	dir := "/tmp/logtubed-local-test-rotate"
+	require.NoError(t, os.RemoveAll(dir))
+
+	o, err := NewLocalOutput(LocalOutputOptions{Dir: dir, MaxFileSize: 100, MaxOpenFiles: 1, Shards: 1})
+	require.NoError(t, err)
+	s := o.(*localOutput).shards[0]
+
+	for i := 0; i < 3; i++ {
+		for _, project := range []string{"ms-order", "order"} {
+			require.NoError(t, s.write(types.Event{
+				Timestamp: time.Date(2019, 7, 16, 11, 0, 0, 0, time.UTC),
+				Topic:     "info",
+				Env:       "test",
+				Project:   project,
+				Message:   "hello world hello world hello world hello world hello world",
+			}))
+		}
+	}
+	require.Equal(t, 1, s.order.Len())
+	require.NoError(t, s.closeFiles())
+
+	for _, name := range []string{
+		"info-test-ms-order-2019-07-16.log",
+		"info-test-ms-order-2019-07-16.1.log",
+		"info-test-order-2019-07-16.1.log",
+	} {
+		_, err = os.Stat(filepath.Join(dir, name))
+		require.NoError(t, err, name)
+	}
+}
+
+func TestLocalOutput_Maintain(t *testing.T) {
+	dir := "/tmp/logtubed-local-test-maintain"
+	require.NoError(t, os.RemoveAll(dir))
+
+	o, err := NewLocalOutput(LocalOutputOptions{Dir: dir, Compress: true, MaxAge: 3, MaxProjectSize: 150})
+	require.NoError(t, err)
+	l := o.(*localOutput)
+	l.projects["ms-order"] = true
+	l.projects["order"] = true
+
+	now := time.Date(2019, 7, 16, 12, 0, 0, 0, time.Local)
+	content := []byte(strings.Repeat("a", 100))
+	for _, name := range []string{
+		"info-test-order-2019-07-10.log",
+		"info-test-order-2019-07-15.log",
+		"info-test-ms-order-2019-07-14.1.log",
+		"info-test-ms-order-2019-07-15.log",
+		"info-test-ms-order-2019-07-16.log",
+	} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), content, 0644))
+		require.NoError(t, os.Chtimes(filepath.Join(dir, name), now.Add(-time.Hour), now.Add(-time.Hour)))
+	}
+
+	l.maintain(now)
+
+	var names []string
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	require.Equal(t, []string{
+		"info-test-ms-order-2019-07-15.1.log.gz",
+		"info-test-ms-order-2019-07-16.log",
+		"info-test-order-2019-07-15.1.log.gz",
+	}, names)
+}
+
+func TestLocalOutput_MaintainAfterRestart(t *testing.T) {
+	dir := "/tmp/logtubed-local-test-maintain-restart"
+	require.NoError(t, os.RemoveAll(dir))
+
+	// no events seen since startup, projects are resolved from files on disk
+	o, err := NewLocalOutput(LocalOutputOptions{Dir: dir, MaxProjectSize: 150})
+	require.NoError(t, err)
+	l := o.(*localOutput)
+
+	now := time.Date(2019, 7, 16, 12, 0, 0, 0, time.Local)
+	content := []byte(strings.Repeat("a", 100))
+	for _, name := range []string{
+		"info-test-ms-order-2019-07-14.1.log",
+		"info-test-ms-order-2019-07-15.log",
+		"x-access-prod-ms-test-user-2019-07-14.log",
+		"x-access-prod-ms-test-user-2019-07-15.log",
+		"x-access-prod-ms-test-user-2019-07-16.log",
+	} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), content, 0644))
+	}
+	require.NoError(t, writeLocalOutputMeta(dir, localOutputMeta{Topic: "x-access", Env: "prod", Project: "ms-test-user"}))
+
+	l.maintain(now)
+
+	var names []string
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	require.Equal(t, []string{
+		"info-test-ms-order-2019-07-15.log",
+		"x-access-prod-ms-test-user-2019-07-16.log",
+		"x-access-prod-ms-test-user.meta.json",
+	}, names)
+}
+
+func TestLocalOutput_Queue(t *testing.T) {
+	dir := "/tmp/logtubed-local-test-queue"
+	require.NoError(t, os.RemoveAll(dir))
+
+	varDropped := &expvar.Int{}
+	o, err := NewLocalOutput(LocalOutputOptions{
+		Dir:         dir,
+		Format:      LocalOutputFormatJSON,
+		Shards:      2,
+		QueueSize:   2,
+		QueuePolicy: LocalOutputQueueDrop,
+		Fsync:       LocalOutputFsyncInterval,
+		VarDropped:  varDropped,
+	})
+	require.NoError(t, err)
+
+	// not running, shard of the index queues one event, the rest are dropped
+	e := types.Event{Timestamp: time.Date(2019, 7, 16, 11, 0, 0, 0, time.UTC), Topic: "info", Env: "test", Project: "order", Message: "hello"}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, o.ConsumeEvent(e))
+	}
+	require.Equal(t, int64(2), varDropped.Value())
+
+	// queued events are drained and flushed on shutdown
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	ctxCancel()
+	require.NoError(t, o.Run(ctx))
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "info-test-order-2019-07-16.log"))
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(buf), "\n"))
+
+	_, err = NewLocalOutput(LocalOutputOptions{Dir: dir, Fsync: "sometimes"})
+	require.Error(t, err)
+}
+
+func TestSplitLocalOutputPrefix(t *testing.T) {
+	cases := []struct {
+		prefix  string
+		topic   string
+		env     string
+		project string
+		ok      bool
+	}{
+		{"x-access-prod-ms-order", "x-access", "prod", "ms-order", true},
+		{"info-local-order", "info", "local", "order", true},
+		{"info-prod-ms-test-order", "info", "prod", "ms-test-order", true},
+		{"err-prod-dev-tools", "err", "prod", "dev-tools", true},
+		{"x-redis-track-uat-ms-order", "x-redis-track", "uat", "ms-order", true},
+		{"x-test-report-prod-ms", "x-test-report", "prod", "ms", true},
+		{"x-access-local-order", "x-access", "local", "order", true},
+		{"x-access-prod-ms-test-order", "", "", "", false},
+		{"x-redis-track-local-ms-order", "", "", "", false},
+		{"info-prod", "", "", "", false},
+		{"x-access-prod-", "", "", "", false},
+	}
+	for _, c := range cases {
+		topic, env, project, ok := splitLocalOutputPrefix(c.prefix)
+		require.Equal(t, c.ok, ok, c.prefix)
+		if ok {
+			require.Equal(t, []string{c.topic, c.env, c.project}, []string{topic, env, project}, c.prefix)
+		}
+	}
+}
+
+func TestResolveLocalOutputMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-local-meta-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, ok := resolveLocalOutputMeta(dir, "x-access-prod-ms-test-order")
+	require.False(t, ok)
+
+	m := localOutputMeta{Topic: "x-access", Env: "prod", Project: "ms-test-order"}
+	require.NoError(t, writeLocalOutputMeta(dir, m))
+	r, ok := resolveLocalOutputMeta(dir, "x-access-prod-ms-test-order")
+	require.True(t, ok)
+	require.Equal(t, m, r)
 }
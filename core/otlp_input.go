@@ -0,0 +1,151 @@
+package core
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/logtube/logtubed/otlp"
+	"github.com/logtube/logtubed/types"
+	"github.com/rs/zerolog/log"
+	"go.guoyk.net/common"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	OTLPLogsPath = "/v1/logs"
+
+	otlpMaxBodySize = 32 * 1024 * 1024
+)
+
+type OTLPInputOptions struct {
+	Bind string
+	Next types.EventConsumer
+}
+
+type OTLPInput interface {
+	common.Runnable
+	SetBlocked(blocked bool)
+}
+
+// otlpInput receives OpenTelemetry logs over OTLP/HTTP, both JSON and protobuf
+type otlpInput struct {
+	optBind string
+
+	next types.EventConsumer
+
+	blocked bool
+}
+
+func NewOTLPInput(opts OTLPInputOptions) (OTLPInput, error) {
+	if len(opts.Bind) == 0 {
+		opts.Bind = "0.0.0.0:4318"
+	}
+	if opts.Next == nil {
+		return nil, errors.New("OTLPInput: Next is not set")
+	}
+	log.Info().Str("input", "otlp").Interface("opts", opts).Msg("input created")
+	return &otlpInput{
+		optBind: opts.Bind,
+		next:    opts.Next,
+	}, nil
+}
+
+func (o *otlpInput) SetBlocked(blocked bool) {
+	o.blocked = blocked
+}
+
+func (o *otlpInput) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != OTLPLogsPath {
+		http.NotFound(rw, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// refuse on blocked, OTLP exporters retry on 503
+	if o.blocked {
+		http.Error(rw, "blocked", http.StatusServiceUnavailable)
+		return
+	}
+
+	var err error
+	var body io.Reader = http.MaxBytesReader(rw, req.Body, otlpMaxBodySize)
+	if strings.EqualFold(req.Header.Get("Content-Encoding"), "gzip") {
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(body); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gr.Close()
+		body = io.LimitReader(gr, otlpMaxBodySize)
+	}
+
+	var buf []byte
+	if buf, err = ioutil.ReadAll(body); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	isJSON := strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
+
+	var r otlp.LogsRequest
+	if isJSON {
+		r, err = otlp.UnmarshalLogsRequestJSON(buf)
+	} else {
+		r, err = otlp.UnmarshalLogsRequestProto(buf)
+	}
+	if err != nil {
+		log.Debug().Err(err).Str("input", "otlp").Msg("failed to unmarshal logs request")
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	es := r.ToEvents()
+	for _, e := range es {
+		// size of the whole request shared by all records
+		e.RawSize = len(buf) / len(es)
+		log.Debug().Str("input", "otlp").Interface("event", e).Msg("new event")
+		if err = o.next.ConsumeEvent(e); err != nil {
+			log.Error().Err(err).Str("input", "otlp").Msg("failed to delivery event to next")
+		}
+	}
+
+	// empty ExportLogsServiceResponse
+	if isJSON {
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte("{}"))
+	} else {
+		rw.Header().Set("Content-Type", "application/x-protobuf")
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+func (o *otlpInput) Run(ctx context.Context) error {
+	log.Info().Str("input", "otlp").Msg("started")
+	defer log.Info().Str("input", "otlp").Msg("stopped")
+
+	l, err := net.Listen("tcp", o.optBind)
+	if err != nil {
+		log.Error().Err(err).Str("input", "otlp").Msg("failed to listen")
+		return err
+	}
+
+	s := &http.Server{Handler: o}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(l)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return s.Shutdown(context.Background())
+	case err = <-done:
+		return err
+	}
+}
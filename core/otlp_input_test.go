@@ -0,0 +1,44 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/logtube/logtubed/types"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOTLPInput_ServeHTTP(t *testing.T) {
+	eo := &testEventConsumer{data: make(chan types.Event, 5)}
+
+	o, err := NewOTLPInput(OTLPInputOptions{Next: eo})
+	require.NoError(t, err)
+
+	body := &bytes.Buffer{}
+	zw := gzip.NewWriter(body)
+	_, _ = zw.Write([]byte(`{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"ms-order"}},{"key":"deployment.environment","value":{"stringValue":"test"}}]},"scopeLogs":[{"logRecords":[{"timeUnixNano":"1597403361727000000","severityText":"WARN","traceId":"5b8efff798038103d269b633813fc60c","body":{"stringValue":"hello"}}]}]}]}`))
+	_ = zw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, OTLPLogsPath, body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	rw := httptest.NewRecorder()
+	o.(http.Handler).ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, "{}", rw.Body.String())
+
+	e := <-eo.data
+	require.Equal(t, "ms-order", e.Project)
+	require.Equal(t, "test", e.Env)
+	require.Equal(t, "warn", e.Topic)
+	require.Equal(t, "5b8efff798038103d269b633813fc60c", e.Crid)
+	require.NotZero(t, e.RawSize)
+
+	o.SetBlocked(true)
+	req = httptest.NewRequest(http.MethodPost, OTLPLogsPath, bytes.NewReader([]byte{}))
+	rw = httptest.NewRecorder()
+	o.(http.Handler).ServeHTTP(rw, req)
+	require.Equal(t, http.StatusServiceUnavailable, rw.Code)
+}
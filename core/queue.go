@@ -8,14 +8,27 @@ import (
 	"github.com/rs/zerolog/log"
 	"go.guoyk.net/common"
 	"go.guoyk.net/diskqueue"
+	"io"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// max time to wait for more records when collecting a batch
+	queueBatchLinger = time.Millisecond * 5
+)
+
 type QueueOptions struct {
 	Dir       string
 	Name      string
 	SyncEvery int
+	Compress  bool // compress large Op bodies
+	BatchSize int  // max Ops handed over at once, only if Next is a BatchOpConsumer
+
+	// journal batches until acknowledged, only if Next is a AckOpConsumer, failed batches are put back to diskqueue,
+	// unacknowledged batches are delivered again on restart, costs a fsync per batch
+	AtLeastOnce bool
 
 	Next types.OpConsumer
 
@@ -27,16 +40,24 @@ type QueueOptions struct {
 type Queue interface {
 	types.OpConsumer
 	common.Runnable
+	Drainable
 }
 
 type queue struct {
+	inflight int64 // ops read from diskqueue but not yet handed over, first for 64-bit alignment
+
 	optDir       string
 	optName      string
 	optSyncEvery int
+	optCompress  bool
+	optBatchSize int
 
-	dq diskqueue.DiskQueue
+	dq      diskqueue.DiskQueue
+	journal *queueJournal
 
-	next types.OpConsumer
+	next      types.OpConsumer
+	nextBatch types.BatchOpConsumer
+	nextAck   types.AckOpConsumer
 
 	varInput  *expvar.Int
 	varOutput *expvar.Int
@@ -56,6 +77,9 @@ func NewQueue(opts QueueOptions) (Queue, error) {
 	if opts.SyncEvery <= 0 {
 		opts.SyncEvery = 100
 	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
 	log.Info().Interface("opts", opts).Msg("queue created")
 	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
 		return nil, err
@@ -64,14 +88,33 @@ func NewQueue(opts QueueOptions) (Queue, error) {
 		optDir:       opts.Dir,
 		optName:      opts.Name,
 		optSyncEvery: opts.SyncEvery,
+		optCompress:  opts.Compress,
+		optBatchSize: opts.BatchSize,
 		next:         opts.Next,
 		varInput:     opts.VarInput,
 		varOutput:    opts.VarOutput,
 		varDepth:     opts.VarDepth,
 	}
+	q.nextBatch, _ = opts.Next.(types.BatchOpConsumer)
+	if opts.AtLeastOnce {
+		if q.nextAck, _ = opts.Next.(types.AckOpConsumer); q.nextAck == nil {
+			return nil, errors.New("queue: Next does not support acknowledgement")
+		}
+	}
 	return q, nil
 }
 
+func newDiskQueue(name, dir string, syncEvery int) diskqueue.DiskQueue {
+	return diskqueue.New(name,
+		dir,
+		256*1024*1024,
+		20,
+		2*1024*1024,
+		int64(syncEvery),
+		time.Second*20,
+	)
+}
+
 func (q *queue) ConsumeOp(op types.Op) error {
 	dq := q.dq
 	if dq == nil {
@@ -80,24 +123,161 @@ func (q *queue) ConsumeOp(op types.Op) error {
 	if q.varInput != nil {
 		q.varInput.Add(1)
 	}
-	return dq.Put(types.OpMarshal(op))
+	return dq.Put(marshalQueueOp(op, q.optCompress))
+}
+
+// marshalQueueOp encode a Op for diskqueue, with enqueue time recorded
+func marshalQueueOp(op types.Op, compress bool) []byte {
+	if op.EnqueuedAt.IsZero() {
+		op.EnqueuedAt = time.Now()
+	}
+	if compress {
+		return types.OpMarshalCompressed(op)
+	}
+	return types.OpMarshal(op)
+}
+
+// Pending ops in diskqueue, ops read but not yet handed over and ops handed over but not yet acknowledged
+func (q *queue) Pending() (n int64) {
+	if dq := q.dq; dq != nil {
+		n += dq.Depth()
+	}
+	n += atomic.LoadInt64(&q.inflight)
+	n += q.unacked()
+	return
+}
+
+func (q *queue) unacked() int64 {
+	if q.journal == nil {
+		return 0
+	}
+	return int64(q.journal.Pending())
+}
+
+func (q *queue) decode(buf []byte) (op types.Op, ok bool) {
+	if q.varOutput != nil {
+		q.varOutput.Add(1)
+	}
+	var err error
+	if op, err = types.OpUnmarshal(buf); err != nil {
+		log.Error().Err(err).Msg("Queue: failed to unmarshal Op")
+		return
+	}
+	ok = true
+	return
+}
+
+// consumeBatch collect Ops already available in diskqueue, up to BatchSize, and hand them over at once,
+// the first record is counted as in flight by caller, all records are released once handed over
+func (q *queue) consumeBatch(dq diskqueue.DiskQueue, buf []byte) {
+	read := int64(1)
+	defer func() { atomic.AddInt64(&q.inflight, -read) }()
+	ops := make([]types.Op, 0, q.optBatchSize)
+	if op, ok := q.decode(buf); ok {
+		ops = append(ops, op)
+	}
+	var linger *time.Timer
+collect:
+	for len(ops) < q.optBatchSize {
+		select {
+		case buf = <-dq.ReadChan():
+		default:
+			// diskqueue hands over records one by one, wait a moment for the next one
+			if linger == nil {
+				linger = time.NewTimer(queueBatchLinger)
+				defer linger.Stop()
+			}
+			select {
+			case buf = <-dq.ReadChan():
+			case <-linger.C:
+				break collect
+			}
+		}
+		read++
+		atomic.AddInt64(&q.inflight, 1)
+		if op, ok := q.decode(buf); ok {
+			ops = append(ops, op)
+		}
+	}
+	if len(ops) == 0 {
+		return
+	}
+	if q.journal != nil {
+		seq, err := q.journal.Append(ops)
+		if err == nil {
+			q.deliverAck(dq, seq, ops)
+			return
+		}
+		log.Error().Err(err).Int("count", len(ops)).Msg("Queue: failed to journal batch, delivering without acknowledgement")
+	}
+	if err := q.nextBatch.ConsumeOps(ops); err != nil {
+		log.Error().Err(err).Int("count", len(ops)).Msg("Queue: BatchOpConsumer failed to ConsumeOps")
+	}
+}
+
+// deliverAck hand over a journaled batch, the batch is acknowledged once delivered, or put back to diskqueue if failed
+func (q *queue) deliverAck(dq diskqueue.DiskQueue, seq uint64, ops []types.Op) {
+	journal := q.journal
+	if err := q.nextAck.ConsumeOpsAck(ops, func(err error) {
+		if err == nil {
+			journal.Ack(seq)
+			return
+		}
+		// requeue, stops at first failure, i.e. diskqueue closed, ops not yet requeued stay in journal
+		// and are delivered again on restart, requeued ones are not
+		for i, op := range ops {
+			if err1 := dq.Put(marshalQueueOp(op, q.optCompress)); err1 != nil {
+				log.Error().Err(err1).Str("queue", q.optName).Int("count", len(ops)-i).Msg("Queue: failed to requeue failed batch, keeping the rest in journal")
+				if i > 0 {
+					if err2 := journal.Replace(seq, ops[i:]); err2 != nil {
+						log.Error().Err(err2).Str("queue", q.optName).Msg("Queue: failed to journal rest of failed batch")
+					}
+				}
+				return
+			}
+		}
+		journal.Ack(seq)
+		log.Warn().Err(err).Str("queue", q.optName).Int("count", len(ops)).Msg("failed batch requeued")
+	}); err != nil {
+		log.Error().Err(err).Int("count", len(ops)).Msg("Queue: AckOpConsumer failed to ConsumeOpsAck")
+	}
 }
 
 func (q *queue) Run(ctx context.Context) error {
 	log.Info().Str("queue", q.optName).Msg("started")
 	defer log.Info().Str("queue", q.optName).Msg("stopped")
 
+	// open journal
+	var unacked []queueJournalBatch
+	if q.nextAck != nil {
+		journal, batches, err := openQueueJournal(q.optDir, q.optName)
+		if err != nil {
+			return err
+		}
+		defer journal.Close()
+		q.journal = journal
+		unacked = batches
+	}
+
+	// restore files of a interrupted purge
+	if err := recoverQueuePurge(q.optDir, q.optName); err != nil {
+		return err
+	}
+
 	// create and assign diskqueue
-	dq := diskqueue.New(q.optName,
-		q.optDir,
-		256*1024*1024,
-		20,
-		2*1024*1024,
-		int64(q.optSyncEvery),
-		time.Second*20,
-	)
+	dq := newDiskQueue(q.optName, q.optDir, q.optSyncEvery)
 	q.dq = dq
 
+	// deliver unacknowledged batches of previous run first
+	var count int
+	for _, b := range unacked {
+		count += len(b.ops)
+		q.deliverAck(dq, b.seq, b.ops)
+	}
+	if count > 0 {
+		log.Info().Str("queue", q.optName).Int("count", count).Msg("unacknowledged ops redelivered")
+	}
+
 	// create depth stats ticker
 	st := time.NewTicker(time.Second)
 	defer st.Stop()
@@ -106,20 +286,18 @@ loop:
 	for {
 		select {
 		case buf := <-dq.ReadChan():
-			if q.varOutput != nil {
-				q.varOutput.Add(1)
-			}
-
-			var op types.Op
-			var err error
-			if op, err = types.OpUnmarshal(buf); err != nil {
-				log.Error().Err(err).Msg("Queue: failed to unmarshal Op")
+			// diskqueue depth drops once read, count it as in flight until handed over
+			atomic.AddInt64(&q.inflight, 1)
+			if q.nextBatch != nil {
+				q.consumeBatch(dq, buf)
 				continue loop
 			}
-			if err = q.next.ConsumeOp(op); err != nil {
-				log.Error().Err(err).Msg("Queue: OpConsumer failed to ConsumeOp")
-				continue loop
+			if op, ok := q.decode(buf); ok {
+				if err := q.next.ConsumeOp(op); err != nil {
+					log.Error().Err(err).Msg("Queue: OpConsumer failed to ConsumeOp")
+				}
 			}
+			atomic.AddInt64(&q.inflight, -1)
 		case <-st.C:
 			if q.varDepth != nil {
 				q.varDepth.Set(dq.Depth())
@@ -132,5 +310,42 @@ loop:
 	// clear diskqueue
 	q.dq = nil
 
+	log.Info().Str("queue", q.optName).Int64("depth", dq.Depth()).Int64("unacked", q.unacked()).Msg("ops remaining on disk")
+
 	return dq.Close()
 }
+
+// QueueWriter appends Ops to a disk queue without consuming it, the daemon owning the queue must be stopped
+type QueueWriter interface {
+	types.OpConsumer
+	io.Closer
+}
+
+type queueWriter struct {
+	dq       diskqueue.DiskQueue
+	compress bool
+}
+
+func NewQueueWriter(opts QueueOptions) (QueueWriter, error) {
+	if len(opts.Dir) == 0 {
+		return nil, errors.New("queue: Dir is not set")
+	}
+	if len(opts.Name) == 0 {
+		return nil, errors.New("queue: Name is not set")
+	}
+	if opts.SyncEvery <= 0 {
+		opts.SyncEvery = 100
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return &queueWriter{dq: newDiskQueue(opts.Name, opts.Dir, opts.SyncEvery), compress: opts.Compress}, nil
+}
+
+func (w *queueWriter) ConsumeOp(op types.Op) error {
+	return w.dq.Put(marshalQueueOp(op, w.compress))
+}
+
+func (w *queueWriter) Close() error {
+	return w.dq.Close()
+}
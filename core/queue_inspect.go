@@ -0,0 +1,484 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/logtube/logtubed/types"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the following helpers read diskqueue files directly, the daemon owning the queue must be stopped
+
+var (
+	// ErrQueueScanStop returned by a ScanQueue callback to stop scanning without error
+	ErrQueueScanStop = errors.New("queue: scan stopped")
+)
+
+type queueMeta struct {
+	Depth        int64
+	ReadFileNum  int64
+	ReadPos      int64
+	WriteFileNum int64
+	WritePos     int64
+}
+
+func queueMetaFile(dir, name string) string {
+	return filepath.Join(dir, name+".diskqueue.meta.dat")
+}
+
+func queueDataFile(dir, name string, num int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.diskqueue.%06d.dat", name, num))
+}
+
+// readQueueMeta read the diskqueue metadata file, a missing file means an empty queue
+func readQueueMeta(dir, name string) (m queueMeta, err error) {
+	var f *os.File
+	if f, err = os.Open(queueMetaFile(dir, name)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+	if _, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n", &m.Depth, &m.ReadFileNum, &m.ReadPos, &m.WriteFileNum, &m.WritePos); err != nil {
+		err = fmt.Errorf("queue: invalid metadata file: %s", err.Error())
+	}
+	return
+}
+
+// listQueueFiles list all files belongs to a diskqueue, including the metadata file
+func listQueueFiles(dir, name string) (files []QueueFile, err error) {
+	var infos []os.FileInfo
+	if infos, err = ioutil.ReadDir(dir); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasPrefix(info.Name(), name+".diskqueue.") || !strings.HasSuffix(info.Name(), ".dat") {
+			continue
+		}
+		files = append(files, QueueFile{Name: info.Name(), Size: info.Size()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return
+}
+
+// ScanQueue iterate over pending records of a diskqueue in order, without consuming them
+func ScanQueue(dir, name string, fn func(buf []byte) error) (err error) {
+	var m queueMeta
+	if m, err = readQueueMeta(dir, name); err != nil {
+		return
+	}
+	for num := m.ReadFileNum; num <= m.WriteFileNum; num++ {
+		var pos, end int64 = 0, -1
+		if num == m.ReadFileNum {
+			pos = m.ReadPos
+		}
+		if num == m.WriteFileNum {
+			end = m.WritePos
+		}
+		if err = scanQueueFile(queueDataFile(dir, name, num), pos, end, fn); err != nil {
+			if err == ErrQueueScanStop {
+				err = nil
+			}
+			return
+		}
+	}
+	return
+}
+
+// scanQueueFile read length-prefixed records from pos, until end or EOF if end < 0
+func scanQueueFile(file string, pos, end int64, fn func(buf []byte) error) (err error) {
+	var f *os.File
+	if f, err = os.Open(file); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+	if _, err = f.Seek(pos, io.SeekStart); err != nil {
+		return
+	}
+	r := bufio.NewReader(f)
+	for end < 0 || pos < end {
+		var size int32
+		if err = binary.Read(r, binary.BigEndian, &size); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if size < 0 || (end >= 0 && pos+4+int64(size) > end) {
+			return fmt.Errorf("queue: corrupted record at %s:%d", file, pos)
+		}
+		buf := make([]byte, size)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return fmt.Errorf("queue: truncated record at %s:%d", file, pos)
+		}
+		pos += 4 + int64(size)
+		if err = fn(buf); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// loadQueueJournal read journal of a diskqueue without modifying it
+func loadQueueJournal(dir, name string) (j *queueJournal, err error) {
+	j = &queueJournal{file: queueJournalFile(dir, name), pending: map[uint64][]types.Op{}}
+	err = j.load()
+	return
+}
+
+// scanQueueOps iterate over unacknowledged ops in journal, then pending ops of diskqueue, in the order they are delivered on start
+func scanQueueOps(dir, name string, fn func(op types.Op) error) (err error) {
+	var j *queueJournal
+	if j, err = loadQueueJournal(dir, name); err != nil {
+		return
+	}
+	seqs := make([]uint64, 0, len(j.pending))
+	for seq := range j.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, k int) bool { return seqs[i] < seqs[k] })
+	for _, seq := range seqs {
+		for _, op := range j.pending[seq] {
+			if err = fn(op); err != nil {
+				if err == ErrQueueScanStop {
+					err = nil
+				}
+				return
+			}
+		}
+	}
+	return ScanQueue(dir, name, func(buf []byte) error {
+		op, err := types.OpUnmarshal(buf)
+		if err != nil {
+			return err
+		}
+		return fn(op)
+	})
+}
+
+type QueueFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+type QueueStats struct {
+	Name      string           `json:"name"`
+	Depth     int64            `json:"depth"`   // depth recorded in metadata
+	Records   int64            `json:"records"` // records actually found in data files
+	Invalid   int64            `json:"invalid"` // records failed to decode
+	Unacked   int64            `json:"unacked"` // ops in journal not yet acknowledged, delivered again on start
+	Files     []QueueFile      `json:"files"`
+	TotalSize int64            `json:"total_size"`
+	Oldest    time.Time        `json:"oldest"`
+	Newest    time.Time        `json:"newest"`
+	Indexes   map[string]int64 `json:"indexes"`
+}
+
+// queueOpTimestamp extract the "timestamp" field from the JSON body of a Op
+func queueOpTimestamp(op types.Op) (t time.Time, ok bool) {
+	var body struct {
+		Timestamp string `json:"timestamp"`
+	}
+	if json.Unmarshal(op.Body, &body) != nil {
+		return
+	}
+	var err error
+	if t, err = time.Parse(time.RFC3339Nano, body.Timestamp); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// InspectQueue collect depth, file sizes, oldest / newest event time and per index counts of a diskqueue
+func InspectQueue(dir, name string) (s QueueStats, err error) {
+	s.Name = name
+	s.Indexes = map[string]int64{}
+	var m queueMeta
+	if m, err = readQueueMeta(dir, name); err != nil {
+		return
+	}
+	s.Depth = m.Depth
+	if s.Files, err = listQueueFiles(dir, name); err != nil {
+		return
+	}
+	for _, f := range s.Files {
+		s.TotalSize += f.Size
+	}
+	var j *queueJournal
+	if j, err = loadQueueJournal(dir, name); err != nil {
+		return
+	}
+	s.Unacked = int64(j.Pending())
+	err = ScanQueue(dir, name, func(buf []byte) error {
+		s.Records++
+		op, err := types.OpUnmarshal(buf)
+		if err != nil {
+			s.Invalid++
+			return nil
+		}
+		s.Indexes[op.Index]++
+		if t, ok := queueOpTimestamp(op); ok {
+			if s.Oldest.IsZero() || t.Before(s.Oldest) {
+				s.Oldest = t
+			}
+			if t.After(s.Newest) {
+				s.Newest = t
+			}
+		}
+		return nil
+	})
+	return
+}
+
+type queueDumpRecord struct {
+	Index string          `json:"index"`
+	Body  json.RawMessage `json:"body,omitempty"`
+	Raw   string          `json:"raw,omitempty"` // body which is not valid JSON
+}
+
+func writeQueueDumpRecord(w io.Writer, op types.Op) (err error) {
+	rec := queueDumpRecord{Index: op.Index}
+	if json.Valid(op.Body) {
+		rec.Body = op.Body
+	} else {
+		rec.Raw = string(op.Body)
+	}
+	var buf []byte
+	if buf, err = json.Marshal(rec); err != nil {
+		return
+	}
+	_, err = w.Write(append(buf, '\n'))
+	return
+}
+
+// PeekQueue decode at most n records from the head of a diskqueue, unacknowledged ops in journal come first
+func PeekQueue(dir, name string, n int) (ops []types.Op, err error) {
+	if n <= 0 {
+		return
+	}
+	err = scanQueueOps(dir, name, func(op types.Op) error {
+		ops = append(ops, op)
+		if len(ops) >= n {
+			return ErrQueueScanStop
+		}
+		return nil
+	})
+	return
+}
+
+// DumpQueue export all records of a diskqueue as NDJSON, one {"index", "body"} object per line,
+// including unacknowledged ops in journal
+func DumpQueue(dir, name string, w io.Writer) (count int64, err error) {
+	err = scanQueueOps(dir, name, func(op types.Op) error {
+		if err := writeQueueDumpRecord(w, op); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return
+}
+
+// DrainQueue export all records of a diskqueue as NDJSON, then empty the diskqueue and remove the journal,
+// w is synced and closed if supported before anything is removed, so records are never dropped unwritten
+func DrainQueue(dir, name string, w io.Writer) (count int64, err error) {
+	if count, err = DumpQueue(dir, name, w); err != nil {
+		return
+	}
+	if s, ok := w.(interface{ Sync() error }); ok {
+		if err = s.Sync(); err != nil {
+			return
+		}
+	}
+	if c, ok := w.(io.Closer); ok {
+		if err = c.Close(); err != nil {
+			return
+		}
+	}
+	dq := newDiskQueue(name, dir, 1)
+	if err = dq.Empty(); err != nil {
+		_ = dq.Close()
+		return
+	}
+	if err = dq.Close(); err != nil {
+		return
+	}
+	if err = os.Remove(queueJournalFile(dir, name)); err != nil && os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// filterQueueJournal load journal and remove ops with index starting with prefix in memory, batches left empty are removed
+func filterQueueJournal(dir, name string, prefix string) (j *queueJournal, purged int64, kept int64, err error) {
+	if j, err = loadQueueJournal(dir, name); err != nil {
+		return
+	}
+	for seq, ops := range j.pending {
+		var remaining []types.Op
+		for _, op := range ops {
+			if strings.HasPrefix(op.Index, prefix) {
+				purged++
+				continue
+			}
+			kept++
+			remaining = append(remaining, op)
+		}
+		if len(remaining) == 0 {
+			delete(j.pending, seq)
+		} else {
+			j.pending[seq] = remaining
+		}
+	}
+	return
+}
+
+// queuePurgeBackupName name of original files moved aside while rewritten files are swapped in
+func queuePurgeBackupName(name string) string {
+	return name + ".purge-backup"
+}
+
+// recoverQueuePurge restore original files of a purge interrupted while swapping files,
+// metadata file is renamed last, once it is in backup all originals are, and files already swapped in are discarded
+func recoverQueuePurge(dir, name string) (err error) {
+	backup := queuePurgeBackupName(name)
+	var files []QueueFile
+	if files, err = listQueueFiles(dir, backup); err != nil || len(files) == 0 {
+		return
+	}
+	if _, err = os.Stat(queueMetaFile(dir, backup)); err == nil {
+		if err = removeQueueFiles(dir, name); err != nil {
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	if err = renameQueueFiles(dir, backup, name); err != nil {
+		return
+	}
+	log.Warn().Str("queue", name).Msg("queue files restored from interrupted purge")
+	return
+}
+
+// PurgeQueue remove all records with index starting with prefix, including unacknowledged ops in journal,
+// remaining records are rewritten in order, original files are kept until rewritten ones are in place,
+// journal is rewritten last
+func PurgeQueue(dir, name string, prefix string) (purged int64, kept int64, err error) {
+	if len(prefix) == 0 {
+		err = errors.New("queue: prefix is not set")
+		return
+	}
+	if err = recoverQueuePurge(dir, name); err != nil {
+		return
+	}
+	var j *queueJournal
+	var jPurged int64
+	if j, jPurged, kept, err = filterQueueJournal(dir, name, prefix); err != nil {
+		return
+	}
+	purged = jPurged
+
+	tmpName := name + ".purging"
+
+	// remove leftovers of previous failed purge
+	if err = removeQueueFiles(dir, tmpName); err != nil {
+		return
+	}
+
+	tmp := newDiskQueue(tmpName, dir, 1000)
+	if err = ScanQueue(dir, name, func(buf []byte) error {
+		op, err := types.OpUnmarshal(buf)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(op.Index, prefix) {
+			purged++
+			return nil
+		}
+		kept++
+		return tmp.Put(buf)
+	}); err != nil {
+		_ = tmp.Close()
+		_ = removeQueueFiles(dir, tmpName)
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+
+	// move original files aside, swap rewritten ones in, then remove originals, metadata file does not contain the name
+	backup := queuePurgeBackupName(name)
+	if err = removeQueueFiles(dir, backup); err != nil {
+		return
+	}
+	if err = renameQueueFiles(dir, name, backup); err != nil {
+		_ = recoverQueuePurge(dir, name)
+		return
+	}
+	if err = renameQueueFiles(dir, tmpName, name); err != nil {
+		_ = recoverQueuePurge(dir, name)
+		return
+	}
+	if err = removeQueueFiles(dir, backup); err != nil {
+		return
+	}
+
+	// rewrite journal last, a failed purge leaves it untouched
+	if jPurged > 0 {
+		j.lock.Lock()
+		err = j.compact()
+		j.lock.Unlock()
+		if err != nil {
+			return
+		}
+		err = j.Close()
+	}
+	return
+}
+
+// renameQueueFiles rename all files of diskqueue from to diskqueue to, metadata file is renamed last
+func renameQueueFiles(dir, from, to string) (err error) {
+	var files []QueueFile
+	if files, err = listQueueFiles(dir, from); err != nil {
+		return
+	}
+	meta := filepath.Base(queueMetaFile(dir, from))
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Name != meta && files[j].Name == meta })
+	for _, f := range files {
+		if err = os.Rename(filepath.Join(dir, f.Name), filepath.Join(dir, to+strings.TrimPrefix(f.Name, from))); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func removeQueueFiles(dir, name string) (err error) {
+	var files []QueueFile
+	if files, err = listQueueFiles(dir, name); err != nil {
+		return
+	}
+	for _, f := range files {
+		if err = os.Remove(filepath.Join(dir, f.Name)); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,206 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/logtube/logtubed/types"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-queue-inspect")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewQueueWriter(QueueOptions{Dir: dir, Name: "test"})
+	require.NoError(t, err)
+	t0 := time.Date(2020, 8, 14, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		e := types.Event{Timestamp: t0.Add(time.Minute * time.Duration(i)), Env: "test", Project: "order", Topic: "info", Message: "hello"}
+		if i%2 == 1 {
+			e.Topic = "debug"
+		}
+		require.NoError(t, w.ConsumeOp(e.ToOp()))
+	}
+	require.NoError(t, w.Close())
+
+	s, err := InspectQueue(dir, "test")
+	require.NoError(t, err)
+	require.Equal(t, int64(10), s.Depth)
+	require.Equal(t, int64(10), s.Records)
+	require.Equal(t, int64(0), s.Invalid)
+	require.Equal(t, t0, s.Oldest)
+	require.Equal(t, t0.Add(time.Minute*9), s.Newest)
+	require.Equal(t, int64(5), s.Indexes["debug-test-2020-08-14"])
+	require.NotEmpty(t, s.Files)
+
+	ops, err := PeekQueue(dir, "test", 3)
+	require.NoError(t, err)
+	require.Len(t, ops, 3)
+	require.Equal(t, "info-test-2020-08-14", ops[0].Index)
+	require.Equal(t, "debug-test-2020-08-14", ops[1].Index)
+
+	buf := &bytes.Buffer{}
+	n, err := DumpQueue(dir, "test", buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), n)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 10)
+	var rec map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &rec))
+	require.Equal(t, "info-test-2020-08-14", rec["index"])
+	require.Equal(t, "hello", rec["body"].(map[string]interface{})["message"])
+
+	purged, kept, err := PurgeQueue(dir, "test", "debug-")
+	require.NoError(t, err)
+	require.Equal(t, int64(5), purged)
+	require.Equal(t, int64(5), kept)
+
+	s, err = InspectQueue(dir, "test")
+	require.NoError(t, err)
+	require.Equal(t, int64(5), s.Depth)
+	require.Equal(t, int64(5), s.Records)
+	require.Equal(t, int64(0), s.Indexes["debug-test-2020-08-14"])
+	require.Equal(t, t0.Add(time.Minute*8), s.Newest)
+
+	buf.Reset()
+	n, err = DrainQueue(dir, "test", buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), n)
+
+	s, err = InspectQueue(dir, "test")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), s.Depth)
+	require.Equal(t, int64(0), s.Records)
+}
+
+func TestQueueInspect_Journal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-queue-inspect-journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewQueueWriter(QueueOptions{Dir: dir, Name: "test"})
+	require.NoError(t, err)
+	require.NoError(t, w.ConsumeOp(types.Op{Index: "info-test-2020-08-14", Body: []byte(`{"message":"queued"}`)}))
+	require.NoError(t, w.Close())
+
+	// unacknowledged batch left by a previous run
+	j, _, err := openQueueJournal(dir, "test")
+	require.NoError(t, err)
+	_, err = j.Append([]types.Op{
+		{Index: "debug-test-2020-08-14", Body: []byte(`{"message":"unacked-1"}`)},
+		{Index: "info-test-2020-08-14", Body: []byte(`{"message":"unacked-2"}`)},
+	})
+	require.NoError(t, err)
+	require.NoError(t, j.Close())
+
+	ops, err := PeekQueue(dir, "test", 10)
+	require.NoError(t, err)
+	require.Len(t, ops, 3)
+	require.Equal(t, "debug-test-2020-08-14", ops[0].Index)
+
+	buf := &bytes.Buffer{}
+	n, err := DumpQueue(dir, "test", buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+	require.Contains(t, buf.String(), "unacked-2")
+
+	purged, kept, err := PurgeQueue(dir, "test", "debug-")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), purged)
+	require.Equal(t, int64(2), kept)
+
+	s, err := InspectQueue(dir, "test")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), s.Unacked)
+
+	buf.Reset()
+	n, err = DrainQueue(dir, "test", buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+	require.NotContains(t, buf.String(), "unacked-1")
+
+	// nothing delivered again on next start
+	s, err = InspectQueue(dir, "test")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), s.Unacked)
+	require.Equal(t, int64(0), s.Records)
+}
+
+type testFailingCloser struct {
+	bytes.Buffer
+}
+
+func (c *testFailingCloser) Close() error {
+	return errors.New("disk full")
+}
+
+func TestQueueInspect_DrainCloseFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-queue-inspect-drain")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewQueueWriter(QueueOptions{Dir: dir, Name: "test"})
+	require.NoError(t, err)
+	require.NoError(t, w.ConsumeOp(types.Op{Index: "info-test-2020-08-14", Body: []byte(`{"message":"hello"}`)}))
+	require.NoError(t, w.Close())
+
+	_, err = DrainQueue(dir, "test", &testFailingCloser{})
+	require.Error(t, err)
+
+	// queue is left untouched
+	s, err := InspectQueue(dir, "test")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), s.Records)
+}
+
+func TestQueueInspect_PurgeRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-queue-inspect-recover")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeQueue := func(name string, n int) {
+		w, err := NewQueueWriter(QueueOptions{Dir: dir, Name: name})
+		require.NoError(t, err)
+		for i := 0; i < n; i++ {
+			require.NoError(t, w.ConsumeOp(types.Op{Index: "info-test-2020-08-14", Body: []byte(`{"message":"hello"}`)}))
+		}
+		require.NoError(t, w.Close())
+	}
+	records := func() int64 {
+		s, err := InspectQueue(dir, "test")
+		require.NoError(t, err)
+		return s.Records
+	}
+	backup := queuePurgeBackupName("test")
+
+	// interrupted while moving originals aside, metadata file not yet moved
+	writeQueue("test", 10)
+	require.NoError(t, os.Rename(queueDataFile(dir, "test", 0), queueDataFile(dir, backup, 0)))
+	require.NoError(t, recoverQueuePurge(dir, "test"))
+	require.Equal(t, int64(10), records())
+
+	// interrupted while swapping rewritten files in, originals are all in backup
+	require.NoError(t, renameQueueFiles(dir, "test", backup))
+	writeQueue("test", 1)
+	require.NoError(t, recoverQueuePurge(dir, "test"))
+	require.Equal(t, int64(10), records())
+	files, err := listQueueFiles(dir, backup)
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	// purge recovers before rewriting
+	require.NoError(t, renameQueueFiles(dir, "test", backup))
+	writeQueue("test", 1)
+	purged, kept, err := PurgeQueue(dir, "test", "debug-")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), purged)
+	require.Equal(t, int64(10), kept)
+	require.Equal(t, int64(10), records())
+}
@@ -0,0 +1,270 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/logtube/logtubed/types"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// queueJournal records batches handed over to a AckOpConsumer until they are acknowledged,
+// diskqueue advances its read position once a record is read, the journal keeps unacknowledged
+// batches on disk so they are delivered again after a crash or restart
+
+// journal record layout
+
+// batch: 1-byte 'B', 8-bytes seq uint64 (BE), 4-bytes count uint32 (BE), then count * (4-bytes length uint32 (BE), marshalled Op)
+// ack:   1-byte 'A', 8-bytes seq uint64 (BE)
+
+const (
+	queueJournalTypeBatch = 'B'
+	queueJournalTypeAck   = 'A'
+
+	// compact journal once it exceeds this size
+	queueJournalCompactSize = 64 * 1024 * 1024
+)
+
+type queueJournal struct {
+	file string
+
+	lock    sync.Mutex
+	f       *os.File
+	size    int64
+	seq     uint64
+	pending map[uint64][]types.Op
+}
+
+func queueJournalFile(dir, name string) string {
+	return filepath.Join(dir, name+".journal.dat")
+}
+
+type queueJournalBatch struct {
+	seq uint64
+	ops []types.Op
+}
+
+// openQueueJournal open journal file, returns batches not yet acknowledged in order, they keep their seq for acknowledgement
+func openQueueJournal(dir, name string) (j *queueJournal, unacked []queueJournalBatch, err error) {
+	j = &queueJournal{file: queueJournalFile(dir, name), pending: map[uint64][]types.Op{}}
+	if err = j.load(); err != nil {
+		return
+	}
+	for seq, ops := range j.pending {
+		unacked = append(unacked, queueJournalBatch{seq: seq, ops: ops})
+	}
+	sort.Slice(unacked, func(i, k int) bool { return unacked[i].seq < unacked[k].seq })
+	// rewrite journal with unacked batches only
+	if err = j.compact(); err != nil {
+		return
+	}
+	return
+}
+
+func (j *queueJournal) load() (err error) {
+	var f *os.File
+	if f, err = os.Open(j.file); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		var typ byte
+		if typ, err = r.ReadByte(); err != nil {
+			break
+		}
+		var seq uint64
+		if err = binary.Read(r, binary.BigEndian, &seq); err != nil {
+			break
+		}
+		if seq >= j.seq {
+			j.seq = seq + 1
+		}
+		switch typ {
+		case queueJournalTypeBatch:
+			var ops []types.Op
+			if ops, err = readQueueJournalOps(r); err != nil {
+				break
+			}
+			j.pending[seq] = ops
+		case queueJournalTypeAck:
+			delete(j.pending, seq)
+		default:
+			err = errors.New("queue: invalid journal record")
+		}
+		if err != nil {
+			break
+		}
+	}
+	// a partially written last record is discarded, the batch was never handed over
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return
+}
+
+func readQueueJournalOps(r io.Reader) (ops []types.Op, err error) {
+	var count uint32
+	if err = binary.Read(r, binary.BigEndian, &count); err != nil {
+		return
+	}
+	for i := uint32(0); i < count; i++ {
+		var l uint32
+		if err = binary.Read(r, binary.BigEndian, &l); err != nil {
+			return
+		}
+		buf := make([]byte, l)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return
+		}
+		var op types.Op
+		if op, err = types.OpUnmarshal(buf); err != nil {
+			return
+		}
+		ops = append(ops, op)
+	}
+	return
+}
+
+func appendQueueJournalBatch(buf []byte, seq uint64, ops []types.Op) []byte {
+	var h [13]byte
+	h[0] = queueJournalTypeBatch
+	binary.BigEndian.PutUint64(h[1:], seq)
+	binary.BigEndian.PutUint32(h[9:], uint32(len(ops)))
+	buf = append(buf, h[:]...)
+	for _, op := range ops {
+		data := types.OpMarshal(op)
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(data)))
+		buf = append(buf, l[:]...)
+		buf = append(buf, data...)
+	}
+	return buf
+}
+
+// Append journal a batch and sync to disk, returns seq for acknowledgement
+func (j *queueJournal) Append(ops []types.Op) (seq uint64, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.f == nil {
+		err = errors.New("queue: journal closed")
+		return
+	}
+	seq = j.seq
+	j.seq++
+	buf := appendQueueJournalBatch(nil, seq, ops)
+	if _, err = j.f.Write(buf); err != nil {
+		return
+	}
+	j.size += int64(len(buf))
+	if err = j.f.Sync(); err != nil {
+		return
+	}
+	j.pending[seq] = ops
+	return
+}
+
+// Replace rewrite a pending batch with remaining ops and sync to disk, a later batch record of the same seq wins on load
+func (j *queueJournal) Replace(seq uint64, ops []types.Op) (err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.f == nil {
+		err = errors.New("queue: journal closed")
+		return
+	}
+	if _, ok := j.pending[seq]; !ok {
+		return
+	}
+	buf := appendQueueJournalBatch(nil, seq, ops)
+	if _, err = j.f.Write(buf); err != nil {
+		return
+	}
+	j.size += int64(len(buf))
+	if err = j.f.Sync(); err != nil {
+		return
+	}
+	j.pending[seq] = ops
+	return
+}
+
+// Ack mark a batch as delivered, losing a ack record only causes a duplicated delivery, so no sync here
+func (j *queueJournal) Ack(seq uint64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.f == nil {
+		return
+	}
+	if _, ok := j.pending[seq]; !ok {
+		return
+	}
+	delete(j.pending, seq)
+	var buf [9]byte
+	buf[0] = queueJournalTypeAck
+	binary.BigEndian.PutUint64(buf[1:], seq)
+	if _, err := j.f.Write(buf[:]); err != nil {
+		return
+	}
+	j.size += int64(len(buf))
+	if j.size >= queueJournalCompactSize {
+		if err := j.compact(); err != nil {
+			log.Error().Err(err).Str("file", j.file).Msg("Queue: failed to compact journal")
+		}
+	}
+}
+
+// Pending count of Ops not yet acknowledged
+func (j *queueJournal) Pending() (n int) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for _, ops := range j.pending {
+		n += len(ops)
+	}
+	return
+}
+
+// compact rewrite journal with pending batches only, must be called with lock held
+func (j *queueJournal) compact() (err error) {
+	var buf []byte
+	for seq, ops := range j.pending {
+		buf = appendQueueJournalBatch(buf, seq, ops)
+	}
+	tmp := j.file + ".tmp"
+	var f *os.File
+	if f, err = os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
+		return
+	}
+	if _, err = f.Write(buf); err == nil {
+		if err = f.Sync(); err == nil {
+			err = os.Rename(tmp, j.file)
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return
+	}
+	if j.f != nil {
+		_ = j.f.Close()
+	}
+	j.f = f
+	j.size = int64(len(buf))
+	return
+}
+
+func (j *queueJournal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
@@ -1,10 +1,18 @@
 package core
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"github.com/logtube/logtubed/types"
 	"github.com/stretchr/testify/assert"
+	"go.guoyk.net/diskqueue"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -59,5 +67,401 @@ func TestQueue_Run(t *testing.T) {
 	ctxCancel()
 	<-done
 
-	assert.Equal(t, <-oc.data, op)
+	out := <-oc.data
+	assert.Equal(t, op.Index, out.Index)
+	assert.Equal(t, op.Body, out.Body)
+	assert.False(t, out.EnqueuedAt.IsZero(), "should record enqueue time")
+}
+
+// benchOpConsumer mimics ElasticOutput, hands every Op over a unbuffered channel
+type benchOpConsumer struct {
+	och chan types.Op
+}
+
+func (c *benchOpConsumer) ConsumeOp(op types.Op) error {
+	c.och <- op
+	return nil
+}
+
+// benchBatchOpConsumer mimics ElasticOutput with batch support, hands every batch over a unbuffered channel
+type benchBatchOpConsumer struct {
+	benchOpConsumer
+	bch chan []types.Op
+}
+
+func (c *benchBatchOpConsumer) ConsumeOps(ops []types.Op) error {
+	c.bch <- ops
+	return nil
+}
+
+func benchmarkQueue(b *testing.B, batch bool) {
+	dir, err := ioutil.TempDir("", "logtubed-queue-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// prefill queue
+	w, err := NewQueueWriter(QueueOptions{Dir: dir, Name: "bench", SyncEvery: 10000})
+	if err != nil {
+		b.Fatal(err)
+	}
+	op := types.Event{Timestamp: time.Now(), Env: "test", Project: "order", Topic: "info", Message: "hello world"}.ToOp()
+	for i := 0; i < b.N; i++ {
+		if err = w.ConsumeOp(op); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	bc := &benchBatchOpConsumer{benchOpConsumer: benchOpConsumer{och: make(chan types.Op)}, bch: make(chan []types.Op)}
+	var next types.OpConsumer = &bc.benchOpConsumer
+	if batch {
+		next = bc
+	}
+	q, err := NewQueue(QueueOptions{Dir: dir, Name: "bench", SyncEvery: 10000, Next: next})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+	done := make(chan interface{})
+	go func() {
+		_ = q.Run(ctx)
+		close(done)
+	}()
+
+	for n := 0; n < b.N; {
+		select {
+		case <-bc.och:
+			n++
+		case ops := <-bc.bch:
+			n += len(ops)
+		}
+	}
+
+	elapsed := time.Since(start)
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "events/sec")
+	ctxCancel()
+	<-done
+}
+
+func BenchmarkQueue_ConsumeOp(b *testing.B) {
+	benchmarkQueue(b, false)
+}
+
+func BenchmarkQueue_ConsumeOps(b *testing.B) {
+	benchmarkQueue(b, true)
+}
+
+// benchElasticServer a fake ES accepting bulk requests, counts indexed documents
+func benchElasticServer(count *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		if !strings.HasSuffix(req.URL.Path, "/_bulk") {
+			_, _ = rw.Write([]byte(`{"version":{"number":"6.8.0"}}`))
+			return
+		}
+		buf, _ := ioutil.ReadAll(req.Body)
+		// action and document, one line each
+		atomic.AddInt64(count, int64(bytes.Count(buf, []byte("\n"))/2))
+		_, _ = rw.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	}))
+}
+
+// benchOpOnlyConsumer hides batch support of ElasticOutput, queue hands over Ops one by one
+type benchOpOnlyConsumer struct {
+	next types.OpConsumer
+}
+
+func (c benchOpOnlyConsumer) ConsumeOp(op types.Op) error {
+	return c.next.ConsumeOp(op)
+}
+
+// benchmarkQueueElastic queue to a real ElasticOutput against a fake ES, with or without batch handover
+func benchmarkQueueElastic(b *testing.B, batch bool) {
+	dir, err := ioutil.TempDir("", "logtubed-queue-bench-es")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewQueueWriter(QueueOptions{Dir: dir, Name: "bench", SyncEvery: 10000})
+	if err != nil {
+		b.Fatal(err)
+	}
+	op := types.Event{Timestamp: time.Now(), Env: "test", Project: "order", Topic: "info", Message: "hello world"}.ToOp()
+	for i := 0; i < b.N; i++ {
+		if err = w.ConsumeOp(op); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	var count int64
+	s := benchElasticServer(&count)
+	defer s.Close()
+
+	eo, err := NewElasticOutput(ElasticOutputOptions{Name: "bench", URLs: []string{s.URL}, NoSniff: true, BatchTimeout: time.Millisecond * 100})
+	if err != nil {
+		b.Fatal(err)
+	}
+	var next types.OpConsumer = benchOpOnlyConsumer{next: eo}
+	if batch {
+		next = eo
+	}
+	q, err := NewQueue(QueueOptions{Dir: dir, Name: "bench", SyncEvery: 10000, Next: next})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+	done := make(chan interface{}, 2)
+	go func() {
+		_ = eo.Run(ctx)
+		done <- nil
+	}()
+	go func() {
+		_ = q.Run(ctx)
+		done <- nil
+	}()
+
+	for atomic.LoadInt64(&count) < int64(b.N) {
+		time.Sleep(time.Millisecond)
+	}
+
+	elapsed := time.Since(start)
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "events/sec")
+	ctxCancel()
+	<-done
+	<-done
+}
+
+func BenchmarkQueue_ElasticConsumeOp(b *testing.B) {
+	benchmarkQueueElastic(b, false)
+}
+
+func BenchmarkQueue_ElasticConsumeOps(b *testing.B) {
+	benchmarkQueueElastic(b, true)
+}
+
+// testAckOpConsumer records batches, acknowledges them only if ack is set, fails the first fail batches
+type testAckOpConsumer struct {
+	ack  bool
+	fail int
+	data chan []types.Op
+}
+
+func (c *testAckOpConsumer) ConsumeOp(op types.Op) error {
+	return c.ConsumeOpsAck([]types.Op{op}, nil)
+}
+
+func (c *testAckOpConsumer) ConsumeOps(ops []types.Op) error {
+	return c.ConsumeOpsAck(ops, nil)
+}
+
+func (c *testAckOpConsumer) ConsumeOpsAck(ops []types.Op, ack func(err error)) error {
+	if c.fail > 0 {
+		c.fail--
+		if ack != nil {
+			ack(errors.New("test failure"))
+		}
+		return nil
+	}
+	if c.ack && ack != nil {
+		ack(nil)
+	}
+	c.data <- ops
+	return nil
+}
+
+func TestQueue_AtLeastOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-queue-ack")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	run := func(c *testAckOpConsumer, ops []types.Op, expected int) (out []types.Op) {
+		q, err := NewQueue(QueueOptions{Dir: dir, Name: "lt-test", Next: c, AtLeastOnce: true})
+		assert.NoError(t, err)
+		ctx, ctxCancel := context.WithCancel(context.Background())
+		done := make(chan interface{})
+		go func() {
+			assert.NoError(t, q.Run(ctx))
+			close(done)
+		}()
+		time.Sleep(time.Millisecond * 100)
+		for _, op := range ops {
+			assert.NoError(t, q.ConsumeOp(op))
+		}
+		for len(out) < expected {
+			select {
+			case b := <-c.data:
+				out = append(out, b...)
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for ops")
+			}
+		}
+		ctxCancel()
+		<-done
+		return
+	}
+
+	ops := []types.Op{
+		{Index: "index-1", Body: []byte("hello")},
+		{Index: "index-2", Body: []byte("world")},
+	}
+
+	// delivered but never acknowledged
+	out := run(&testAckOpConsumer{data: make(chan []types.Op, 10)}, ops, 2)
+	assert.Len(t, out, 2)
+
+	// redelivered on restart, acknowledged this time
+	out = run(&testAckOpConsumer{ack: true, data: make(chan []types.Op, 10)}, nil, 2)
+	assert.Len(t, out, 2)
+	assert.Equal(t, "index-1", out[0].Index)
+	assert.Equal(t, "hello", string(out[0].Body))
+
+	// nothing left
+	c := &testAckOpConsumer{ack: true, data: make(chan []types.Op, 10)}
+	run(c, nil, 0)
+	assert.Len(t, c.data, 0)
+
+	_, err = NewQueue(QueueOptions{Dir: dir, Name: "lt-test", Next: &testOpConsumer{}, AtLeastOnce: true})
+	assert.Error(t, err)
+}
+
+func TestQueue_AtLeastOnceRequeue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-queue-requeue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// first 2 batches fail, put back to diskqueue and delivered again while running
+	c := &testAckOpConsumer{ack: true, fail: 2, data: make(chan []types.Op, 10)}
+	q, err := NewQueue(QueueOptions{Dir: dir, Name: "lt-test", Next: c, AtLeastOnce: true})
+	assert.NoError(t, err)
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	done := make(chan interface{})
+	go func() {
+		assert.NoError(t, q.Run(ctx))
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	assert.NoError(t, q.ConsumeOp(types.Op{Index: "index-1", Body: []byte("hello")}))
+
+	select {
+	case b := <-c.data:
+		assert.Len(t, b, 1)
+		assert.Equal(t, "index-1", b[0].Index)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for requeued ops")
+	}
+	assert.Equal(t, int64(0), q.Pending())
+
+	ctxCancel()
+	<-done
+}
+
+// testFailingDiskQueue accepts limited Puts, then fails like a closed diskqueue
+type testFailingDiskQueue struct {
+	diskqueue.DiskQueue
+	limit int
+	puts  [][]byte
+}
+
+func (d *testFailingDiskQueue) Put(buf []byte) error {
+	if len(d.puts) >= d.limit {
+		return errors.New("exiting")
+	}
+	d.puts = append(d.puts, buf)
+	return nil
+}
+
+func TestQueue_AtLeastOnceRequeuePartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-queue-requeue-partial")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	j, _, err := openQueueJournal(dir, "lt-test")
+	assert.NoError(t, err)
+	ops := []types.Op{{Index: "index-1"}, {Index: "index-2"}, {Index: "index-3"}}
+	seq, err := j.Append(ops)
+	assert.NoError(t, err)
+
+	// batch fails, diskqueue closes after first op requeued
+	c := &testAckOpConsumer{ack: true, fail: 1}
+	q := &queue{optName: "lt-test", journal: j, nextAck: c}
+	dq := &testFailingDiskQueue{limit: 1}
+	q.deliverAck(dq, seq, ops)
+	assert.Len(t, dq.puts, 1)
+	assert.NoError(t, j.Close())
+
+	// only ops not yet requeued are delivered again on restart
+	j, unacked, err := openQueueJournal(dir, "lt-test")
+	assert.NoError(t, err)
+	defer j.Close()
+	if assert.Len(t, unacked, 1) && assert.Len(t, unacked[0].ops, 2) {
+		assert.Equal(t, "index-2", unacked[0].ops[0].Index)
+		assert.Equal(t, "index-3", unacked[0].ops[1].Index)
+	}
+}
+
+// testBlockingBatchOpConsumer blocks in ConsumeOps until released
+type testBlockingBatchOpConsumer struct {
+	testOpConsumer
+	entered chan []types.Op
+	release chan struct{}
+}
+
+func (c *testBlockingBatchOpConsumer) ConsumeOps(ops []types.Op) error {
+	c.entered <- ops
+	<-c.release
+	return nil
+}
+
+func TestQueue_PendingInFlight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-queue-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	oc := &testBlockingBatchOpConsumer{entered: make(chan []types.Op, 1), release: make(chan struct{})}
+	q, err := NewQueue(QueueOptions{Dir: dir, Name: "lt-test", Next: oc})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	done := make(chan interface{})
+	go func() {
+		assert.NoError(t, q.Run(ctx))
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, q.ConsumeOp(types.Op{Index: "testindex", Body: []byte("helloworld")}))
+	}
+	<-oc.entered
+	// ops read off diskqueue but not yet handed over must still be pending
+	assert.Equal(t, int64(3), q.Pending())
+	close(oc.release)
+
+	assert.Equal(t, int64(0), WaitDrained(time.Second*5, q))
+
+	ctxCancel()
+	<-done
 }
@@ -1,15 +1,21 @@
 package core
 
 import (
-	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
 	"github.com/logtube/logtubed/beat"
 	"github.com/logtube/logtubed/types"
 	"github.com/rs/zerolog/log"
 	"go.guoyk.net/common"
 	"go.guoyk.net/redcon"
+	"io/ioutil"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -17,14 +23,43 @@ import (
 )
 
 var (
-	SuffixCompactEvent = []byte(".compact")
+	SuffixCompactEvent     = []byte(".compact")
+	SuffixCompactEventGzip = []byte(".compact.gz") // gzip is detected by magic bytes anyway, the suffix only selects the decoder
 )
 
+// RedisToken a per-client AUTH token, events outside allowed envs / projects are dropped, empty means any
+type RedisToken struct {
+	Token    string   `json:"-"`
+	Envs     []string `json:"envs"`
+	Projects []string `json:"projects"`
+}
+
 type RedisInputOptions struct {
 	Bind                   string
 	Multi                  bool
+	Password               string `json:"-"`
+	Tokens                 []RedisToken
+	Routes                 []RedisKeyRoute // first match wins, keys without match are decoded by suffix
+	MaxRawSize             int             // events with larger raw size are dropped or truncated, default 1000000
+	MaxMessageSize         int             // events with larger message are dropped or truncated, 0 means no limit
+	Truncate               bool            // truncate message of oversized events instead of dropping
+	VarDropped             *expvar.Map     // oversized events dropped, per project
+	VarTruncated           *expvar.Map     // oversized events truncated, per project
+	VarStats               *expvar.Map     // decoded, failed and dropped events, per pipeline
+	Strict                 bool            // reply accepted count to RPUSH / LPUSH / PUBLISH, or error if all values failed to decode
+	Capture                RawCapture      // optional, capture values failed to decode
+	TLSBind                string          // additional TLS listener, if empty and TLSCert is set, Bind is TLS only
+	TLSCert                string
+	TLSKey                 string
+	TLSClientCA            string // verify client certificates against this CA if set
 	LogtubeTimeOffset      int
 	MySQLErrorIgnoreLevels []string
+	NginxFormat            string
+	NginxTags              []beat.NginxTag
+	KubernetesEnvRules     []string
+	KubernetesProjectRules []string
+	KubernetesTopicRules   []string
+	KubernetesDefaultTopic string
 	Next                   types.EventConsumer
 }
 
@@ -34,13 +69,34 @@ type RedisInput interface {
 }
 
 type redisInput struct {
-	optBind  string
-	optMulti bool
+	optBind     string
+	optMulti    bool
+	optPassword string
+	optTokens   []RedisToken
+	optTLSBind  string
+	optRoutes   []RedisKeyRoute
+
+	optMaxRawSize     int
+	optMaxMessageSize int
+	optTruncate       bool
+
+	varDropped   *expvar.Map
+	varTruncated *expvar.Map
+	varStats     *expvar.Map
+
+	optStrict bool
+	capture   RawCapture
+
+	tlsConfig *tls.Config
 
 	connsCount    int64
+	connsTotal    int64
 	connsSum      map[string]int
 	connsSumMutex sync.Locker
 
+	cmdsCount int64
+	startedAt time.Time
+
 	pipelines []beat.Pipeline
 
 	next types.EventConsumer
@@ -52,22 +108,73 @@ func NewRedisInput(opts RedisInputOptions) (RedisInput, error) {
 	if len(opts.Bind) == 0 {
 		opts.Bind = "0.0.0.0:6379"
 	}
+	if opts.MaxRawSize == 0 {
+		opts.MaxRawSize = redisDefaultMaxRawSize
+	}
 	if opts.Next == nil {
 		return nil, errors.New("RedisInput: Next is not set")
 	}
+	for _, t := range opts.Tokens {
+		if len(t.Token) == 0 {
+			return nil, errors.New("RedisInput: empty token")
+		}
+	}
+	for i := range opts.Routes {
+		if err := opts.Routes[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	var tlsConfig *tls.Config
+	if len(opts.TLSCert) > 0 || len(opts.TLSKey) > 0 {
+		var err error
+		if tlsConfig, err = newRedisTLSConfig(opts.TLSCert, opts.TLSKey, opts.TLSClientCA); err != nil {
+			return nil, err
+		}
+	} else if len(opts.TLSBind) > 0 {
+		return nil, errors.New("RedisInput: TLSCert and TLSKey are not set")
+	}
 	log.Info().Str("input", "redis").Interface("opts", opts).Msg("input created")
 	o := &redisInput{
-		optBind:  opts.Bind,
-		optMulti: opts.Multi,
+		optBind:     opts.Bind,
+		optMulti:    opts.Multi,
+		optPassword: opts.Password,
+		optTokens:   opts.Tokens,
+		optTLSBind:  opts.TLSBind,
+		optRoutes:   opts.Routes,
+
+		optMaxRawSize:     opts.MaxRawSize,
+		optMaxMessageSize: opts.MaxMessageSize,
+		optTruncate:       opts.Truncate,
+
+		varDropped:   opts.VarDropped,
+		varTruncated: opts.VarTruncated,
+		varStats:     opts.VarStats,
+
+		optStrict: opts.Strict,
+		capture:   opts.Capture,
+
+		tlsConfig: tlsConfig,
 
 		connsSum:      map[string]int{},
 		connsSumMutex: &sync.Mutex{},
 
+		startedAt: time.Now(),
+
 		pipelines: []beat.Pipeline{
 			beat.NewMySQLPipeline(beat.MySQLPipelineOptions{
 				ErrorIgnoreLevels: opts.MySQLErrorIgnoreLevels,
 			}),
-			beat.NewNginxPipeline(beat.NginxPipelineOptions{}),
+			beat.NewNginxPipeline(beat.NginxPipelineOptions{
+				Format: opts.NginxFormat,
+				Tags:   opts.NginxTags,
+			}),
+			beat.NewKubernetesPipeline(beat.KubernetesPipelineOptions{
+				EnvRules:          opts.KubernetesEnvRules,
+				ProjectRules:      opts.KubernetesProjectRules,
+				TopicRules:        opts.KubernetesTopicRules,
+				DefaultTopic:      opts.KubernetesDefaultTopic,
+				DefaultTimeOffset: opts.LogtubeTimeOffset,
+			}),
 			beat.NewLogtubePipeline(beat.LogtubePipelineOptions{
 				DefaultTimeOffset: opts.LogtubeTimeOffset,
 			}),
@@ -78,6 +185,113 @@ func NewRedisInput(opts RedisInputOptions) (RedisInput, error) {
 	return o, nil
 }
 
+func newRedisTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if len(clientCAFile) > 0 {
+		var buf []byte
+		if buf, err = ioutil.ReadFile(clientCAFile); err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, errors.New("RedisInput: no certificate found in " + clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// redisConnState per connection state, stored as redcon.Conn context
+type redisConnState struct {
+	id     int64
+	host   string
+	name   string
+	db     int
+	authed bool
+	token  *RedisToken
+
+	multi  bool
+	queued []redcon.Command
+}
+
+func redisConnStateOf(conn redcon.Conn) *redisConnState {
+	if st, ok := conn.Context().(*redisConnState); ok {
+		return st
+	}
+	st := &redisConnState{}
+	conn.SetContext(st)
+	return st
+}
+
+func (r *redisInput) authRequired() bool {
+	return len(r.optPassword) > 0 || len(r.optTokens) > 0
+}
+
+// auth check password or tokens, returns matched token, nil for password
+func (r *redisInput) auth(password string) (token *RedisToken, ok bool) {
+	if len(r.optPassword) > 0 && subtle.ConstantTimeCompare([]byte(password), []byte(r.optPassword)) == 1 {
+		ok = true
+		return
+	}
+	for i := range r.optTokens {
+		if subtle.ConstantTimeCompare([]byte(password), []byte(r.optTokens[i].Token)) == 1 {
+			token = &r.optTokens[i]
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+func redisScopeAllows(allowed []string, value string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == value {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver check token scope and deliver a decoded event to next, returns false if dropped
+func (r *redisInput) deliver(st *redisConnState, pipeline string, e types.Event) bool {
+	inputStatAdd(r.varStats, pipeline, InputStatDecoded)
+	if st != nil && st.token != nil {
+		if !redisScopeAllows(st.token.Envs, e.Env) || !redisScopeAllows(st.token.Projects, e.Project) {
+			log.Debug().Str("input", "redis").Str("env", e.Env).Str("project", e.Project).Msg("event not allowed by token")
+			inputStatAdd(r.varStats, pipeline, InputStatDropped)
+			return false
+		}
+	}
+	if !r.limitEvent(&e) {
+		inputStatAdd(r.varStats, pipeline, InputStatDropped)
+		return false
+	}
+	log.Debug().Str("input", "redis").Interface("event", e).Msg("new event")
+	if err := r.next.ConsumeEvent(e); err != nil {
+		log.Error().Err(err).Str("input", "redis").Msg("failed to delivery event to next")
+		inputStatAdd(r.varStats, pipeline, InputStatDropped)
+		return false
+	}
+	return true
+}
+
+// fail record a raw value failed to decode
+func (r *redisInput) fail(pipeline string, raw []byte, err error) {
+	log.Debug().Err(err).Str("input", "redis").Str("pipeline", pipeline).Str("event", string(raw)).Msg("failed to decode event")
+	inputStatAdd(r.varStats, pipeline, InputStatFailed)
+	if r.capture != nil {
+		r.capture.Capture("redis", pipeline, raw, err)
+	}
+}
+
 func (r *redisInput) SetBlocked(blocked bool) {
 	r.blocked = blocked
 }
@@ -106,68 +320,72 @@ func (r *redisInput) decreaseConnsSum(addr string) int {
 	return r.connsSum[i]
 }
 
-func (r *redisInput) runPipelines(b beat.Event, e *types.Event) (ok bool) {
+// runPipelines process beat event with the first matched pipeline, returns name of the pipeline
+func (r *redisInput) runPipelines(b beat.Event, e *types.Event) (name string, ok bool) {
 	for _, p := range r.pipelines {
 		if p.Match(b) {
 			log.Debug().Str("input", "redis").Str("pipeline", p.Name()).Msg("pipeline matched")
-			return p.Process(b, e)
+			return p.Name(), p.Process(b, e)
 		}
 	}
 	log.Debug().Str("input", "redis").Msg("no pipeline matched")
-	return
+	return RedisDecoderBeat, false
 }
 
-func (r *redisInput) consumeCompactEvent(raw []byte) {
-	// ignore event > 1mb
-	if len(raw) > 1000000 {
-		return
+// consumeCompactEvent decode a value of one or many compact events, see types.UnmarshalCompactEventsJSON
+func (r *redisInput) consumeCompactEvent(st *redisConnState, rt *RedisKeyRoute, raw []byte) (accepted int, failed int) {
+	r.logRawSize(raw)
+	rs, err := types.UnmarshalCompactEventsJSON(raw)
+	if err != nil {
+		r.fail(RedisDecoderCompact, raw, err)
+		return 0, 1
 	}
-	// warn event > 500k
-	if len(raw) > 500000 {
-		log.Warn().Int("raw-length", len(raw)).Msg("raw message larger than 500k")
-	}
-	log.Debug().Int("raw-length", len(raw)).Msg("raw message")
-	var ce types.CompactEvent
-	var err error
-	if ce, err = types.UnmarshalCompactEventJSON(raw); err != nil {
-		log.Debug().Err(err).Str("event", string(raw)).Msg("failed to unmarshal compact event")
-		return
-	}
-	e := ce.ToEvent()
-	e.RawSize = len(raw)
-	log.Debug().Str("input", "redis").Interface("event", e).Msg("new event")
-	if err = r.next.ConsumeEvent(e); err != nil {
-		log.Error().Err(err).Str("input", "redis").Msg("failed to delivery event to next")
+	for _, res := range rs {
+		if res.Err != nil {
+			r.fail(RedisDecoderCompact, res.Raw, res.Err)
+			failed++
+			continue
+		}
+		e := res.Event.ToEvent()
+		e.RawSize = len(res.Raw)
+		rt.applyDefaults(&e)
+		if r.deliver(st, RedisDecoderCompact, e) {
+			accepted++
+		}
 	}
+	return
 }
 
-func (r *redisInput) consumeBeatEvent(raw []byte) {
-	// ignore event > 1mb
-	if len(raw) > 1000000 {
-		return
-	}
-	// warn event > 500k
-	if len(raw) > 500000 {
-		log.Warn().Int("raw-length", len(raw)).Msg("raw message larger than 500k")
-	}
-	log.Debug().Int("raw-length", len(raw)).Msg("raw message")
+func (r *redisInput) consumeBeatEvent(st *redisConnState, rt *RedisKeyRoute, raw []byte) (accepted int, failed int) {
+	r.logRawSize(raw)
 	// unmarshal beat event
 	var be beat.Event
 	if err := json.Unmarshal(raw, &be); err != nil {
-		log.Debug().Err(err).Str("event", string(raw)).Msg("failed to unmarshal beat event")
-		return
+		r.fail(RedisDecoderBeat, raw, err)
+		return 0, 1
 	}
 	// convert to event
 	var e types.Event
 	e.RawSize = len(raw)
-	if ok := r.runPipelines(be, &e); ok {
-		log.Debug().Str("input", "redis").Interface("event", e).Msg("new event")
-		if err := r.next.ConsumeEvent(e); err != nil {
-			log.Error().Err(err).Str("input", "redis").Msg("failed to delivery event to next")
-		}
-	} else {
-		log.Debug().Str("event", string(raw)).Msg("pipeline not success")
+	name, ok := r.runPipelines(be, &e)
+	if !ok {
+		r.fail(name, raw, errors.New("pipeline not success"))
+		return 0, 1
+	}
+	rt.applyDefaults(&e)
+	if r.deliver(st, name, e) {
+		accepted = 1
+	}
+	return
+}
+
+// writeStrictReply reply accepted count, or error if nothing accepted and some values failed to decode
+func (r *redisInput) writeStrictReply(conn redcon.Conn, accepted int, failed int) {
+	if accepted == 0 && failed > 0 {
+		conn.WriteError(fmt.Sprintf("ERR %d values failed to decode", failed))
+		return
 	}
+	conn.WriteInt(accepted)
 }
 
 func (r *redisInput) handleCommand(conn redcon.Conn, cmd redcon.Command) {
@@ -176,27 +394,120 @@ func (r *redisInput) handleCommand(conn redcon.Conn, cmd redcon.Command) {
 		conn.WriteError("ERR bad command")
 		return
 	}
+	atomic.AddInt64(&r.cmdsCount, 1)
 	// extract command
 	command := strings.ToLower(string(cmd.Args[0]))
 	log.Debug().Str("addr", conn.RemoteAddr()).Str("cmd", command).Int("args", len(cmd.Args)-1).Msg("new command")
-	// handle command
+	// check authentication
+	st := redisConnStateOf(conn)
+	if r.authRequired() && !st.authed && command != "auth" && command != "quit" {
+		conn.WriteError("NOAUTH Authentication required.")
+		return
+	}
+	// transaction
+	switch command {
+	case "multi":
+		if st.multi {
+			conn.WriteError("ERR MULTI calls can not be nested")
+			return
+		}
+		st.multi = true
+		st.queued = nil
+		conn.WriteString("OK")
+		return
+	case "discard":
+		if !st.multi {
+			conn.WriteError("ERR DISCARD without MULTI")
+			return
+		}
+		st.multi = false
+		st.queued = nil
+		conn.WriteString("OK")
+		return
+	case "exec":
+		if !st.multi {
+			conn.WriteError("ERR EXEC without MULTI")
+			return
+		}
+		queued := st.queued
+		st.multi = false
+		st.queued = nil
+		// every command writes exactly one reply
+		conn.WriteArray(len(queued))
+		for _, c := range queued {
+			r.execCommand(conn, st, strings.ToLower(string(c.Args[0])), c)
+		}
+		return
+	case "quit":
+	default:
+		if st.multi {
+			st.queued = append(st.queued, copyRedisCommand(cmd))
+			conn.WriteString("QUEUED")
+			return
+		}
+	}
+	r.execCommand(conn, st, command, cmd)
+}
+
+func (r *redisInput) execCommand(conn redcon.Conn, st *redisConnState, command string, cmd redcon.Command) {
 	switch command {
 	default:
 		log.Error().Str("command", command).Msg("unknown message")
 		conn.WriteError("ERR unknown command '" + command + "'")
+	case "auth":
+		// AUTH password, or AUTH username password since redis 6
+		if len(cmd.Args) < 2 || len(cmd.Args) > 3 {
+			conn.WriteError("ERR wrong number of arguments for 'auth' command")
+			return
+		}
+		if !r.authRequired() {
+			// clients configured with a password should still work
+			conn.WriteString("OK")
+			return
+		}
+		token, ok := r.auth(string(cmd.Args[len(cmd.Args)-1]))
+		if !ok {
+			log.Error().Str("input", "redis").Str("addr", conn.RemoteAddr()).Msg("authentication failed")
+			conn.WriteError("WRONGPASS invalid username-password pair")
+			return
+		}
+		st.authed = true
+		st.token = token
+		conn.WriteString("OK")
 	case "ping":
-		conn.WriteString("PONG")
+		if len(cmd.Args) > 1 {
+			conn.WriteBulk(cmd.Args[1])
+		} else {
+			conn.WriteString("PONG")
+		}
+	case "echo":
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for 'echo' command")
+			return
+		}
+		conn.WriteBulk(cmd.Args[1])
 	case "quit":
 		conn.WriteString("OK")
 		_ = conn.Close()
-	case "info":
-		if r.optMulti {
-			// declare as redis 2.4+, supports multiple values in RPUSH/LPUSH
-			conn.WriteString("redis_version:2.4\r\n")
-		} else {
-			// declare as redis 2.4-, not support multiple values in RPUSH/LPUSH
-			conn.WriteString("redis_version:2.3\r\n")
+	case "select":
+		// all databases are the same
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for 'select' command")
+			return
+		}
+		db, err := strconv.Atoi(string(cmd.Args[1]))
+		if err != nil || db < 0 {
+			conn.WriteError("ERR invalid DB index")
+			return
 		}
+		st.db = db
+		conn.WriteString("OK")
+	case "info":
+		conn.WriteBulkString(r.redisInfo(cmd.Args[1:]))
+	case "client":
+		r.handleClientCommand(conn, st, cmd)
+	case "eval", "evalsha", "script":
+		r.handleScriptCommand(conn, command, cmd)
 	case "rpush", "lpush":
 		// refuse on blocked
 		if r.blocked {
@@ -209,16 +520,30 @@ func (r *redisInput) handleCommand(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 		// retrieve all events
-		if bytes.HasSuffix(cmd.Args[1], SuffixCompactEvent) {
-			for _, raw := range cmd.Args[2:] {
-				r.consumeCompactEvent(raw)
-			}
-		} else {
-			for _, raw := range cmd.Args[2:] {
-				r.consumeBeatEvent(raw)
-			}
+		accepted, failed := r.consumeKey(st, cmd.Args[1], cmd.Args[2:])
+		if r.optStrict {
+			r.writeStrictReply(conn, accepted, failed)
+			return
 		}
 		conn.WriteInt64(0)
+	case "publish":
+		// refuse on blocked
+		if r.blocked {
+			conn.WriteError("ERR blocked")
+			return
+		}
+		// PUBLISH channel "{....}", used by filebeat with datatype channel
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'publish' command")
+			return
+		}
+		accepted, failed := r.consumeKey(st, cmd.Args[1], cmd.Args[2:])
+		if r.optStrict {
+			r.writeStrictReply(conn, accepted, failed)
+			return
+		}
+		// number of subscribers received the message
+		conn.WriteInt64(1)
 	case "llen":
 		conn.WriteInt64(0)
 	}
@@ -230,6 +555,7 @@ func (r *redisInput) handleConnect(conn redcon.Conn) bool {
 		time.Sleep(time.Second)
 		return false
 	}
+	conn.SetContext(&redisConnState{id: atomic.AddInt64(&r.connsTotal, 1), host: extractIP(conn.RemoteAddr())})
 	log.Info().Int64(
 		"conns",
 		r.increaseConnsCount(),
@@ -260,30 +586,57 @@ func (r *redisInput) Run(ctx context.Context) error {
 	log.Info().Str("input", "redis").Msg("started")
 	defer log.Info().Str("input", "redis").Msg("stopped")
 
-	init := make(chan error, 1)
-	done := make(chan error, 1)
+	// create servers
+	var servers []redisServer
+	if r.tlsConfig != nil && len(r.optTLSBind) == 0 {
+		servers = append(servers, redcon.NewServerTLS(r.optBind, r.handleCommand, r.handleConnect, r.handleDisconnect, r.tlsConfig))
+	} else {
+		servers = append(servers, redcon.NewServer(r.optBind, r.handleCommand, r.handleConnect, r.handleDisconnect))
+		if r.tlsConfig != nil {
+			servers = append(servers, redcon.NewServerTLS(r.optTLSBind, r.handleCommand, r.handleConnect, r.handleDisconnect, r.tlsConfig))
+		}
+	}
 
-	// create the server
-	s := redcon.NewServer(r.optBind, r.handleCommand, r.handleConnect, r.handleDisconnect)
+	closeAll := func() (err error) {
+		for _, s := range servers {
+			if err1 := s.Close(); err1 != nil {
+				err = err1
+			}
+		}
+		return
+	}
 
-	// start the server
-	go func() {
-		done <- s.ListenServeAndSignal(init)
-	}()
-	// wait server initialization
-	if err := <-init; err != nil {
-		log.Error().Err(err).Str("input", "redis").Msg("failed to initialize redis input")
-		return err
+	done := make(chan error, len(servers))
+	for _, s := range servers {
+		init := make(chan error, 1)
+		// start the server
+		go func(s redisServer) {
+			done <- s.ListenServeAndSignal(init)
+		}(s)
+		// wait server initialization
+		if err := <-init; err != nil {
+			log.Error().Err(err).Str("input", "redis").Msg("failed to initialize redis input")
+			_ = closeAll()
+			return err
+		}
 	}
+
 	// wait context cancellation or server exit
 	select {
 	case <-ctx.Done():
-		return s.Close()
+		return closeAll()
 	case err := <-done:
+		_ = closeAll()
 		return err
 	}
 }
 
+// redisServer common interface of redcon.Server and redcon.TLSServer
+type redisServer interface {
+	ListenServeAndSignal(signal chan error) error
+	Close() error
+}
+
 func extractIP(addr string) string {
 	c := strings.Split(addr, ":")
 	if len(c) < 2 {
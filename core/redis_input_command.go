@@ -0,0 +1,159 @@
+package core
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"go.guoyk.net/redcon"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	redisInfoSections = []string{"server", "clients", "memory", "persistence", "stats", "replication", "cpu", "keyspace"}
+)
+
+// redisInfoSection render a INFO section, as a real redis server does
+func (r *redisInput) redisInfoSection(section string) string {
+	var lines []string
+	switch section {
+	case "server":
+		version := "2.3.0"
+		if r.optMulti {
+			// declare as redis 2.4+, supports multiple values in RPUSH/LPUSH
+			version = "2.4.0"
+		}
+		lines = []string{
+			"redis_version:" + version,
+			"redis_mode:standalone",
+			"os:" + runtime.GOOS,
+			"arch_bits:64",
+			fmt.Sprintf("process_id:%d", os.Getpid()),
+			"tcp_port:" + redisPortOf(r.optBind),
+			fmt.Sprintf("uptime_in_seconds:%d", int64(time.Since(r.startedAt)/time.Second)),
+			fmt.Sprintf("uptime_in_days:%d", int64(time.Since(r.startedAt)/(time.Hour*24))),
+			"executable:logtubed",
+		}
+	case "clients":
+		lines = []string{
+			fmt.Sprintf("connected_clients:%d", atomic.LoadInt64(&r.connsCount)),
+			"blocked_clients:0",
+		}
+	case "memory":
+		lines = []string{"used_memory:0", "used_memory_human:0B", "maxmemory:0", "maxmemory_policy:noeviction"}
+	case "persistence":
+		lines = []string{"loading:0", "rdb_bgsave_in_progress:0", "aof_enabled:0"}
+	case "stats":
+		lines = []string{
+			fmt.Sprintf("total_connections_received:%d", atomic.LoadInt64(&r.connsTotal)),
+			fmt.Sprintf("total_commands_processed:%d", atomic.LoadInt64(&r.cmdsCount)),
+			"rejected_connections:0",
+			"keyspace_hits:0",
+			"keyspace_misses:0",
+		}
+	case "replication":
+		lines = []string{"role:master", "connected_slaves:0"}
+	case "cpu":
+		lines = []string{"used_cpu_sys:0.00", "used_cpu_user:0.00"}
+	case "keyspace":
+	default:
+		return ""
+	}
+	return "# " + strings.ToUpper(section[:1]) + section[1:] + "\r\n" + strings.Join(append(lines, ""), "\r\n")
+}
+
+// redisInfo render INFO reply, with optional section names
+func (r *redisInput) redisInfo(args [][]byte) string {
+	sections := redisInfoSections
+	if len(args) > 0 {
+		sections = nil
+		for _, arg := range args {
+			s := strings.ToLower(string(arg))
+			if s == "all" || s == "default" || s == "everything" {
+				sections = redisInfoSections
+				break
+			}
+			sections = append(sections, s)
+		}
+	}
+	var out []string
+	for _, s := range sections {
+		if v := r.redisInfoSection(s); len(v) > 0 {
+			out = append(out, v)
+		}
+	}
+	return strings.Join(out, "\r\n")
+}
+
+func redisPortOf(bind string) string {
+	if i := strings.LastIndex(bind, ":"); i >= 0 {
+		return bind[i+1:]
+	}
+	return "6379"
+}
+
+// copyRedisCommand deep copy a command, redcon reuses the read buffer between commands
+func copyRedisCommand(cmd redcon.Command) redcon.Command {
+	out := redcon.Command{Raw: append([]byte(nil), cmd.Raw...)}
+	for _, arg := range cmd.Args {
+		out.Args = append(out.Args, append([]byte(nil), arg...))
+	}
+	return out
+}
+
+// handleClientCommand CLIENT SETNAME / GETNAME / ID / others acknowledged
+func (r *redisInput) handleClientCommand(conn redcon.Conn, st *redisConnState, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'client' command")
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "setname":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'client|setname' command")
+			return
+		}
+		st.name = string(cmd.Args[2])
+		conn.WriteString("OK")
+	case "getname":
+		if len(st.name) == 0 {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulkString(st.name)
+		}
+	case "id":
+		conn.WriteInt64(st.id)
+	case "list", "info":
+		conn.WriteBulkString(fmt.Sprintf("id=%d addr=%s name=%s db=%d\n", st.id, conn.RemoteAddr(), st.name, st.db))
+	default:
+		// CLIENT SETINFO, CLIENT REPLY, CLIENT TRACKING and so on, accepted but ignored
+		conn.WriteString("OK")
+	}
+}
+
+// handleScriptCommand scripting is not supported, EVALSHA always misses so clients fall back to EVAL, which is refused
+func (r *redisInput) handleScriptCommand(conn redcon.Conn, command string, cmd redcon.Command) {
+	switch command {
+	case "evalsha":
+		conn.WriteError("NOSCRIPT No matching script. Please use EVAL.")
+	case "eval":
+		conn.WriteError("ERR scripting is not supported by logtubed")
+	case "script":
+		if len(cmd.Args) >= 3 && strings.ToLower(string(cmd.Args[1])) == "load" {
+			sum := sha1.Sum(cmd.Args[2])
+			conn.WriteBulkString(hex.EncodeToString(sum[:]))
+			return
+		}
+		if len(cmd.Args) >= 2 && strings.ToLower(string(cmd.Args[1])) == "exists" {
+			conn.WriteArray(len(cmd.Args) - 2)
+			for range cmd.Args[2:] {
+				conn.WriteInt(0)
+			}
+			return
+		}
+		conn.WriteString("OK")
+	}
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"github.com/logtube/logtubed/types"
+	"github.com/rs/zerolog/log"
+	"unicode/utf8"
+)
+
+const (
+	redisDefaultMaxRawSize = 1000000
+)
+
+// logRawSize warn raw message larger than half of max raw size
+func (r *redisInput) logRawSize(raw []byte) {
+	if r.optMaxRawSize > 0 && len(raw) > r.optMaxRawSize/2 {
+		log.Warn().Str("input", "redis").Int("raw-length", len(raw)).Msg("raw message too large")
+	}
+	log.Debug().Int("raw-length", len(raw)).Msg("raw message")
+}
+
+// limitEvent enforce max raw size and max message size, drop or truncate Message, returns false if dropped
+func (r *redisInput) limitEvent(e *types.Event) bool {
+	msgLen := len(e.Message)
+	limit := msgLen
+	if r.optMaxMessageSize > 0 && limit > r.optMaxMessageSize {
+		limit = r.optMaxMessageSize
+	}
+	if r.optMaxRawSize > 0 && e.RawSize > r.optMaxRawSize {
+		// shrink message by the exceeded size
+		if l := msgLen - (e.RawSize - r.optMaxRawSize); l < limit {
+			limit = l
+		}
+		if limit < 0 {
+			limit = 0
+		}
+	} else if limit == msgLen {
+		return true
+	}
+	project := e.Project
+	if len(project) == 0 {
+		project = unknownProject
+	}
+	if !r.optTruncate {
+		log.Warn().Str("input", "redis").Str("project", e.Project).Int("raw-size", e.RawSize).Int("message-size", msgLen).Msg("event too large, dropped")
+		if r.varDropped != nil {
+			r.varDropped.Add(project, 1)
+		}
+		return false
+	}
+	e.Message = truncateUTF8(e.Message, limit)
+	extra := make(map[string]interface{}, len(e.Extra)+2)
+	for k, v := range e.Extra {
+		extra[k] = v
+	}
+	extra["truncated"] = true
+	extra["original_size"] = msgLen
+	e.Extra = extra
+	if r.varTruncated != nil {
+		r.varTruncated.Add(project, 1)
+	}
+	return true
+}
+
+// truncateUTF8 cut s to at most n bytes, without breaking a multi-byte character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/logtube/logtubed/types"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	RedisDecoderCompact = "compact" // compact event JSON, see types.CompactEvent
+	RedisDecoderBeat    = "beat"    // filebeat event JSON, processed by pipelines
+	RedisDecoderLine    = "line"    // plain text, one event per value
+	RedisDecoderNDJSON  = "ndjson"  // newline delimited JSON objects, with Event field names
+)
+
+const (
+	// topic of line / ndjson events if neither the value nor the route provides one
+	redisRouteDefaultTopic = "info"
+)
+
+// RedisKeyRoute decode values pushed to keys matching Pattern with Decoder, and fill empty env / project / topic
+type RedisKeyRoute struct {
+	Pattern string // glob pattern, see path.Match, for example "app:*:prod"
+	Decoder string
+	Env     string
+	Project string
+	Topic   string
+}
+
+func (rt *RedisKeyRoute) validate() error {
+	if _, err := path.Match(rt.Pattern, ""); err != nil {
+		return errors.New("RedisInput: invalid route pattern " + rt.Pattern)
+	}
+	switch rt.Decoder {
+	case RedisDecoderCompact, RedisDecoderBeat, RedisDecoderLine, RedisDecoderNDJSON:
+		return nil
+	default:
+		return errors.New("RedisInput: unknown route decoder " + rt.Decoder)
+	}
+}
+
+// applyDefaults fill empty fields with route defaults, nil route does nothing
+func (rt *RedisKeyRoute) applyDefaults(e *types.Event) {
+	if rt == nil {
+		return
+	}
+	if len(e.Env) == 0 {
+		e.Env = rt.Env
+	}
+	if len(e.Project) == 0 {
+		e.Project = rt.Project
+	}
+	if len(e.Topic) == 0 {
+		e.Topic = rt.Topic
+	}
+}
+
+// routeOf find the first route matching key, nil if none
+func (r *redisInput) routeOf(key []byte) *RedisKeyRoute {
+	for i := range r.optRoutes {
+		if ok, _ := path.Match(r.optRoutes[i].Pattern, string(key)); ok {
+			return &r.optRoutes[i]
+		}
+	}
+	return nil
+}
+
+// consumeKey decode values of a list key or a channel, by routes or key suffix, returns count of accepted and failed events
+func (r *redisInput) consumeKey(st *redisConnState, key []byte, raws [][]byte) (accepted int, failed int) {
+	rt := r.routeOf(key)
+	decoder := RedisDecoderBeat
+	if rt != nil {
+		decoder = rt.Decoder
+	} else if bytes.HasSuffix(key, SuffixCompactEvent) || bytes.HasSuffix(key, SuffixCompactEventGzip) {
+		decoder = RedisDecoderCompact
+	}
+	for _, raw := range raws {
+		var a, f int
+		switch decoder {
+		case RedisDecoderCompact:
+			a, f = r.consumeCompactEvent(st, rt, raw)
+		case RedisDecoderBeat:
+			a, f = r.consumeBeatEvent(st, rt, raw)
+		case RedisDecoderLine:
+			a, f = r.consumeLineEvent(st, rt, raw)
+		case RedisDecoderNDJSON:
+			a, f = r.consumeNDJSONEvents(st, rt, raw)
+		}
+		accepted += a
+		failed += f
+	}
+	return
+}
+
+func (r *redisInput) consumeLineEvent(st *redisConnState, rt *RedisKeyRoute, raw []byte) (accepted int, failed int) {
+	r.logRawSize(raw)
+	msg := strings.TrimRight(string(raw), "\r\n")
+	if len(msg) == 0 {
+		r.fail(RedisDecoderLine, raw, errors.New("empty line"))
+		return 0, 1
+	}
+	e := types.Event{
+		Timestamp: time.Now(),
+		Hostname:  st.host,
+		Message:   msg,
+		RawSize:   len(raw),
+	}
+	rt.applyDefaults(&e)
+	if len(e.Topic) == 0 {
+		e.Topic = redisRouteDefaultTopic
+	}
+	if r.deliver(st, RedisDecoderLine, e) {
+		accepted = 1
+	}
+	return
+}
+
+func (r *redisInput) consumeNDJSONEvents(st *redisConnState, rt *RedisKeyRoute, raw []byte) (accepted int, failed int) {
+	r.logRawSize(raw)
+	for _, line := range bytes.Split(raw, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(line, &m); err != nil {
+			r.fail(RedisDecoderNDJSON, line, err)
+			failed++
+			continue
+		}
+		e := redisEventFromNDJSON(m)
+		e.RawSize = len(line)
+		if len(e.Hostname) == 0 {
+			e.Hostname = st.host
+		}
+		rt.applyDefaults(&e)
+		if len(e.Topic) == 0 {
+			e.Topic = redisRouteDefaultTopic
+		}
+		if r.deliver(st, RedisDecoderNDJSON, e) {
+			accepted++
+		}
+	}
+	return
+}
+
+// redisEventFromNDJSON map well-known keys to Event fields, "x_" prefixed and unknown keys go to Extra
+func redisEventFromNDJSON(m map[string]interface{}) (e types.Event) {
+	for k, v := range m {
+		s, isStr := v.(string)
+		switch k {
+		case "timestamp", "time", "@timestamp":
+			if isStr {
+				if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+					e.Timestamp = t
+					continue
+				}
+			}
+		case "hostname":
+			if isStr {
+				e.Hostname = s
+				continue
+			}
+		case "env":
+			if isStr {
+				e.Env = s
+				continue
+			}
+		case "project":
+			if isStr {
+				e.Project = s
+				continue
+			}
+		case "topic":
+			if isStr {
+				e.Topic = s
+				continue
+			}
+		case "crid":
+			if isStr {
+				e.Crid = s
+				continue
+			}
+		case "crsrc":
+			if isStr {
+				e.Crsrc = s
+				continue
+			}
+		case "message", "msg":
+			if isStr {
+				e.Message = s
+				continue
+			}
+		case "keyword":
+			if isStr {
+				e.Keyword = s
+				continue
+			}
+		}
+		if e.Extra == nil {
+			e.Extra = map[string]interface{}{}
+		}
+		e.Extra[strings.TrimPrefix(k, "x_")] = v
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	return
+}
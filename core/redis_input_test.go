@@ -1,9 +1,25 @@
 package core
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"expvar"
 	"github.com/go-redis/redis"
 	"github.com/logtube/logtubed/types"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -200,3 +216,353 @@ func TestRedisInput_Run(t *testing.T) {
 	cancel()
 	<-done
 }
+
+func runTestRedisInput(t *testing.T, opts RedisInputOptions) (eo *testEventConsumer, stop func()) {
+	eo = &testEventConsumer{data: make(chan types.Event, 5)}
+	opts.Next = eo
+	ri, err := NewRedisInput(opts)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ri.Run(ctx)
+	}()
+	time.Sleep(time.Millisecond * 200)
+	stop = func() {
+		cancel()
+		require.NoError(t, <-done)
+	}
+	return
+}
+
+func TestRedisInput_Auth(t *testing.T) {
+	eo, stop := runTestRedisInput(t, RedisInputOptions{
+		Bind:     "127.0.0.1:4590",
+		Password: "secret",
+		Tokens:   []RedisToken{{Token: "order-token", Envs: []string{"test"}, Projects: []string{"order"}}},
+	})
+	defer stop()
+
+	// no password
+	c := redis.NewClient(&redis.Options{Addr: "127.0.0.1:4590"})
+	require.Error(t, c.RPush("x.compact", `{"t":1565941455000,"e":"test","p":"order","o":"info","m":"hello"}`).Err())
+	_ = c.Close()
+
+	// wrong password
+	c = redis.NewClient(&redis.Options{Addr: "127.0.0.1:4590", Password: "wrong"})
+	require.Error(t, c.Ping().Err())
+	_ = c.Close()
+
+	// password
+	c = redis.NewClient(&redis.Options{Addr: "127.0.0.1:4590", Password: "secret"})
+	require.NoError(t, c.RPush("x.compact", `{"t":1565941455000,"e":"test","p":"user","o":"info","m":"hello"}`).Err())
+	require.Equal(t, "user", (<-eo.data).Project)
+	_ = c.Close()
+
+	// token, events outside allowed project are dropped
+	c = redis.NewClient(&redis.Options{Addr: "127.0.0.1:4590", Password: "order-token"})
+	require.NoError(t, c.RPush("x.compact",
+		`{"t":1565941455000,"e":"test","p":"user","o":"info","m":"hello"}`,
+		`{"t":1565941455000,"e":"test","p":"order","o":"info","m":"hello"}`,
+	).Err())
+	require.Equal(t, "order", (<-eo.data).Project)
+	require.Len(t, eo.data, 0)
+	_ = c.Close()
+}
+
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	var err error
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "logtubed"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return
+}
+
+func TestRedisInput_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-redis-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, cert, key := writeTestCertificate(t, dir)
+
+	eo, stop := runTestRedisInput(t, RedisInputOptions{
+		Bind:        "127.0.0.1:4591",
+		TLSBind:     "127.0.0.1:4592",
+		TLSCert:     certFile,
+		TLSKey:      keyFile,
+		TLSClientCA: certFile,
+	})
+	defer stop()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	// plaintext listener still works
+	c := redis.NewClient(&redis.Options{Addr: "127.0.0.1:4591"})
+	require.NoError(t, c.Ping().Err())
+	_ = c.Close()
+
+	// TLS without client certificate
+	c = redis.NewClient(&redis.Options{Addr: "127.0.0.1:4592", TLSConfig: &tls.Config{RootCAs: pool}})
+	require.Error(t, c.Ping().Err())
+	_ = c.Close()
+
+	// TLS with client certificate
+	c = redis.NewClient(&redis.Options{Addr: "127.0.0.1:4592", TLSConfig: &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+	}})
+	require.NoError(t, c.RPush("x.compact", `{"t":1565941455000,"e":"test","p":"order","o":"info","m":"hello"}`).Err())
+	require.Equal(t, "hello", (<-eo.data).Message)
+	_ = c.Close()
+}
+
+func TestRedisInput_Commands(t *testing.T) {
+	eo, stop := runTestRedisInput(t, RedisInputOptions{
+		Bind:              "127.0.0.1:4593",
+		Multi:             true,
+		LogtubeTimeOffset: -8,
+	})
+	defer stop()
+
+	const beat = `{"beat":{"hostname":"example-1.com"},"source":"/var/log/test/debug/test.2019-01-02.log","message":"[2019/01/02 03:04:05.666] CRID[abcdefg] hello, world"}`
+
+	c := redis.NewClient(&redis.Options{Addr: "127.0.0.1:4593", DB: 3})
+	defer c.Close()
+
+	// SELECT is sent on connect for non-zero DB
+	require.NoError(t, c.Ping().Err())
+
+	info, err := c.Info("server").Result()
+	require.NoError(t, err)
+	require.Contains(t, info, "# Server")
+	require.Contains(t, info, "redis_version:2.4")
+	require.NotContains(t, info, "# Stats")
+	info, err = c.Info().Result()
+	require.NoError(t, err)
+	require.Contains(t, info, "total_commands_processed:")
+
+	// PUBLISH
+	n, err := c.Publish("anychannel", beat).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+	e := <-eo.data
+	require.Equal(t, "example-1.com", e.Hostname)
+
+	// MULTI / EXEC
+	_, err = c.TxPipelined(func(p redis.Pipeliner) error {
+		p.RPush("anykey", beat)
+		p.RPush("anykey", beat)
+		return nil
+	})
+	require.NoError(t, err)
+	<-eo.data
+	<-eo.data
+	require.Error(t, c.Do("exec").Err())
+
+	// CLIENT SETNAME / GETNAME
+	c1 := redis.NewClient(&redis.Options{Addr: "127.0.0.1:4593", PoolSize: 1})
+	defer c1.Close()
+	require.NoError(t, c1.Do("client", "setname", "worker-1").Err())
+	name, err := c1.Do("client", "getname").String()
+	require.NoError(t, err)
+	require.Equal(t, "worker-1", name)
+
+	// EVALSHA misses
+	err = c.EvalSha("0123456789abcdef0123456789abcdef01234567", nil).Err()
+	require.Error(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "NOSCRIPT"))
+}
+
+func TestRedisInput_Routes(t *testing.T) {
+	_, err := NewRedisInput(RedisInputOptions{
+		Next:   &testEventConsumer{},
+		Routes: []RedisKeyRoute{{Pattern: "app:*", Decoder: "xml"}},
+	})
+	require.Error(t, err)
+
+	eo, stop := runTestRedisInput(t, RedisInputOptions{
+		Bind: "127.0.0.1:4594",
+		Routes: []RedisKeyRoute{
+			{Pattern: "app:orders:*", Decoder: RedisDecoderLine, Env: "prod", Project: "ms-order"},
+			{Pattern: "app:json:*", Decoder: RedisDecoderNDJSON, Env: "prod", Project: "ms-json", Topic: "audit"},
+		},
+	})
+	defer stop()
+
+	c := redis.NewClient(&redis.Options{Addr: "127.0.0.1:4594"})
+	defer c.Close()
+
+	require.NoError(t, c.RPush("app:orders:prod", "order 1 created\n").Err())
+	e := <-eo.data
+	require.Equal(t, "order 1 created", e.Message)
+	require.Equal(t, "prod", e.Env)
+	require.Equal(t, "ms-order", e.Project)
+	require.Equal(t, "info", e.Topic)
+	require.Equal(t, "127.0.0.1", e.Hostname)
+
+	require.NoError(t, c.RPush("app:json:1",
+		`{"timestamp":"2019-01-02T03:04:05.666Z","project":"ms-override","message":"hello","user":"u1"}`+"\n"+
+			`{"message":"world","topic":"debug"}`,
+	).Err())
+	e = <-eo.data
+	require.Equal(t, "hello", e.Message)
+	require.Equal(t, "ms-override", e.Project)
+	require.Equal(t, "prod", e.Env)
+	require.Equal(t, "audit", e.Topic)
+	require.Equal(t, "u1", e.Extra["user"])
+	require.Equal(t, 2019, e.Timestamp.Year())
+	e = <-eo.data
+	require.Equal(t, "world", e.Message)
+	require.Equal(t, "debug", e.Topic)
+}
+
+func TestRedisInput_Limit(t *testing.T) {
+	varDropped, varTruncated := &expvar.Map{}, &expvar.Map{}
+	eo, stop := runTestRedisInput(t, RedisInputOptions{
+		Bind:           "127.0.0.1:4595",
+		MaxRawSize:     200,
+		MaxMessageSize: 50,
+		VarDropped:     varDropped,
+		VarTruncated:   varTruncated,
+		Routes: []RedisKeyRoute{
+			{Pattern: "app:*", Decoder: RedisDecoderLine, Project: "ms-order"},
+		},
+	})
+	defer stop()
+
+	c := redis.NewClient(&redis.Options{Addr: "127.0.0.1:4595"})
+	defer c.Close()
+
+	require.NoError(t, c.RPush("app:1", strings.Repeat("a", 60), "short").Err())
+	e := <-eo.data
+	require.Equal(t, "short", e.Message)
+	require.Equal(t, "1", varDropped.Get("ms-order").String())
+
+	ri := &redisInput{optMaxRawSize: 200, optMaxMessageSize: 50, optTruncate: true, varTruncated: varTruncated}
+	e = types.Event{Project: "ms-order", Message: strings.Repeat("中", 20), RawSize: 60}
+	require.True(t, ri.limitEvent(&e))
+	require.Equal(t, strings.Repeat("中", 16), e.Message)
+	require.Equal(t, true, e.Extra["truncated"])
+	require.Equal(t, 60, e.Extra["original_size"])
+	require.Equal(t, "1", varTruncated.Get("ms-order").String())
+
+	e = types.Event{Message: strings.Repeat("a", 40), RawSize: 220}
+	require.True(t, ri.limitEvent(&e))
+	require.Equal(t, 20, len(e.Message))
+	require.Equal(t, "1", varTruncated.Get("unknown").String())
+
+	e = types.Event{Message: "ok", RawSize: 100}
+	require.True(t, ri.limitEvent(&e))
+	require.Nil(t, e.Extra)
+}
+
+func TestRedisInput_Strict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-redis-capture")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	capture, err := NewRawCapture(RawCaptureOptions{File: filepath.Join(dir, "capture.ndjson"), Sample: 2})
+	require.NoError(t, err)
+	defer capture.Close()
+
+	varStats := &expvar.Map{}
+	eo, stop := runTestRedisInput(t, RedisInputOptions{
+		Bind:     "127.0.0.1:4596",
+		Strict:   true,
+		VarStats: varStats,
+		Capture:  capture,
+	})
+	defer stop()
+
+	c := redis.NewClient(&redis.Options{Addr: "127.0.0.1:4596"})
+	defer c.Close()
+
+	const ce = `{"t":1546398245666,"h":"example-1.com","e":"test","p":"ms-order","o":"info","m":"hello"}`
+
+	n, err := c.RPush("xlog.compact", ce, "bad-1", ce).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+	<-eo.data
+	<-eo.data
+
+	err = c.RPush("xlog.compact", "bad-2").Err()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "1 values failed to decode")
+
+	require.Error(t, c.RPush("xlog", "bad-3").Err())
+
+	require.Equal(t, "2", varStats.Get("compact.decoded").String())
+	require.Equal(t, "2", varStats.Get("compact.failed").String())
+	require.Equal(t, "1", varStats.Get("beat.failed").String())
+
+	// one of every 2 failures captured
+	require.NoError(t, capture.Close())
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "capture.ndjson"))
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], `"raw":"bad-1"`)
+	require.Contains(t, lines[1], `"raw":"bad-3"`)
+	require.Contains(t, lines[1], `"pipeline":"beat"`)
+}
+
+func TestRedisInput_CompactBatch(t *testing.T) {
+	eo, stop := runTestRedisInput(t, RedisInputOptions{
+		Bind:   "127.0.0.1:4597",
+		Strict: true,
+	})
+	defer stop()
+
+	c := redis.NewClient(&redis.Options{Addr: "127.0.0.1:4597"})
+	defer c.Close()
+
+	// single event, pretty printed
+	n, err := c.RPush("xlog.compact", "{\n  \"t\": 1,\n  \"p\": \"test\",\n  \"m\": \"single\"\n}").Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+	require.Equal(t, "single", (<-eo.data).Message)
+
+	// JSON array, with an invalid event
+	n, err = c.RPush("xlog.compact", `[{"t":1,"p":"test","m":"a"},{"t":2},{"t":3,"p":"test","m":"b"}]`).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+	require.Equal(t, "a", (<-eo.data).Message)
+	require.Equal(t, "b", (<-eo.data).Message)
+
+	// gzipped NDJSON, with key suffix
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	_, _ = w.Write([]byte("{\"t\":1,\"p\":\"test\",\"m\":\"c\"}\n{\"t\":2,\"p\":\"test\",\"m\":\"d\"}\n"))
+	require.NoError(t, w.Close())
+	n, err = c.RPush("xlog.compact.gz", buf.String()).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+	e := <-eo.data
+	require.Equal(t, "c", e.Message)
+	require.Equal(t, len(`{"t":1,"p":"test","m":"c"}`), e.RawSize)
+	require.Equal(t, "d", (<-eo.data).Message)
+
+	// zstd is not supported
+	err = c.RPush("xlog.compact", string([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00})).Err()
+	require.Error(t, err)
+}
@@ -0,0 +1,498 @@
+package core
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/logtube/logtubed/beat"
+	"github.com/logtube/logtubed/types"
+	"github.com/rs/zerolog/log"
+	"go.guoyk.net/common"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	replayModeJSON    = "json"
+	replayModeLogfmt  = "logfmt"
+	replayModeText    = "text"
+	replayModeLogtube = "logtube"
+
+	replayCheckpointEvery = 1000
+)
+
+var (
+	replayTextStart    = regexp.MustCompile(`^\[\d{4}-\d{2}-\d{2}T`)
+	replayTextPattern  = regexp.MustCompile(`(?s)^\[(\S+)\] \((.*?)\) \[(.*?)\] ?(.*)$`)
+	replayLogtubeStart = regexp.MustCompile(`^\[\d{4}[/-]\d{2}[/-]\d{2} \d{2}:\d{2}:\d{2}`)
+	replayFileExts     = []string{".log", ".gz", ".ndjson", ".json"}
+)
+
+type ReplayOptions struct {
+	Paths      []string  // files or directories, LocalOutput files, gzip archives or NDJSON
+	From       time.Time // inclusive, zero for unlimited
+	To         time.Time // exclusive, zero for unlimited
+	Projects   []string
+	Topics     []string
+	Rate       int    // max events per second, 0 for unlimited
+	Checkpoint string // file to save progress, replay resumes from it
+	TimeOffset int    // default time offset of Logtube V1 messages
+
+	Next types.EventConsumer `json:"-"`
+}
+
+// Replayer reads events back from files and feeds them to a EventConsumer, Run returns once all files are replayed
+type Replayer interface {
+	common.Runnable
+}
+
+type replayProgress struct {
+	Records int64 `json:"records"`
+	Done    bool  `json:"done"`
+}
+
+type replayCheckpoint struct {
+	Files map[string]*replayProgress `json:"files"`
+}
+
+type replayer struct {
+	optPaths      []string
+	optFrom       time.Time
+	optTo         time.Time
+	optProjects   map[string]bool
+	optTopics     map[string]bool
+	optRate       int
+	optCheckpoint string
+	optTimeOffset int
+
+	next types.EventConsumer
+
+	cp replayCheckpoint
+
+	start    time.Time
+	sent     int64
+	skipped  int64
+	filtered int64
+}
+
+func NewReplayer(opts ReplayOptions) (Replayer, error) {
+	if len(opts.Paths) == 0 {
+		return nil, errors.New("replay: Paths is not set")
+	}
+	if opts.Next == nil {
+		return nil, errors.New("replay: Next is not set")
+	}
+	log.Info().Interface("opts", opts).Msg("replayer created")
+	r := &replayer{
+		optPaths:      opts.Paths,
+		optFrom:       opts.From,
+		optTo:         opts.To,
+		optRate:       opts.Rate,
+		optCheckpoint: opts.Checkpoint,
+		optTimeOffset: opts.TimeOffset,
+		next:          opts.Next,
+		cp:            replayCheckpoint{Files: map[string]*replayProgress{}},
+	}
+	if len(opts.Projects) > 0 {
+		r.optProjects = map[string]bool{}
+		for _, p := range opts.Projects {
+			r.optProjects[p] = true
+		}
+	}
+	if len(opts.Topics) > 0 {
+		r.optTopics = map[string]bool{}
+		for _, t := range opts.Topics {
+			r.optTopics[t] = true
+		}
+	}
+	return r, nil
+}
+
+func (r *replayer) loadCheckpoint() (err error) {
+	if r.optCheckpoint == "" {
+		return
+	}
+	var buf []byte
+	if buf, err = ioutil.ReadFile(r.optCheckpoint); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(buf, &r.cp); err != nil {
+		return
+	}
+	if r.cp.Files == nil {
+		r.cp.Files = map[string]*replayProgress{}
+	}
+	return
+}
+
+func (r *replayer) saveCheckpoint() (err error) {
+	if r.optCheckpoint == "" {
+		return
+	}
+	var buf []byte
+	if buf, err = json.Marshal(r.cp); err != nil {
+		return
+	}
+	tmp := r.optCheckpoint + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, r.optCheckpoint)
+}
+
+func isReplayFile(name string) bool {
+	if strings.HasSuffix(name, localOutputMetaExt) {
+		return false
+	}
+	for _, ext := range replayFileExts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// files expand directories, sorted for stable order across resumes
+func (r *replayer) files() (files []string, err error) {
+	for _, p := range r.optPaths {
+		var info os.FileInfo
+		if info, err = os.Stat(p); err != nil {
+			return
+		}
+		if !info.IsDir() {
+			if p, err = filepath.Abs(p); err != nil {
+				return
+			}
+			files = append(files, p)
+			continue
+		}
+		if err = filepath.Walk(p, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !isReplayFile(info.Name()) {
+				return nil
+			}
+			if name, err = filepath.Abs(name); err != nil {
+				return err
+			}
+			files = append(files, name)
+			return nil
+		}); err != nil {
+			return
+		}
+	}
+	sort.Strings(files)
+	return
+}
+
+// replayFileMeta env, topic and project of a LocalOutput file, by meta file beside it or by file name
+func replayFileMeta(name string) (e types.Event, ok bool) {
+	var fi localOutputFileInfo
+	if fi, ok = parseLocalOutputFileName(filepath.Base(name)); !ok {
+		return
+	}
+	var m localOutputMeta
+	if m, ok = resolveLocalOutputMeta(filepath.Dir(name), fi.prefix); ok {
+		e.Topic, e.Env, e.Project = m.Topic, m.Env, m.Project
+	}
+	return
+}
+
+func detectReplayMode(line string) string {
+	switch {
+	case strings.HasPrefix(line, "{"):
+		return replayModeJSON
+	case strings.HasPrefix(line, "timestamp="):
+		return replayModeLogfmt
+	case replayTextStart.MatchString(line):
+		return replayModeText
+	case replayLogtubeStart.MatchString(line):
+		return replayModeLogtube
+	}
+	return ""
+}
+
+// parseLogfmt parse a line produced by LocalOutput logfmt format
+func parseLogfmt(line string) (m map[string]interface{}, ok bool) {
+	m = map[string]interface{}{}
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " ")
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			return
+		}
+		k := line[:i]
+		line = line[i+1:]
+		var v string
+		if strings.HasPrefix(line, "\"") {
+			// find closing quote
+			j := 1
+			for ; j < len(line); j++ {
+				if line[j] == '\\' {
+					j++
+				} else if line[j] == '"' {
+					break
+				}
+			}
+			if j >= len(line) {
+				return
+			}
+			var err error
+			if v, err = strconv.Unquote(line[:j+1]); err != nil {
+				return
+			}
+			line = line[j+1:]
+			m[k] = v
+			continue
+		}
+		if j := strings.IndexByte(line, ' '); j >= 0 {
+			v, line = line[:j], line[j:]
+		} else {
+			v, line = line, ""
+		}
+		// non-string extra values are JSON encoded
+		var jv interface{}
+		if strings.HasPrefix(k, "x_") && json.Unmarshal([]byte(v), &jv) == nil {
+			m[k] = jv
+		} else {
+			m[k] = v
+		}
+	}
+	ok = true
+	return
+}
+
+func (r *replayer) decode(mode string, record string, meta types.Event) (e types.Event, ok bool) {
+	switch mode {
+	case replayModeJSON:
+		var m map[string]interface{}
+		if json.Unmarshal([]byte(record), &m) != nil {
+			return
+		}
+		return types.EventFromMap(m)
+	case replayModeLogfmt:
+		var m map[string]interface{}
+		if m, ok = parseLogfmt(record); !ok {
+			return
+		}
+		return types.EventFromMap(m)
+	case replayModeText:
+		match := replayTextPattern.FindStringSubmatch(record)
+		if match == nil {
+			return
+		}
+		var err error
+		if e.Timestamp, err = time.Parse(time.RFC3339, match[1]); err != nil {
+			return
+		}
+		e.Env, e.Topic, e.Project = meta.Env, meta.Topic, meta.Project
+		e.Crid, e.Keyword, e.Message = match[2], match[3], match[4]
+		ok = true
+		return
+	case replayModeLogtube:
+		e.Env, e.Topic, e.Project = meta.Env, meta.Topic, meta.Project
+		ok = beat.DecodeLogtubeMessage(record, r.optTimeOffset, &e)
+		return
+	}
+	return
+}
+
+func (r *replayer) match(e types.Event) bool {
+	if !r.optFrom.IsZero() && e.Timestamp.Before(r.optFrom) {
+		return false
+	}
+	if !r.optTo.IsZero() && !e.Timestamp.Before(r.optTo) {
+		return false
+	}
+	if r.optProjects != nil && !r.optProjects[e.Project] {
+		return false
+	}
+	if r.optTopics != nil && !r.optTopics[e.Topic] {
+		return false
+	}
+	return true
+}
+
+// throttle sleep to keep the rate limit
+func (r *replayer) throttle(ctx context.Context) {
+	if r.optRate <= 0 {
+		return
+	}
+	expected := r.start.Add(time.Duration(r.sent) * time.Second / time.Duration(r.optRate))
+	if d := time.Until(expected); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// emit handle a single record, records before progress are skipped for resuming
+func (r *replayer) emit(ctx context.Context, mode string, record string, meta types.Event, p *replayProgress, n *int64) (err error) {
+	*n++
+	if *n <= p.Records {
+		return
+	}
+	defer func() {
+		if err == nil {
+			p.Records = *n
+			if p.Records%replayCheckpointEvery == 0 {
+				err = r.saveCheckpoint()
+			}
+		}
+	}()
+	e, ok := r.decode(mode, record, meta)
+	if !ok || e.Env == "" || e.Topic == "" || e.Project == "" {
+		r.skipped++
+		return
+	}
+	if !r.match(e) {
+		r.filtered++
+		return
+	}
+	if e.RawSize == 0 {
+		e.RawSize = len(record)
+	}
+	r.throttle(ctx)
+	if err = r.next.ConsumeEvent(e); err != nil {
+		return
+	}
+	r.sent++
+	return
+}
+
+func (r *replayer) replayFile(ctx context.Context, name string, p *replayProgress) (err error) {
+	var f *os.File
+	if f, err = os.Open(name); err != nil {
+		return
+	}
+	defer f.Close()
+
+	var rd io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(f); err != nil {
+			return
+		}
+		defer gr.Close()
+		rd = gr
+	}
+
+	meta, metaOK := replayFileMeta(name)
+	br := bufio.NewReaderSize(rd, 1024*1024)
+
+	var mode string
+	var pending string
+	var n int64
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		var line string
+		line, err = br.ReadString('\n')
+		eof := err == io.EOF
+		if err != nil && !eof {
+			return
+		}
+		err = nil
+		line = strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(line) != "" {
+			if mode == "" {
+				if mode = detectReplayMode(line); mode == "" {
+					return errors.New("replay: unknown format of " + name)
+				}
+				// text and logtube records carry no topic, env and project, never guess them from a ambiguous file name
+				if (mode == replayModeText || mode == replayModeLogtube) && !metaOK {
+					log.Warn().Str("file", name).Msg("replay file skipped, can not resolve topic, env and project, add a " + localOutputMetaExt + " file beside it")
+					return
+				}
+			}
+			switch mode {
+			case replayModeJSON, replayModeLogfmt:
+				if err = r.emit(ctx, mode, line, meta, p, &n); err != nil {
+					return
+				}
+			default:
+				// multi-line messages, a record starts with timestamp
+				start := replayTextStart
+				if mode == replayModeLogtube {
+					start = replayLogtubeStart
+				}
+				if start.MatchString(line) {
+					if pending != "" {
+						if err = r.emit(ctx, mode, pending, meta, p, &n); err != nil {
+							return
+						}
+					}
+					pending = line
+				} else if pending != "" {
+					pending = pending + "\n" + line
+				}
+			}
+		}
+		if eof {
+			break
+		}
+	}
+	if pending != "" {
+		if err = r.emit(ctx, mode, pending, meta, p, &n); err != nil {
+			return
+		}
+	}
+	p.Done = true
+	return
+}
+
+func (r *replayer) Run(ctx context.Context) (err error) {
+	log.Info().Msg("replay started")
+	defer log.Info().Msg("replay stopped")
+
+	if err = r.loadCheckpoint(); err != nil {
+		return
+	}
+	var files []string
+	if files, err = r.files(); err != nil {
+		return
+	}
+
+	r.start = time.Now()
+	defer func() {
+		if err1 := r.saveCheckpoint(); err1 != nil && err == nil {
+			err = err1
+		}
+		log.Info().Int64("sent", r.sent).Int64("filtered", r.filtered).Int64("skipped", r.skipped).Msg("replay summary")
+	}()
+
+	for _, name := range files {
+		p := r.cp.Files[name]
+		if p == nil {
+			p = &replayProgress{}
+			r.cp.Files[name] = p
+		}
+		if p.Done {
+			log.Info().Str("file", name).Msg("replay file skipped, already done")
+			continue
+		}
+		log.Info().Str("file", name).Int64("resume", p.Records).Msg("replay file")
+		if err = r.replayFile(ctx, name, p); err != nil {
+			if ctx.Err() != nil {
+				err = nil
+			}
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/logtube/logtubed/types"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplayer(t *testing.T) {
+	dir := "/tmp/logtubed-replay-test"
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "files"), 0755))
+
+	e1 := types.Event{
+		Timestamp: time.Date(2019, 7, 16, 11, 59, 53, 0, time.UTC),
+		Hostname:  "node-1",
+		Env:       "test",
+		Project:   "ms-order",
+		Topic:     "x-access",
+		Crid:      "aaaa",
+		Message:   "hello world",
+		Extra:     map[string]interface{}{"path": "/api", "status": 200},
+	}
+	e2 := e1
+	e2.Project = "ms-user"
+	e3 := e1
+	e3.Timestamp = e1.Timestamp.Add(time.Hour * 24)
+
+	// LocalOutput logtube format, multi-line
+	var buf []byte
+	for _, e := range []types.Event{e1, e3} {
+		line, err := localOutputSerializeLogtube(e)
+		require.NoError(t, err)
+		buf = append(buf, line...)
+	}
+	buf = append(buf, "  at stacktrace\n"...)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "files", "x-access-test-ms-order-2019-07-16.log"), buf, 0644))
+
+	// gzip archive of NDJSON
+	zbuf := &bytes.Buffer{}
+	zw := gzip.NewWriter(zbuf)
+	for _, e := range []types.Event{e1, e2} {
+		line, err := localOutputSerializeJSON(e)
+		require.NoError(t, err)
+		_, _ = zw.Write(line)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "files", "10.node-1.1.ndjson.gz"), zbuf.Bytes(), 0644))
+
+	// logfmt
+	line, err := localOutputSerializeLogfmt(e2)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "files", "x-access-test-ms-user-2019-07-16.log"), line, 0644))
+
+	var out []types.Event
+	newReplayer := func(fail int) Replayer {
+		r, err := NewReplayer(ReplayOptions{
+			Paths:      []string{filepath.Join(dir, "files")},
+			From:       time.Date(2019, 7, 16, 0, 0, 0, 0, time.UTC),
+			To:         time.Date(2019, 7, 17, 0, 0, 0, 0, time.UTC),
+			Topics:     []string{"x-access"},
+			Checkpoint: filepath.Join(dir, "checkpoint.json"),
+			Next: types.EventConsumerFunc(func(e types.Event) error {
+				if len(out) == fail {
+					return os.ErrClosed
+				}
+				out = append(out, e)
+				return nil
+			}),
+		})
+		require.NoError(t, err)
+		return r
+	}
+
+	// fails after 2 events, resumes from checkpoint
+	require.Error(t, newReplayer(2).Run(context.Background()))
+	require.Len(t, out, 2)
+	require.NoError(t, newReplayer(-1).Run(context.Background()))
+	require.Len(t, out, 4)
+
+	require.Equal(t, "ms-order", out[0].Project)
+	require.Equal(t, "ms-user", out[1].Project)
+	require.Equal(t, "/api", out[1].Extra["path"])
+	require.Equal(t, float64(200), out[1].Extra["status"])
+	require.Equal(t, "ms-order", out[2].Project)
+	require.Equal(t, "x-access", out[2].Topic)
+	require.Equal(t, "test", out[2].Env)
+	require.Equal(t, "aaaa", out[2].Crid)
+	require.True(t, out[2].Timestamp.Equal(e1.Timestamp))
+	require.Equal(t, "ms-user", out[3].Project)
+	require.Equal(t, "node-1", out[3].Hostname)
+	require.Equal(t, "/api", out[3].Extra["path"])
+
+	// all done
+	require.NoError(t, newReplayer(-1).Run(context.Background()))
+	require.Len(t, out, 4)
+}
+
+func TestReplayer_Meta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-replay-meta-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	e := types.Event{
+		Timestamp: time.Date(2019, 7, 16, 11, 59, 53, 0, time.UTC),
+		Env:       "prod",
+		Project:   "ms-test-order",
+		Topic:     "x-access",
+		Crid:      "aaaa",
+		Message:   "hello world",
+	}
+	line, err := localOutputSerializeLogtube(e)
+	require.NoError(t, err)
+	// ambiguous without meta file, env may be prod or test
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "x-access-prod-ms-test-order-2019-07-16.log"), line, 0644))
+
+	var out []types.Event
+	r, err := NewReplayer(ReplayOptions{
+		Paths: []string{dir},
+		Next: types.EventConsumerFunc(func(e types.Event) error {
+			out = append(out, e)
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	require.NoError(t, r.Run(context.Background()))
+	require.Empty(t, out)
+
+	require.NoError(t, writeLocalOutputMeta(dir, localOutputMeta{Topic: "x-access", Env: "prod", Project: "ms-test-order"}))
+	require.NoError(t, r.Run(context.Background()))
+	require.Len(t, out, 1)
+	require.Equal(t, "x-access", out[0].Topic)
+	require.Equal(t, "prod", out[0].Env)
+	require.Equal(t, "ms-test-order", out[0].Project)
+}
@@ -3,16 +3,30 @@ package core
 import (
 	"context"
 	"errors"
+	"expvar"
 	"github.com/logtube/logtubed/types"
 	"github.com/rs/zerolog/log"
 	"go.guoyk.net/common"
 	"go.guoyk.net/sptp"
 	"net"
+	"sync"
+	"time"
+)
+
+const (
+	sptpKernelDropsInterval = time.Second * 10
 )
 
 type SPTPInputOptions struct {
-	Bind string
-	Next types.EventConsumer
+	Bind           string
+	ReadBuffer     int         // socket receive buffer size in bytes, 0 keeps system default
+	Workers        int         // decoding workers, default 4
+	QueueSize      int         // packets waiting for workers, packets are dropped once full, default 1024
+	VarStats       *expvar.Map // decoded, failed and dropped events
+	VarSenders     *expvar.Map // packets, bytes and incomplete chunk groups, per sender IP
+	VarKernelDrops *expvar.Int // drops of the socket reported by /proc/net/udp
+	Capture        RawCapture  // optional, capture packets failed to decode
+	Next           types.EventConsumer
 }
 
 type SPTPInput interface {
@@ -20,14 +34,28 @@ type SPTPInput interface {
 }
 
 type sptpInput struct {
-	next types.EventConsumer
-	addr *net.UDPAddr
+	optReadBuffer int
+	optWorkers    int
+	optQueueSize  int
+
+	next           types.EventConsumer
+	addr           *net.UDPAddr
+	varStats       *expvar.Map
+	varSenders     *expvar.Map
+	varKernelDrops *expvar.Int
+	capture        RawCapture
 }
 
 func NewSPTPInput(opts SPTPInputOptions) (SPTPInput, error) {
 	if len(opts.Bind) == 0 {
 		opts.Bind = "0.0.0.0:9921"
 	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1024
+	}
 	if opts.Next == nil {
 		return nil, errors.New("SPTPInput: Next not set")
 	}
@@ -38,8 +66,15 @@ func NewSPTPInput(opts SPTPInputOptions) (SPTPInput, error) {
 	}
 	log.Info().Str("input", "sptp").Interface("opts", opts).Msg("input created")
 	input := &sptpInput{
-		addr: addr,
-		next: opts.Next,
+		optReadBuffer:  opts.ReadBuffer,
+		optWorkers:     opts.Workers,
+		optQueueSize:   opts.QueueSize,
+		addr:           addr,
+		next:           opts.Next,
+		varStats:       opts.VarStats,
+		varSenders:     opts.VarSenders,
+		varKernelDrops: opts.VarKernelDrops,
+		capture:        opts.Capture,
 	}
 	return input, nil
 }
@@ -56,14 +91,38 @@ func (s *sptpInput) Run(ctx context.Context) error {
 		log.Error().Err(err).Str("input", "SPTP").Msg("failed to bind UDP socket")
 		return err
 	}
-	// SPTP receiver
-	recv := sptp.NewReceiver(conn)
+	if s.optReadBuffer > 0 {
+		if err = conn.SetReadBuffer(s.optReadBuffer); err != nil {
+			log.Error().Err(err).Str("input", "SPTP").Int("read-buffer", s.optReadBuffer).Msg("failed to set socket receive buffer")
+		}
+	}
+	// SPTP receiver, with per sender accounting
+	sc := newSPTPConn(conn, s.varSenders)
+	recv := sptp.NewReceiver(sc)
 	// wait context cancellation
 	go func() {
 		<-ctx.Done()
 		closing = true
 		_ = conn.Close()
 	}()
+	// kernel drops
+	if s.varKernelDrops != nil {
+		go s.watchKernelDrops(ctx, conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+	// decoding workers
+	ch := make(chan []byte, s.optQueueSize)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < s.optWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for buf := range ch {
+				s.consume(buf)
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(ch)
 	// the main loop
 	for {
 		var buf []byte
@@ -79,17 +138,60 @@ func (s *sptpInput) Run(ctx context.Context) error {
 			continue
 		}
 
-		var ce types.CompactEvent
-		if ce, err = types.UnmarshalCompactEventJSON(buf); err != nil {
+		select {
+		case ch <- buf:
+		default:
+			log.Debug().Str("input", "SPTP").Msg("workers busy, packet dropped")
+			inputStatAdd(s.varStats, "queue", InputStatDropped)
+		}
+	}
+}
+
+// consume decode a packet of one or many compact events, see types.UnmarshalCompactEventsJSON
+func (s *sptpInput) consume(buf []byte) {
+	rs, err := types.UnmarshalCompactEventsJSON(buf)
+	if err != nil {
+		s.fail(buf, err)
+		return
+	}
+	for _, res := range rs {
+		if res.Err != nil {
+			s.fail(res.Raw, res.Err)
 			continue
 		}
-		log.Debug().Str("input", "SPTP").Interface("event", ce).Msg("new event")
+		inputStatAdd(s.varStats, RedisDecoderCompact, InputStatDecoded)
+		log.Debug().Str("input", "SPTP").Interface("event", res.Event).Msg("new event")
 
-		e := ce.ToEvent()
-		e.RawSize = len(buf)
+		e := res.Event.ToEvent()
+		e.RawSize = len(res.Raw)
 
 		if err = s.next.ConsumeEvent(e); err != nil {
 			log.Error().Err(err).Str("input", "SPTP").Msg("failed to delivery event")
+			inputStatAdd(s.varStats, RedisDecoderCompact, InputStatDropped)
+		}
+	}
+}
+
+// fail record a payload failed to decode
+func (s *sptpInput) fail(raw []byte, err error) {
+	log.Debug().Err(err).Str("input", "SPTP").Str("event", string(raw)).Msg("failed to decode event")
+	inputStatAdd(s.varStats, RedisDecoderCompact, InputStatFailed)
+	if s.capture != nil {
+		s.capture.Capture("sptp", RedisDecoderCompact, raw, err)
+	}
+}
+
+func (s *sptpInput) watchKernelDrops(ctx context.Context, port int) {
+	tk := time.NewTicker(sptpKernelDropsInterval)
+	defer tk.Stop()
+	for {
+		if drops, ok := readUDPDrops(port); ok {
+			s.varKernelDrops.Set(drops)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tk.C:
 		}
 	}
 }
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"go.guoyk.net/sptp"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// files listing UDP sockets, with drops as the last column
+	procNetUDPFiles = []string{"/proc/net/udp", "/proc/net/udp6"}
+)
+
+type sptpChunkGroup struct {
+	sender    string
+	count     int
+	received  int
+	createdAt time.Time
+}
+
+// sptpConn wraps UDP socket as io.Reader of sptp.Receiver, counts packets, bytes and incomplete chunk groups per sender IP,
+// sptp.Receiver reads in a single goroutine, so no locking here
+type sptpConn struct {
+	conn       *net.UDPConn
+	varSenders *expvar.Map
+
+	groups    map[uint64]*sptpChunkGroup
+	lastSweep time.Time
+}
+
+func newSPTPConn(conn *net.UDPConn, varSenders *expvar.Map) *sptpConn {
+	return &sptpConn{
+		conn:       conn,
+		varSenders: varSenders,
+		groups:     map[uint64]*sptpChunkGroup{},
+		lastSweep:  time.Now(),
+	}
+}
+
+func (c *sptpConn) Read(p []byte) (n int, err error) {
+	var addr *net.UDPAddr
+	if n, addr, err = c.conn.ReadFromUDP(p); err != nil || c.varSenders == nil {
+		return
+	}
+	sender := addr.IP.String()
+	c.varSenders.Add(sender+".packets", 1)
+	c.varSenders.Add(sender+".bytes", int64(n))
+	// track chunk groups the same way as sptp.ChunkPool, groups not completed within timeout are incomplete
+	now := time.Now()
+	if n >= sptp.OverheadChunked && p[0] == sptp.Magic && p[1]&sptp.ModeChunked == sptp.ModeChunked {
+		id := binary.LittleEndian.Uint64(p[2 : sptp.OverheadChunked-2])
+		g := c.groups[id]
+		if g == nil {
+			g = &sptpChunkGroup{sender: sender, count: int(p[sptp.OverheadChunked-2]), createdAt: now}
+			c.groups[id] = g
+		}
+		g.received++
+		if g.received >= g.count {
+			delete(c.groups, id)
+		}
+	}
+	if now.Sub(c.lastSweep) > sptp.ChunkTimeoutDefault {
+		c.lastSweep = now
+		for id, g := range c.groups {
+			if now.Sub(g.createdAt) > sptp.ChunkTimeoutDefault {
+				c.varSenders.Add(g.sender+".incomplete", 1)
+				delete(c.groups, id)
+			}
+		}
+	}
+	return
+}
+
+// readUDPDrops sum drops of UDP sockets bound to port, from /proc/net/udp and /proc/net/udp6
+func readUDPDrops(port int) (drops int64, ok bool) {
+	suffix := fmt.Sprintf(":%04X", port)
+	for _, file := range procNetUDPFiles {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		s := bufio.NewScanner(f)
+		// skip header
+		s.Scan()
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) < 13 || !strings.HasSuffix(fields[1], suffix) {
+				continue
+			}
+			if v, err := strconv.ParseInt(fields[len(fields)-1], 10, 64); err == nil {
+				drops += v
+				ok = true
+			}
+		}
+		_ = f.Close()
+	}
+	return
+}
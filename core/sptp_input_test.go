@@ -5,9 +5,14 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"expvar"
 	"github.com/logtube/logtubed/types"
+	"github.com/stretchr/testify/require"
 	"go.guoyk.net/sptp"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -92,3 +97,100 @@ func TestSPTPInput_Run(t *testing.T) {
 	cancel()
 	<-done
 }
+
+func TestSPTPInput_Stats(t *testing.T) {
+	varSenders, varStats := &expvar.Map{}, &expvar.Map{}
+	eo := &testEventConsumer{data: make(chan types.Event, 100)}
+	si, err := NewSPTPInput(SPTPInputOptions{
+		Bind:       "127.0.0.1:4556",
+		ReadBuffer: 1024 * 1024,
+		Workers:    2,
+		VarStats:   varStats,
+		VarSenders: varSenders,
+		Next:       eo,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- si.Run(ctx)
+	}()
+	time.Sleep(time.Millisecond * 200)
+
+	conn, err := net.Dial("udp", "127.0.0.1:4556")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	buf, err := json.Marshal(&types.CompactEvent{Timestamp: 1, Project: "test", Message: "hello"})
+	require.NoError(t, err)
+	_, err = sptp.NewWriter(conn).Write(buf)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte{sptp.Magic, 0x00, 'x', 'x'})
+	require.NoError(t, err)
+
+	e := <-eo.data
+	require.Equal(t, "hello", e.Message)
+	time.Sleep(time.Millisecond * 100)
+
+	require.Equal(t, "2", varSenders.Get("127.0.0.1.packets").String())
+	require.Equal(t, "1", varStats.Get("compact.decoded").String())
+	require.Equal(t, "1", varStats.Get("compact.failed").String())
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestReadUDPDrops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtubed-proc-net-udp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "udp")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 00000000:26C1 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 12345 2 0000000000000000 42
+  124: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 12346 2 0000000000000000 7
+`), 0644))
+
+	files := procNetUDPFiles
+	defer func() { procNetUDPFiles = files }()
+	procNetUDPFiles = []string{file}
+
+	drops, ok := readUDPDrops(9921)
+	require.True(t, ok)
+	require.Equal(t, int64(42), drops)
+	_, ok = readUDPDrops(9922)
+	require.False(t, ok)
+}
+
+func TestSPTPInput_Batch(t *testing.T) {
+	eo := &testEventConsumer{data: make(chan types.Event, 100)}
+	si, err := NewSPTPInput(SPTPInputOptions{
+		Bind: "127.0.0.1:4557",
+		Next: eo,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- si.Run(ctx)
+	}()
+	time.Sleep(time.Millisecond * 200)
+
+	conn, err := net.Dial("udp", "127.0.0.1:4557")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// NDJSON
+	_, err = sptp.NewWriter(conn).Write([]byte("{\"t\":1,\"p\":\"test\",\"m\":\"a\"}\n{\"t\":2,\"p\":\"test\",\"m\":\"b\"}\n"))
+	require.NoError(t, err)
+	var msgs []string
+	for i := 0; i < 2; i++ {
+		msgs = append(msgs, (<-eo.data).Message)
+	}
+	require.ElementsMatch(t, []string{"a", "b"}, msgs)
+
+	cancel()
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,204 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/logtube/logtubed/types"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TailPath = "/tail"
+
+	tailHeartbeatInterval = time.Second * 15
+)
+
+type TailOptions struct {
+	BufferSize     int // default buffer size of each subscriber
+	MaxSubscribers int
+}
+
+// Tail streams dispatched events to HTTP subscribers as Server-Sent Events
+type Tail interface {
+	types.EventConsumer
+	http.Handler
+}
+
+type tailFilter struct {
+	envs     map[string]bool
+	projects map[string]bool
+	topics   map[string]bool
+	crid     string
+	keyword  string
+}
+
+func splitTailFilter(s string) map[string]bool {
+	var m map[string]bool
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			if m == nil {
+				m = map[string]bool{}
+			}
+			m[v] = true
+		}
+	}
+	return m
+}
+
+func (f tailFilter) match(e types.Event) bool {
+	if f.envs != nil && !f.envs[e.Env] {
+		return false
+	}
+	if f.projects != nil && !f.projects[e.Project] {
+		return false
+	}
+	if f.topics != nil && !f.topics[e.Topic] {
+		return false
+	}
+	if f.crid != "" && f.crid != e.Crid {
+		return false
+	}
+	if f.keyword != "" && !strings.Contains(e.Keyword, f.keyword) && !strings.Contains(e.Message, f.keyword) {
+		return false
+	}
+	return true
+}
+
+type tailSubscriber struct {
+	filter  tailFilter
+	ch      chan types.Event
+	dropped int64
+}
+
+type tail struct {
+	optBufferSize     int
+	optMaxSubscribers int
+
+	lock        sync.RWMutex
+	subscribers map[*tailSubscriber]bool
+}
+
+func NewTail(opts TailOptions) (Tail, error) {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 1000
+	}
+	if opts.MaxSubscribers <= 0 {
+		opts.MaxSubscribers = 16
+	}
+	log.Info().Str("tail", "sse").Interface("opts", opts).Msg("tail created")
+	return &tail{
+		optBufferSize:     opts.BufferSize,
+		optMaxSubscribers: opts.MaxSubscribers,
+		subscribers:       map[*tailSubscriber]bool{},
+	}, nil
+}
+
+// ConsumeEvent never blocks, events are dropped if a subscriber is full
+func (t *tail) ConsumeEvent(e types.Event) error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for s := range t.subscribers {
+		if !s.filter.match(e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+	return nil
+}
+
+func (t *tail) subscribe(f tailFilter, size int) (*tailSubscriber, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.subscribers) >= t.optMaxSubscribers {
+		return nil, errors.New("too many subscribers")
+	}
+	s := &tailSubscriber{filter: f, ch: make(chan types.Event, size)}
+	t.subscribers[s] = true
+	return s, nil
+}
+
+func (t *tail) unsubscribe(s *tailSubscriber) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.subscribers, s)
+}
+
+func (t *tail) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	fl, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	q := req.URL.Query()
+	f := tailFilter{
+		envs:     splitTailFilter(q.Get("env")),
+		projects: splitTailFilter(q.Get("project")),
+		topics:   splitTailFilter(q.Get("topic")),
+		crid:     strings.TrimSpace(q.Get("crid")),
+		keyword:  strings.TrimSpace(q.Get("keyword")),
+	}
+	size := t.optBufferSize
+	if n, err := strconv.Atoi(q.Get("buffer")); err == nil && n > 0 && n < size {
+		size = n
+	}
+
+	s, err := t.subscribe(f, size)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer t.unsubscribe(s)
+
+	log.Info().Str("tail", "sse").Str("addr", req.RemoteAddr).Str("query", req.URL.RawQuery).Msg("subscriber connected")
+	defer log.Info().Str("tail", "sse").Str("addr", req.RemoteAddr).Msg("subscriber disconnected")
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.WriteHeader(http.StatusOK)
+	fl.Flush()
+
+	hb := time.NewTicker(tailHeartbeatInterval)
+	defer hb.Stop()
+
+	for {
+		select {
+		case e := <-s.ch:
+			if n := atomic.SwapInt64(&s.dropped, 0); n > 0 {
+				if _, err = fmt.Fprintf(rw, "event: dropped\ndata: %d\n\n", n); err != nil {
+					return
+				}
+			}
+			var buf []byte
+			if buf, err = json.Marshal(e.ToMap()); err != nil {
+				continue
+			}
+			if _, err = fmt.Fprintf(rw, "data: %s\n\n", buf); err != nil {
+				return
+			}
+			// flush when buffer drained
+			if len(s.ch) == 0 {
+				fl.Flush()
+			}
+		case <-hb.C:
+			if _, err = fmt.Fprint(rw, ": ping\n\n"); err != nil {
+				return
+			}
+			fl.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
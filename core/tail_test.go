@@ -0,0 +1,66 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/logtube/logtubed/types"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTail_ServeHTTP(t *testing.T) {
+	tl, err := NewTail(TailOptions{BufferSize: 2, MaxSubscribers: 1})
+	require.NoError(t, err)
+
+	s := httptest.NewServer(tl)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, _ := http.NewRequest(http.MethodGet, s.URL+TailPath+"?project=ms-order&keyword=hello", nil)
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// second subscriber refused
+	res2, err := http.Get(s.URL + TailPath)
+	require.NoError(t, err)
+	_ = res2.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, res2.StatusCode)
+
+	// never blocks, even if subscriber is full
+	for i := 0; i < 10; i++ {
+		require.NoError(t, tl.ConsumeEvent(types.Event{Timestamp: time.Now(), Project: "ms-order", Topic: "info", Message: "hello world"}))
+	}
+	require.NoError(t, tl.ConsumeEvent(types.Event{Timestamp: time.Now(), Project: "ms-stock", Topic: "info", Message: "hello world"}))
+
+	r := bufio.NewReader(res.Body)
+	var m map[string]interface{}
+	var dropped bool
+	for m == nil || !dropped {
+		var line string
+		line, err = r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "event: dropped\n" {
+			dropped = true
+		} else if strings.HasPrefix(line, "data: {") {
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &m))
+		}
+	}
+	require.Equal(t, "ms-order", m["project"])
+	require.Equal(t, "hello world", m["message"])
+}
+
+func TestTailFilter_Match(t *testing.T) {
+	f := tailFilter{envs: splitTailFilter("test, staging"), topics: splitTailFilter(""), crid: "abc"}
+	require.True(t, f.match(types.Event{Env: "test", Topic: "err", Crid: "abc"}))
+	require.False(t, f.match(types.Event{Env: "prod", Topic: "err", Crid: "abc"}))
+	require.False(t, f.match(types.Event{Env: "staging", Topic: "err", Crid: "abd"}))
+}
@@ -0,0 +1,296 @@
+package core
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"github.com/logtube/logtubed/types"
+	"github.com/rs/zerolog/log"
+	"go.guoyk.net/common"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TraceIndexPath = "/traces/"
+)
+
+type TraceIndexOptions struct {
+	MaxTraces  int                 // max crids held, least recently active ones are evicted
+	MaxEntries int                 // max entries held per crid
+	Window     time.Duration       // a crid is considered quiet after no activity in this duration
+	Emit       bool                // emit a summary event when a crid goes quiet
+	Topic      string              // topic of the summary event
+	Next       types.EventConsumer `json:"-"`
+}
+
+type TraceIndex interface {
+	types.EventConsumer
+	common.Runnable
+	http.Handler
+}
+
+// TraceEntry a single event of a crid
+type TraceEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Hostname  string    `json:"hostname"`
+	Env       string    `json:"env"`
+	Project   string    `json:"project"`
+	Topic     string    `json:"topic"`
+	Crsrc     string    `json:"crsrc"`
+}
+
+// TraceHop a call from one project to another, crsrc of an event is the caller project
+type TraceHop struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Trace summary of a crid
+type Trace struct {
+	Crid      string       `json:"crid"`
+	First     time.Time    `json:"first"`
+	Last      time.Time    `json:"last"`
+	Duration  int64        `json:"duration"` // milliseconds between first and last entries
+	Count     int          `json:"count"`    // total events, may be larger than len(Entries)
+	Projects  []string     `json:"projects"` // projects in order of first appearance
+	Chain     []TraceHop   `json:"chain"`
+	Entries   []TraceEntry `json:"entries"`
+	Truncated bool         `json:"truncated"`
+}
+
+type traceItem struct {
+	crid    string
+	active  time.Time
+	count   int
+	entries []TraceEntry
+}
+
+type traceIndex struct {
+	optMaxTraces  int
+	optMaxEntries int
+	optWindow     time.Duration
+	optEmit       bool
+	optTopic      string
+
+	next types.EventConsumer
+
+	lock  sync.Locker
+	items map[string]*list.Element
+	order *list.List // front is the least recently active
+}
+
+func NewTraceIndex(opts TraceIndexOptions) (TraceIndex, error) {
+	if opts.MaxTraces <= 0 {
+		opts.MaxTraces = 100000
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 100
+	}
+	if opts.Window <= 0 {
+		opts.Window = time.Minute
+	}
+	if len(opts.Topic) == 0 {
+		opts.Topic = "x-trace"
+	}
+	log.Info().Str("trace", "index").Interface("opts", opts).Msg("trace index created")
+	return &traceIndex{
+		optMaxTraces:  opts.MaxTraces,
+		optMaxEntries: opts.MaxEntries,
+		optWindow:     opts.Window,
+		optEmit:       opts.Emit && opts.Next != nil,
+		optTopic:      opts.Topic,
+		next:          opts.Next,
+		lock:          &sync.Mutex{},
+		items:         map[string]*list.Element{},
+		order:         list.New(),
+	}, nil
+}
+
+func (t *traceIndex) ConsumeEvent(e types.Event) error {
+	crid := strings.TrimSpace(e.Crid)
+	if crid == "" || crid == "-" || e.Topic == t.optTopic {
+		return nil
+	}
+	entry := TraceEntry{
+		Timestamp: e.Timestamp,
+		Hostname:  e.Hostname,
+		Env:       e.Env,
+		Project:   e.Project,
+		Topic:     e.Topic,
+		Crsrc:     e.Crsrc,
+	}
+
+	var evicted *traceItem
+
+	t.lock.Lock()
+	el := t.items[crid]
+	if el == nil {
+		if t.order.Len() >= t.optMaxTraces {
+			evicted = t.remove(t.order.Front())
+		}
+		el = t.order.PushBack(&traceItem{crid: crid})
+		t.items[crid] = el
+	} else {
+		t.order.MoveToBack(el)
+	}
+	item := el.Value.(*traceItem)
+	item.active = time.Now()
+	item.count++
+	if len(item.entries) < t.optMaxEntries {
+		item.entries = append(item.entries, entry)
+	}
+	t.lock.Unlock()
+
+	if evicted != nil {
+		t.emit(evicted)
+	}
+	return nil
+}
+
+func (t *traceIndex) remove(el *list.Element) *traceItem {
+	item := t.order.Remove(el).(*traceItem)
+	delete(t.items, item.crid)
+	return item
+}
+
+// Lookup find trace by crid
+func (t *traceIndex) Lookup(crid string) (tr Trace, ok bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var el *list.Element
+	if el, ok = t.items[crid]; !ok {
+		return
+	}
+	tr = summarizeTrace(el.Value.(*traceItem))
+	return
+}
+
+func summarizeTrace(item *traceItem) (tr Trace) {
+	tr.Crid = item.crid
+	tr.Count = item.count
+	tr.Truncated = item.count > len(item.entries)
+	tr.Entries = make([]TraceEntry, len(item.entries))
+	copy(tr.Entries, item.entries)
+	sort.SliceStable(tr.Entries, func(i, j int) bool {
+		return tr.Entries[i].Timestamp.Before(tr.Entries[j].Timestamp)
+	})
+	tr.Projects = []string{}
+	tr.Chain = []TraceHop{}
+	if len(tr.Entries) == 0 {
+		return
+	}
+	tr.First = tr.Entries[0].Timestamp
+	tr.Last = tr.Entries[len(tr.Entries)-1].Timestamp
+	tr.Duration = int64(tr.Last.Sub(tr.First) / time.Millisecond)
+	projects := map[string]bool{}
+	hops := map[TraceHop]bool{}
+	for _, e := range tr.Entries {
+		if !projects[e.Project] {
+			projects[e.Project] = true
+			tr.Projects = append(tr.Projects, e.Project)
+		}
+		if e.Crsrc == "" || e.Crsrc == "-" || e.Crsrc == e.Project {
+			continue
+		}
+		hop := TraceHop{From: e.Crsrc, To: e.Project}
+		if !hops[hop] {
+			hops[hop] = true
+			tr.Chain = append(tr.Chain, hop)
+		}
+	}
+	return
+}
+
+func (t *traceIndex) emit(item *traceItem) {
+	if !t.optEmit {
+		return
+	}
+	tr := summarizeTrace(item)
+	if len(tr.Entries) == 0 {
+		return
+	}
+	root := tr.Entries[0]
+	var chain []string
+	for _, hop := range tr.Chain {
+		chain = append(chain, hop.From+" -> "+hop.To)
+	}
+	e := types.Event{
+		Timestamp: tr.First,
+		Hostname:  root.Hostname,
+		Env:       root.Env,
+		Project:   root.Project,
+		Topic:     t.optTopic,
+		Crid:      tr.Crid,
+		Message:   strings.Join(chain, ", "),
+		Extra: map[string]interface{}{
+			"duration":  tr.Duration,
+			"count":     tr.Count,
+			"projects":  tr.Projects,
+			"truncated": tr.Truncated,
+		},
+	}
+	if err := t.next.ConsumeEvent(e); err != nil {
+		log.Error().Err(err).Str("trace", "index").Msg("failed to emit trace summary")
+	}
+}
+
+// sweep remove quiet crids
+func (t *traceIndex) sweep() {
+	deadline := time.Now().Add(-t.optWindow)
+	var quiet []*traceItem
+	t.lock.Lock()
+	for el := t.order.Front(); el != nil; el = t.order.Front() {
+		if el.Value.(*traceItem).active.After(deadline) {
+			break
+		}
+		quiet = append(quiet, t.remove(el))
+	}
+	t.lock.Unlock()
+	for _, item := range quiet {
+		t.emit(item)
+	}
+}
+
+func (t *traceIndex) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	crid := strings.TrimSpace(strings.TrimPrefix(req.URL.Path, TraceIndexPath))
+	if crid == "" {
+		crid = strings.TrimSpace(req.URL.Query().Get("crid"))
+	}
+	if crid == "" {
+		http.Error(rw, "crid is required", http.StatusBadRequest)
+		return
+	}
+	tr, ok := t.Lookup(crid)
+	if !ok {
+		http.Error(rw, "crid not found", http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(tr)
+}
+
+func (t *traceIndex) Run(ctx context.Context) error {
+	log.Info().Str("trace", "index").Msg("started")
+	defer log.Info().Str("trace", "index").Msg("stopped")
+
+	interval := t.optWindow / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	tk := time.NewTicker(interval)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-tk.C:
+			t.sweep()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
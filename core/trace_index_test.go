@@ -0,0 +1,67 @@
+package core
+
+import (
+	"encoding/json"
+	"github.com/logtube/logtubed/types"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTraceIndex(t *testing.T) {
+	eo := &testEventConsumer{data: make(chan types.Event, 5)}
+
+	ti, err := NewTraceIndex(TraceIndexOptions{
+		MaxTraces:  2,
+		MaxEntries: 3,
+		Window:     time.Millisecond * 10,
+		Emit:       true,
+		Next:       eo,
+	})
+	require.NoError(t, err)
+
+	ts := time.Unix(1563249593, 0)
+	_ = ti.ConsumeEvent(types.Event{Timestamp: ts.Add(time.Millisecond * 20), Env: "test", Project: "ms-order", Topic: "info", Crid: "c1", Crsrc: "gateway"})
+	_ = ti.ConsumeEvent(types.Event{Timestamp: ts, Env: "test", Project: "gateway", Topic: "x-access", Crid: "c1"})
+	_ = ti.ConsumeEvent(types.Event{Timestamp: ts.Add(time.Millisecond * 30), Env: "test", Project: "ms-stock", Topic: "info", Crid: "c1", Crsrc: "ms-order"})
+	_ = ti.ConsumeEvent(types.Event{Timestamp: ts.Add(time.Millisecond * 40), Env: "test", Project: "ms-stock", Topic: "err", Crid: "c1", Crsrc: "ms-order"})
+	_ = ti.ConsumeEvent(types.Event{Timestamp: ts, Project: "ms-order", Topic: "info", Crid: "-"})
+
+	rw := httptest.NewRecorder()
+	ti.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, TraceIndexPath+"c1", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	var tr Trace
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &tr))
+	require.Equal(t, 4, tr.Count)
+	require.Len(t, tr.Entries, 3)
+	require.True(t, tr.Truncated)
+	require.Equal(t, []string{"gateway", "ms-order", "ms-stock"}, tr.Projects)
+	require.Equal(t, []TraceHop{{From: "gateway", To: "ms-order"}, {From: "ms-order", To: "ms-stock"}}, tr.Chain)
+	require.Equal(t, int64(30), tr.Duration)
+
+	rw = httptest.NewRecorder()
+	ti.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, TraceIndexPath+"-", nil))
+	require.Equal(t, http.StatusNotFound, rw.Code)
+
+	// evict least recently active
+	_ = ti.ConsumeEvent(types.Event{Timestamp: ts, Project: "a", Topic: "info", Crid: "c2"})
+	_ = ti.ConsumeEvent(types.Event{Timestamp: ts, Project: "b", Topic: "info", Crid: "c3"})
+	e := <-eo.data
+	require.Equal(t, "x-trace", e.Topic)
+	require.Equal(t, "c1", e.Crid)
+	require.Equal(t, "gateway", e.Project)
+	require.Equal(t, "gateway -> ms-order, ms-order -> ms-stock", e.Message)
+
+	// emitted summary is not indexed
+	require.NoError(t, ti.ConsumeEvent(e))
+
+	// sweep quiet crids
+	time.Sleep(time.Millisecond * 20)
+	ti.(*traceIndex).sweep()
+	require.Equal(t, "c2", (<-eo.data).Crid)
+	require.Equal(t, "c3", (<-eo.data).Crid)
+	require.Zero(t, ti.(*traceIndex).order.Len())
+}
@@ -5,6 +5,11 @@ import (
 	"strings"
 )
 
+const (
+	// project name used in per-project counters for events without project
+	unknownProject = "unknown"
+)
+
 func digestPathComponent(s string) string {
 	if n, e := url.PathUnescape(s); e == nil && n != s {
 		s = n
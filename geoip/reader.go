@@ -0,0 +1,376 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// a minimal reader of MaxMind DB format (https://maxmind.github.io/MaxMind-DB/), enough for GeoIP2 / GeoLite2 City and ASN databases
+
+var (
+	ErrInvalidDatabase = errors.New("geoip: invalid MaxMind DB file")
+
+	metadataStartMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+)
+
+const (
+	// metadata is located in the last 128KiB of the file
+	metadataMaxSize = 128 * 1024
+
+	// 16 bytes of zeros between search tree and data section
+	dataSectionSeparatorSize = 16
+)
+
+// data field types
+const (
+	typeExtended = 0
+	typePointer  = 1
+	typeString   = 2
+	typeDouble   = 3
+	typeBytes    = 4
+	typeUint16   = 5
+	typeUint32   = 6
+	typeMap      = 7
+	typeInt32    = 8
+	typeUint64   = 9
+	typeUint128  = 10
+	typeArray    = 11
+	typeBoolean  = 14
+	typeFloat    = 15
+)
+
+type Metadata struct {
+	NodeCount    uint
+	RecordSize   uint
+	IPVersion    uint
+	DatabaseType string
+}
+
+// Reader reads a MaxMind DB file fully into memory, safe for concurrent use
+type Reader struct {
+	Metadata Metadata
+
+	buf         []byte
+	tree        []byte
+	data        []byte
+	ipv4Start   uint
+	nodeByteLen uint
+}
+
+// Open read a MaxMind DB file
+func Open(file string) (*Reader, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(buf)
+}
+
+// NewReader create a Reader from content of a MaxMind DB file
+func NewReader(buf []byte) (r *Reader, err error) {
+	start := 0
+	if len(buf) > metadataMaxSize {
+		start = len(buf) - metadataMaxSize
+	}
+	i := bytes.LastIndex(buf[start:], metadataStartMarker)
+	if i < 0 {
+		return nil, ErrInvalidDatabase
+	}
+	metaStart := start + i + len(metadataStartMarker)
+
+	r = &Reader{buf: buf}
+	var meta interface{}
+	if meta, _, err = (&decoder{buf: buf[metaStart:]}).decode(0, 0); err != nil {
+		return nil, err
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidDatabase
+	}
+	r.Metadata.NodeCount = uintOf(m["node_count"])
+	r.Metadata.RecordSize = uintOf(m["record_size"])
+	r.Metadata.IPVersion = uintOf(m["ip_version"])
+	r.Metadata.DatabaseType, _ = m["database_type"].(string)
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("geoip: unsupported record size %d", r.Metadata.RecordSize)
+	}
+	r.nodeByteLen = r.Metadata.RecordSize / 4
+	treeSize := r.Metadata.NodeCount * r.nodeByteLen
+	if treeSize+dataSectionSeparatorSize > uint(start+i) {
+		return nil, ErrInvalidDatabase
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[treeSize+dataSectionSeparatorSize : start+i]
+
+	// IPv4 addresses in IPv6 tree are located at ::/96
+	if r.Metadata.IPVersion == 6 {
+		node := uint(0)
+		for n := 0; n < 96 && node < r.Metadata.NodeCount; n++ {
+			if node, err = r.record(node, 0); err != nil {
+				return nil, err
+			}
+		}
+		r.ipv4Start = node
+	}
+	return
+}
+
+func uintOf(v interface{}) uint {
+	switch n := v.(type) {
+	case uint64:
+		return uint(n)
+	case uint32:
+		return uint(n)
+	case uint16:
+		return uint(n)
+	case int32:
+		return uint(n)
+	}
+	return 0
+}
+
+// record read left (bit 0) or right (bit 1) record of a node
+func (r *Reader) record(node uint, bit uint) (uint, error) {
+	off := node * r.nodeByteLen
+	if off+r.nodeByteLen > uint(len(r.tree)) {
+		return 0, ErrInvalidDatabase
+	}
+	b := r.tree[off : off+r.nodeByteLen]
+	switch r.Metadata.RecordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+// Lookup find the data record of a IP address, ok is false if not found
+func (r *Reader) Lookup(ip net.IP) (result map[string]interface{}, ok bool, err error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if r.Metadata.IPVersion == 4 {
+		return
+	}
+	bits := uint(len(ip) * 8)
+	for i := uint(0); i < bits && node < r.Metadata.NodeCount; i++ {
+		bit := uint(ip[i>>3]>>(7-(i&7))) & 1
+		if node, err = r.record(node, bit); err != nil {
+			return
+		}
+	}
+	if node <= r.Metadata.NodeCount {
+		// node_count means no data
+		return
+	}
+	off := node - r.Metadata.NodeCount - dataSectionSeparatorSize
+	var v interface{}
+	if v, _, err = (&decoder{buf: r.data}).decode(off, 0); err != nil {
+		return
+	}
+	result, ok = v.(map[string]interface{})
+	return
+}
+
+type decoder struct {
+	buf []byte
+}
+
+const (
+	// guards against pointer loops and deeply nested data in corrupted files
+	decoderMaxDepth = 32
+)
+
+// decode a field at offset, returns the value and the offset after the field
+func (d *decoder) decode(off uint, depth int) (v interface{}, next uint, err error) {
+	if depth > decoderMaxDepth {
+		err = ErrInvalidDatabase
+		return
+	}
+	if off >= uint(len(d.buf)) {
+		err = ErrInvalidDatabase
+		return
+	}
+	ctrl := d.buf[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == typePointer {
+		var ptr uint
+		if ptr, next, err = d.pointer(ctrl, off); err != nil {
+			return
+		}
+		v, _, err = d.decode(ptr, depth+1)
+		return
+	}
+	if typ == typeExtended {
+		if off >= uint(len(d.buf)) {
+			err = ErrInvalidDatabase
+			return
+		}
+		typ = 7 + uint(d.buf[off])
+		off++
+	}
+	var size uint
+	if size, off, err = d.size(ctrl, off); err != nil {
+		return
+	}
+	switch typ {
+	case typeMap, typeArray:
+		// every entry takes at least one byte
+		if size > uint(len(d.buf))-off {
+			err = ErrInvalidDatabase
+			return
+		}
+	}
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, val interface{}
+			if k, off, err = d.decode(off, depth+1); err != nil {
+				return
+			}
+			if val, off, err = d.decode(off, depth+1); err != nil {
+				return
+			}
+			ks, isStr := k.(string)
+			if !isStr {
+				err = ErrInvalidDatabase
+				return
+			}
+			m[ks] = val
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var val interface{}
+			if val, off, err = d.decode(off, depth+1); err != nil {
+				return
+			}
+			a = append(a, val)
+		}
+		return a, off, nil
+	case typeBoolean:
+		return size != 0, off, nil
+	}
+	if off+size > uint(len(d.buf)) {
+		err = ErrInvalidDatabase
+		return
+	}
+	b := d.buf[off : off+size]
+	next = off + size
+	switch typ {
+	case typeString:
+		v = string(b)
+	case typeBytes:
+		v = append([]byte(nil), b...)
+	case typeDouble:
+		if size != 8 {
+			err = ErrInvalidDatabase
+			return
+		}
+		v = math.Float64frombits(binary.BigEndian.Uint64(b))
+	case typeFloat:
+		if size != 4 {
+			err = ErrInvalidDatabase
+			return
+		}
+		v = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			err = ErrInvalidDatabase
+			return
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		v = n
+	case typeInt32:
+		if size > 4 {
+			err = ErrInvalidDatabase
+			return
+		}
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		v = int32(n)
+	case typeUint128:
+		// not used by GeoIP2 databases, kept as bytes
+		v = append([]byte(nil), b...)
+	default:
+		err = fmt.Errorf("geoip: unknown data type %d", typ)
+	}
+	return
+}
+
+func (d *decoder) size(ctrl byte, off uint) (size uint, next uint, err error) {
+	size = uint(ctrl & 0x1f)
+	var n uint
+	switch size {
+	case 29:
+		n = 1
+	case 30:
+		n = 2
+	case 31:
+		n = 3
+	default:
+		return size, off, nil
+	}
+	if off+n > uint(len(d.buf)) {
+		err = ErrInvalidDatabase
+		return
+	}
+	var ext uint
+	for _, c := range d.buf[off : off+n] {
+		ext = ext<<8 | uint(c)
+	}
+	switch size {
+	case 29:
+		size = 29 + ext
+	case 30:
+		size = 285 + ext
+	case 31:
+		size = 65821 + ext
+	}
+	return size, off + n, nil
+}
+
+func (d *decoder) pointer(ctrl byte, off uint) (ptr uint, next uint, err error) {
+	ss := uint(ctrl>>3) & 0x3
+	n := ss + 1
+	if off+n > uint(len(d.buf)) {
+		err = ErrInvalidDatabase
+		return
+	}
+	b := d.buf[off : off+n]
+	vvv := uint(ctrl & 0x7)
+	switch ss {
+	case 0:
+		ptr = vvv<<8 | uint(b[0])
+	case 1:
+		ptr = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+	case 2:
+		ptr = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+	default:
+		ptr = uint(binary.BigEndian.Uint32(b))
+	}
+	return ptr, off + n, nil
+}
@@ -0,0 +1,81 @@
+package geoip
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+)
+
+func testDatabase(t *testing.T, ipVersion, recordSize int) *Reader {
+	w := &Writer{IPVersion: ipVersion, RecordSize: recordSize, DatabaseType: "GeoIP2-City"}
+	_, n1, _ := net.ParseCIDR("1.2.3.0/24")
+	require.NoError(t, w.Insert(n1, map[string]interface{}{
+		"country":      map[string]interface{}{"iso_code": "CN"},
+		"subdivisions": []interface{}{map[string]interface{}{"names": map[string]interface{}{"en": "Beijing"}}},
+		"city":         map[string]interface{}{"names": map[string]interface{}{"en": "Beijing"}},
+		"location":     map[string]interface{}{"latitude": 39.9, "longitude": 116.4},
+		"is_anycast":   true,
+	}))
+	_, n2, _ := net.ParseCIDR("8.8.0.0/16")
+	require.NoError(t, w.Insert(n2, map[string]interface{}{
+		"autonomous_system_number":       uint(15169),
+		"autonomous_system_organization": strings.Repeat("Google ", 50),
+	}))
+	if ipVersion == 6 {
+		_, n3, _ := net.ParseCIDR("2001:db8::/32")
+		require.NoError(t, w.Insert(n3, map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "US"},
+		}))
+	}
+	buf, err := w.Bytes()
+	require.NoError(t, err)
+	r, err := NewReader(buf)
+	require.NoError(t, err)
+	require.Equal(t, "GeoIP2-City", r.Metadata.DatabaseType)
+	return r
+}
+
+func TestReader_LookupRecord(t *testing.T) {
+	for _, c := range []struct{ v, s int }{{6, 24}, {6, 28}, {6, 32}, {4, 24}, {4, 28}} {
+		r := testDatabase(t, c.v, c.s)
+
+		rec, ok, err := r.LookupRecord(net.ParseIP("1.2.3.4"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, Record{Country: "CN", Region: "Beijing", City: "Beijing"}, rec)
+
+		rec, ok, err = r.LookupRecord(net.ParseIP("8.8.8.8"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, uint(15169), rec.ASN)
+		require.Equal(t, strings.Repeat("Google ", 50), rec.ASOrg)
+
+		_, ok, err = r.LookupRecord(net.ParseIP("9.9.9.9"))
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		rec, ok, err = r.LookupRecord(net.ParseIP("2001:db8::1"))
+		require.NoError(t, err)
+		require.Equal(t, c.v == 6, ok)
+		if ok {
+			require.Equal(t, "US", rec.Country)
+		}
+	}
+}
+
+func TestNewReader_Invalid(t *testing.T) {
+	_, err := NewReader([]byte("not a database"))
+	require.Equal(t, ErrInvalidDatabase, err)
+
+	r := testDatabase(t, 6, 28)
+	// corrupted data section must not panic
+	buf := append([]byte(nil), r.buf...)
+	for i := range r.data {
+		buf[len(r.tree)+dataSectionSeparatorSize+i] = 0xFF
+	}
+	r, err = NewReader(buf)
+	require.NoError(t, err)
+	_, _, err = r.Lookup(net.ParseIP("1.2.3.4"))
+	require.Error(t, err)
+}
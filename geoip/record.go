@@ -0,0 +1,44 @@
+package geoip
+
+import (
+	"net"
+)
+
+// Record fields of GeoIP2 / GeoLite2 City and ASN databases
+type Record struct {
+	Country string // ISO 3166-1 code, i.e. 'CN'
+	Region  string // English name of the first subdivision
+	City    string // English name of the city
+	ASN     uint   // autonomous system number
+	ASOrg   string // autonomous system organization
+}
+
+// LookupRecord find a IP address and extract common fields
+func (r *Reader) LookupRecord(ip net.IP) (rec Record, ok bool, err error) {
+	var m map[string]interface{}
+	if m, ok, err = r.Lookup(ip); err != nil || !ok {
+		return
+	}
+	rec.Country, _ = path(m, "country", "iso_code").(string)
+	if subs, _ := m["subdivisions"].([]interface{}); len(subs) > 0 {
+		if sub, _ := subs[0].(map[string]interface{}); sub != nil {
+			rec.Region, _ = path(sub, "names", "en").(string)
+		}
+	}
+	rec.City, _ = path(m, "city", "names", "en").(string)
+	rec.ASN = uintOf(m["autonomous_system_number"])
+	rec.ASOrg, _ = m["autonomous_system_organization"].(string)
+	return
+}
+
+func path(m map[string]interface{}, keys ...string) interface{} {
+	var v interface{} = m
+	for _, k := range keys {
+		mm, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = mm[k]
+	}
+	return v
+}
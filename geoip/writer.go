@@ -0,0 +1,212 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"sort"
+)
+
+// Writer a minimal MaxMind DB writer for tests, networks must not overlap
+type Writer struct {
+	IPVersion    int // 4 or 6, default 6
+	RecordSize   int // 24, 28 or 32, default 28
+	DatabaseType string
+
+	nodes []*writerNode
+	data  [][]byte
+}
+
+type writerRecord struct {
+	kind int // 0 empty, 1 node, 2 data
+	idx  int
+}
+
+type writerNode struct {
+	rec [2]writerRecord
+}
+
+// Insert add a network with its data, data is a map of string, uint, float64, bool, slice or nested map
+func (w *Writer) Insert(network *net.IPNet, data map[string]interface{}) error {
+	if w.IPVersion == 0 {
+		w.IPVersion = 6
+	}
+	if len(w.nodes) == 0 {
+		w.nodes = []*writerNode{{}}
+	}
+	ip := network.IP
+	ones, _ := network.Mask.Size()
+	if ip4 := ip.To4(); ip4 != nil && len(network.Mask) == net.IPv4len {
+		ip = ip4
+		if w.IPVersion == 6 {
+			ip = append(make(net.IP, 12), ip4...)
+			ones += 96
+		}
+	} else if w.IPVersion == 4 {
+		return errors.New("geoip: IPv6 network in IPv4 database")
+	}
+	if ones == 0 {
+		return errors.New("geoip: empty network")
+	}
+	buf, err := encodeValue(data)
+	if err != nil {
+		return err
+	}
+	w.data = append(w.data, buf)
+	node := 0
+	for i := 0; i < ones; i++ {
+		bit := int(ip[i>>3]>>(7-uint(i&7))) & 1
+		rec := &w.nodes[node].rec[bit]
+		if i == ones-1 {
+			*rec = writerRecord{kind: 2, idx: len(w.data) - 1}
+			break
+		}
+		if rec.kind != 1 {
+			w.nodes = append(w.nodes, &writerNode{})
+			*rec = writerRecord{kind: 1, idx: len(w.nodes) - 1}
+		}
+		node = rec.idx
+	}
+	return nil
+}
+
+// Bytes serialize the database
+func (w *Writer) Bytes() ([]byte, error) {
+	if w.IPVersion == 0 {
+		w.IPVersion = 6
+	}
+	if w.RecordSize == 0 {
+		w.RecordSize = 28
+	}
+	if len(w.nodes) == 0 {
+		w.nodes = []*writerNode{{}}
+	}
+	nodeCount := len(w.nodes)
+	var data []byte
+	offsets := make([]int, len(w.data))
+	for i, d := range w.data {
+		offsets[i] = len(data)
+		data = append(data, d...)
+	}
+	value := func(r writerRecord) uint32 {
+		switch r.kind {
+		case 1:
+			return uint32(r.idx)
+		case 2:
+			return uint32(nodeCount + dataSectionSeparatorSize + offsets[r.idx])
+		default:
+			return uint32(nodeCount)
+		}
+	}
+	var out []byte
+	for _, n := range w.nodes {
+		l, r := value(n.rec[0]), value(n.rec[1])
+		switch w.RecordSize {
+		case 24:
+			out = append(out, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			out = append(out, byte(l>>16), byte(l>>8), byte(l), byte((l>>24)<<4|(r>>24)&0x0F), byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			var b [8]byte
+			binary.BigEndian.PutUint32(b[:], l)
+			binary.BigEndian.PutUint32(b[4:], r)
+			out = append(out, b[:]...)
+		default:
+			return nil, errors.New("geoip: unsupported record size")
+		}
+	}
+	out = append(out, make([]byte, dataSectionSeparatorSize)...)
+	out = append(out, data...)
+	out = append(out, metadataStartMarker...)
+	meta, err := encodeValue(map[string]interface{}{
+		"node_count":                  uint(nodeCount),
+		"record_size":                 uint(w.RecordSize),
+		"ip_version":                  uint(w.IPVersion),
+		"database_type":               w.DatabaseType,
+		"binary_format_major_version": uint(2),
+		"binary_format_minor_version": uint(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(out, meta...), nil
+}
+
+func encodeControl(typ int, size int) []byte {
+	var ctrl []byte
+	var ext []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		ext = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		s := size - 285
+		ext = []byte{byte(s >> 8), byte(s)}
+		size = 30
+	default:
+		s := size - 65821
+		ext = []byte{byte(s >> 16), byte(s >> 8), byte(s)}
+		size = 31
+	}
+	if typ > 7 {
+		ctrl = []byte{byte(size), byte(typ - 7)}
+	} else {
+		ctrl = []byte{byte(typ<<5 | size)}
+	}
+	return append(ctrl, ext...)
+}
+
+func encodeValue(v interface{}) (out []byte, err error) {
+	switch t := v.(type) {
+	case string:
+		out = append(encodeControl(typeString, len(t)), t...)
+	case uint:
+		var b []byte
+		for n := uint64(t); n > 0; n >>= 8 {
+			b = append([]byte{byte(n)}, b...)
+		}
+		out = append(encodeControl(typeUint64, len(b)), b...)
+	case float64:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(t))
+		out = append(encodeControl(typeDouble, 8), b[:]...)
+	case bool:
+		size := 0
+		if t {
+			size = 1
+		}
+		out = encodeControl(typeBoolean, size)
+	case []interface{}:
+		out = encodeControl(typeArray, len(t))
+		for _, item := range t {
+			var b []byte
+			if b, err = encodeValue(item); err != nil {
+				return
+			}
+			out = append(out, b...)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out = encodeControl(typeMap, len(t))
+		for _, k := range keys {
+			var kb, vb []byte
+			if kb, err = encodeValue(k); err != nil {
+				return
+			}
+			if vb, err = encodeValue(t[k]); err != nil {
+				return
+			}
+			out = append(out, kb...)
+			out = append(out, vb...)
+		}
+	default:
+		err = errors.New("geoip: unsupported value type")
+	}
+	return
+}
@@ -6,12 +6,14 @@ import (
 	"expvar"
 	"flag"
 	"fmt"
+	"github.com/logtube/logtubed/beat"
 	"github.com/logtube/logtubed/core"
 	"github.com/logtube/logtubed/types"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"go.guoyk.net/common"
 	"io/ioutil"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -32,6 +34,73 @@ func exit(err *error) {
 	}
 }
 
+// serveHTTP serve a handler on its own listener, apart from the pprof / expvar port which is often exposed
+func serveHTTP(name string, bind string, pattern string, h http.Handler) (err error) {
+	var l net.Listener
+	if l, err = net.Listen("tcp", bind); err != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle(pattern, h)
+	log.Info().Str("bind", bind).Str("path", pattern).Msg(name + " serving")
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Error().Err(err).Msg(name + " stopped serving")
+		}
+	}()
+	return
+}
+
+// newDispatcherOptions dispatcher options from config, shared by daemon and replay, outputs are left to caller
+func newDispatcherOptions(opts types.Options) (dOpts core.DispatcherOptions, err error) {
+	var enricher core.Enricher
+	if len(opts.Enrich.Topics) > 0 {
+		topics := map[string]core.EnrichTopic{}
+		for topic, t := range opts.Enrich.Topics {
+			topics[topic] = core.EnrichTopic{GeoIP: t.GeoIP, UserAgent: t.UserAgent, IPFields: t.IPFields, UAField: t.UAField}
+		}
+		if enricher, err = core.NewEnricher(core.EnricherOptions{
+			GeoIPFile: opts.Enrich.GeoIPFile,
+			ASNFile:   opts.Enrich.ASNFile,
+			CacheSize: opts.Enrich.CacheSize,
+			Topics:    topics,
+		}); err != nil {
+			return
+		}
+	}
+
+	digest := core.DigestOptions{
+		Routes:       opts.Digest.Routes,
+		MaxDigests:   opts.Digest.MaxDigests,
+		VarOverflows: expvar.NewMap("dispatcher-digest-overflows"),
+	}
+	for _, r := range opts.Digest.Rules {
+		digest.Rules = append(digest.Rules, core.DigestRule{Pattern: r.Pattern, Placeholder: r.Placeholder})
+	}
+
+	schemas := map[string]map[string]core.FieldSchema{}
+	for topic, fields := range opts.Schemas {
+		schemas[topic] = map[string]core.FieldSchema{}
+		for field, fs := range fields {
+			schemas[topic][field] = core.FieldSchema{Type: fs.Type, Required: fs.Required, MaxLength: fs.MaxLength}
+		}
+	}
+	dOpts = core.DispatcherOptions{
+		TopicIgnores:         opts.Topics.Ignored,
+		TopicRequireKeywords: opts.Topics.KeywordRequired,
+		KeywordIgnores:       opts.Keywords.Ingnored,
+		Priors:               opts.Topics.Priors,
+		Hostname:             opts.Hostname,
+		EnvMappings:          opts.Mappings.Env,
+		TopicMappings:        opts.Mappings.Topic,
+		Schemas:              schemas,
+		Digest:               digest,
+		VarSchemaViolations:  expvar.NewMap("dispatcher-schema-violations"),
+		Enricher:             enricher,
+	}
+	return
+}
+
 func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU() * 5)
 }
@@ -64,10 +133,15 @@ func main() {
 		queuePri    core.Queue
 		outputLocal core.LocalOutput
 
+		outputArchive core.ArchiveOutput
+
 		dispatcher types.EventConsumer
+		traceIndex core.TraceIndex
+		tail       core.Tail
 
 		inputRedis core.RedisInput
 		inputSPTP  core.SPTPInput
+		inputOTLP  core.OTLPInput
 
 		brOpts core.BlockRoutineOptions
 		br     core.BlockRoutine
@@ -78,6 +152,18 @@ func main() {
 	// init zerolog
 	setupZerolog(false)
 
+	// subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			err = runReplay(os.Args[2:])
+			return
+		case "queue":
+			err = runQueue(os.Args[2:])
+			return
+		}
+	}
+
 	// decode command line arguments
 	flag.StringVar(&optCfgFile, "c", "/etc/logtubed.yml", "config file")
 	flag.BoolVar(&optVerbose, "verbose", false, "enable verbose mode")
@@ -134,13 +220,16 @@ func main() {
 		}
 
 		if queueStd, err = core.NewQueue(core.QueueOptions{
-			Dir:       opts.Queue.Dir,
-			Name:      opts.Queue.Name,
-			SyncEvery: opts.Queue.SyncEvery,
-			Next:      outputEsStd,
-			VarInput:  expvar.NewInt("queue-std-input"),
-			VarOutput: expvar.NewInt("queue-std-output"),
-			VarDepth:  expvar.NewInt("queue-std-depth"),
+			Dir:         opts.Queue.Dir,
+			Name:        opts.Queue.Name,
+			SyncEvery:   opts.Queue.SyncEvery,
+			Compress:    opts.Queue.Compress,
+			BatchSize:   opts.OutputES.BatchSize,
+			AtLeastOnce: opts.Queue.AtLeastOnce,
+			Next:        outputEsStd,
+			VarInput:    expvar.NewInt("queue-std-input"),
+			VarOutput:   expvar.NewInt("queue-std-output"),
+			VarDepth:    expvar.NewInt("queue-std-depth"),
 		}); err != nil {
 			return
 		}
@@ -159,13 +248,16 @@ func main() {
 			}
 
 			if queuePri, err = core.NewQueue(core.QueueOptions{
-				Dir:       opts.Queue.Dir,
-				Name:      opts.Queue.Name + "-pri",
-				SyncEvery: opts.Queue.SyncEvery,
-				Next:      outputEsPri,
-				VarInput:  expvar.NewInt("queue-pri-input"),
-				VarOutput: expvar.NewInt("queue-pri-output"),
-				VarDepth:  expvar.NewInt("queue-pri-depth"),
+				Dir:         opts.Queue.Dir,
+				Name:        opts.Queue.Name + "-pri",
+				SyncEvery:   opts.Queue.SyncEvery,
+				Compress:    opts.Queue.Compress,
+				BatchSize:   opts.OutputES.BatchSize,
+				AtLeastOnce: opts.Queue.AtLeastOnce,
+				Next:        outputEsPri,
+				VarInput:    expvar.NewInt("queue-pri-input"),
+				VarOutput:   expvar.NewInt("queue-pri-output"),
+				VarDepth:    expvar.NewInt("queue-pri-depth"),
 			}); err != nil {
 				return
 			}
@@ -177,8 +269,37 @@ func main() {
 
 	// initialize local output
 	if opts.OutputLocal.Enabled {
+		var maxFileSize, maxProjectSize common.Capacity
+		if opts.OutputLocal.MaxFileSize != "" {
+			if maxFileSize, err = common.ParseCapacity(opts.OutputLocal.MaxFileSize); err != nil {
+				return
+			}
+		}
+		if opts.OutputLocal.MaxProjectSize != "" {
+			if maxProjectSize, err = common.ParseCapacity(opts.OutputLocal.MaxProjectSize); err != nil {
+				return
+			}
+		}
 		if outputLocal, err = core.NewLocalOutput(core.LocalOutputOptions{
-			Dir: opts.OutputLocal.Dir,
+			Dir:            opts.OutputLocal.Dir,
+			Format:         opts.OutputLocal.Format,
+			Template:       opts.OutputLocal.Template,
+			MaxFileSize:    int64(maxFileSize),
+			RotateInterval: time.Duration(opts.OutputLocal.RotateInterval) * time.Second,
+			MaxOpenFiles:   opts.OutputLocal.MaxOpenFiles,
+			Compress:       opts.OutputLocal.Compress,
+			MaxAge:         opts.OutputLocal.MaxAge,
+			MaxProjectSize: int64(maxProjectSize),
+			Shards:         opts.OutputLocal.Shards,
+			QueueSize:      opts.OutputLocal.QueueSize,
+			QueuePolicy:    opts.OutputLocal.QueuePolicy,
+			BufferSize:     opts.OutputLocal.BufferSize,
+			FlushInterval:  time.Duration(opts.OutputLocal.FlushInterval) * time.Second,
+			Fsync:          opts.OutputLocal.Fsync,
+			VarInput:       expvar.NewInt("output-local-input"),
+			VarOutput:      expvar.NewInt("output-local-output"),
+			VarDropped:     expvar.NewInt("output-local-dropped"),
+			VarDepth:       expvar.NewInt("output-local-depth"),
 		}); err != nil {
 			return
 		}
@@ -187,31 +308,145 @@ func main() {
 		brOpts.Watermarks = append(brOpts.Watermarks, opts.OutputLocal.Watermark)
 	}
 
+	// initialize archive output
+	if opts.OutputArchive.Enabled {
+		var maxSize common.Capacity
+		if maxSize, err = common.ParseCapacity(opts.OutputArchive.MaxSize); err != nil {
+			return
+		}
+		if outputArchive, err = core.NewArchiveOutput(core.ArchiveOutputOptions{
+			Dir:       opts.OutputArchive.Dir,
+			Hostname:  opts.Hostname,
+			Prefix:    opts.OutputArchive.Prefix,
+			Endpoint:  opts.OutputArchive.Endpoint,
+			Region:    opts.OutputArchive.Region,
+			Bucket:    opts.OutputArchive.Bucket,
+			AccessKey: opts.OutputArchive.AccessKey,
+			SecretKey: opts.OutputArchive.SecretKey,
+			PathStyle: opts.OutputArchive.PathStyle,
+			MaxSize:   int64(maxSize),
+			SealDelay: time.Duration(opts.OutputArchive.SealDelay) * time.Second,
+		}); err != nil {
+			return
+		}
+
+		brOpts.Dirs = append(brOpts.Dirs, opts.OutputArchive.Dir)
+		brOpts.Watermarks = append(brOpts.Watermarks, opts.OutputArchive.Watermark)
+	}
+
+	// initialize trace index, summaries are emitted back to dispatcher
+	if opts.Trace.Enabled {
+		if traceIndex, err = core.NewTraceIndex(core.TraceIndexOptions{
+			MaxTraces:  opts.Trace.MaxTraces,
+			MaxEntries: opts.Trace.MaxEntries,
+			Window:     time.Duration(opts.Trace.Window) * time.Second,
+			Emit:       opts.Trace.Emit,
+			Topic:      opts.Trace.Topic,
+			Next: types.EventConsumerFunc(func(e types.Event) error {
+				return dispatcher.ConsumeEvent(e)
+			}),
+		}); err != nil {
+			return
+		}
+
+		if err = serveHTTP("trace index", opts.Trace.Bind, core.TraceIndexPath, traceIndex); err != nil {
+			return
+		}
+	}
+
+	// initialize tail
+	if opts.Tail.Enabled {
+		if tail, err = core.NewTail(core.TailOptions{
+			BufferSize:     opts.Tail.BufferSize,
+			MaxSubscribers: opts.Tail.MaxSubscribers,
+		}); err != nil {
+			return
+		}
+
+		if err = serveHTTP("tail", opts.Tail.Bind, core.TailPath, tail); err != nil {
+			return
+		}
+	}
+
 	// initialize dispatcher
-	dOpts := core.DispatcherOptions{
-		TopicIgnores:         opts.Topics.Ignored,
-		TopicRequireKeywords: opts.Topics.KeywordRequired,
-		KeywordIgnores:       opts.Keywords.Ingnored,
-		Priors:               opts.Topics.Priors,
-		Hostname:             opts.Hostname,
-		Next:                 outputLocal,
-		NextStd:              queueStd,
-		NextPri:              queuePri,
-		EnvMappings:          opts.Mappings.Env,
-		TopicMappings:        opts.Mappings.Topic,
+	var dOpts core.DispatcherOptions
+	if dOpts, err = newDispatcherOptions(opts); err != nil {
+		return
+	}
+	dOpts.Next = outputLocal
+	dOpts.NextStd = queueStd
+	dOpts.NextPri = queuePri
+
+	if traceIndex != nil {
+		dOpts.Observers = append(dOpts.Observers, traceIndex)
+	}
+
+	if tail != nil {
+		dOpts.Observers = append(dOpts.Observers, tail)
+	}
+
+	if outputArchive != nil {
+		dOpts.Observers = append(dOpts.Observers, outputArchive)
 	}
 
 	if dispatcher, err = core.NewDispatcher(dOpts); err != nil {
 		return
 	}
 
+	// initialize capture of unparsable raw payloads
+	var capture core.RawCapture
+	if len(opts.InputCapture.File) > 0 {
+		if capture, err = core.NewRawCapture(core.RawCaptureOptions{
+			File:    opts.InputCapture.File,
+			Sample:  opts.InputCapture.Sample,
+			MaxSize: opts.InputCapture.MaxSize,
+		}); err != nil {
+			return
+		}
+		defer capture.Close()
+	}
+
 	// initialize Redis input
 	if opts.InputRedis.Enabled {
+		var nginxTags []beat.NginxTag
+		for _, t := range opts.InputRedis.Pipeline.Nginx.Tags {
+			nginxTags = append(nginxTags, beat.NginxTag{Tag: t.Tag, Name: t.Name, Type: t.Type, Multi: t.Multi})
+		}
+		var tokens []core.RedisToken
+		for _, t := range opts.InputRedis.Tokens {
+			tokens = append(tokens, core.RedisToken{Token: t.Token, Envs: t.Envs, Projects: t.Projects})
+		}
+		var routes []core.RedisKeyRoute
+		for _, r := range opts.InputRedis.Routes {
+			routes = append(routes, core.RedisKeyRoute{Pattern: r.Key, Decoder: r.Decoder, Env: r.Env, Project: r.Project, Topic: r.Topic})
+		}
+
 		if inputRedis, err = core.NewRedisInput(core.RedisInputOptions{
 			Bind:                   opts.InputRedis.Bind,
 			Multi:                  opts.InputRedis.Multi,
+			Password:               opts.InputRedis.Password,
+			Tokens:                 tokens,
+			Routes:                 routes,
+			MaxRawSize:             opts.InputRedis.Limit.MaxRawSize,
+			MaxMessageSize:         opts.InputRedis.Limit.MaxMessageSize,
+			Truncate:               opts.InputRedis.Limit.Truncate,
+			VarDropped:             expvar.NewMap("input-redis-oversize-dropped"),
+			VarTruncated:           expvar.NewMap("input-redis-oversize-truncated"),
+			VarStats:               expvar.NewMap("input-redis-stats"),
+			Strict:                 opts.InputRedis.Strict,
+			Capture:                capture,
+			TLSBind:                opts.InputRedis.TLS.Bind,
+			TLSCert:                opts.InputRedis.TLS.Cert,
+			TLSKey:                 opts.InputRedis.TLS.Key,
+			TLSClientCA:            opts.InputRedis.TLS.ClientCA,
 			LogtubeTimeOffset:      opts.InputRedis.Pipeline.Logtube.TimeOffset,
 			MySQLErrorIgnoreLevels: opts.InputRedis.Pipeline.MySQL.ErrorIgnoreLevels,
+			NginxFormat:            opts.InputRedis.Pipeline.Nginx.Format,
+			NginxTags:              nginxTags,
+			KubernetesEnvRules:     opts.InputRedis.Pipeline.Kubernetes.Env,
+			KubernetesProjectRules: opts.InputRedis.Pipeline.Kubernetes.Project,
+			KubernetesTopicRules:   opts.InputRedis.Pipeline.Kubernetes.Topic,
+			KubernetesDefaultTopic: opts.InputRedis.Pipeline.Kubernetes.DefaultTopic,
 			Next:                   dispatcher,
 		}); err != nil {
 			return
@@ -223,11 +458,30 @@ func main() {
 	// initialize SPTP input
 	if opts.InputSPTP.Enabled {
 		if inputSPTP, err = core.NewSPTPInput(core.SPTPInputOptions{
-			Bind: opts.InputSPTP.Bind,
+			Bind:           opts.InputSPTP.Bind,
+			ReadBuffer:     opts.InputSPTP.ReadBuffer,
+			Workers:        opts.InputSPTP.Workers,
+			QueueSize:      opts.InputSPTP.QueueSize,
+			VarStats:       expvar.NewMap("input-sptp-stats"),
+			VarSenders:     expvar.NewMap("input-sptp-senders"),
+			VarKernelDrops: expvar.NewInt("input-sptp-kernel-drops"),
+			Capture:        capture,
+			Next:           dispatcher,
+		}); err != nil {
+			return
+		}
+	}
+
+	// initialize OTLP input
+	if opts.InputOTLP.Enabled {
+		if inputOTLP, err = core.NewOTLPInput(core.OTLPInputOptions{
+			Bind: opts.InputOTLP.Bind,
 			Next: dispatcher,
 		}); err != nil {
 			return
 		}
+
+		brOpts.Blockables = append(brOpts.Blockables, inputOTLP)
 	}
 
 	// block routine
@@ -250,15 +504,22 @@ func main() {
 
 	// ignite L2
 	log.Info().Msg("L2 ignite")
-	common.RunAsync(ctxL2, cancelL2, doneL2, queuePri, queueStd, outputLocal)
+	common.RunAsync(ctxL2, cancelL2, doneL2, queuePri, queueStd, outputLocal, outputArchive)
 	time.Sleep(time.Millisecond * 100)
 
+	// ops not yet delivered to ES
+	drainables := []core.Drainable{queueStd, queuePri, outputEsStd, outputEsPri}
+
 	// ignite L1
-	if inputSPTP == nil && inputRedis == nil {
+	var chDrained chan struct{}
+	if inputSPTP == nil && inputRedis == nil && inputOTLP == nil {
 		log.Info().Msg("no inputs, running in drain mode")
+		if outputEsStd != nil {
+			chDrained = core.NotifyDrained(drainables...)
+		}
 	}
 	log.Info().Msg("L1 ignite")
-	common.RunAsync(ctxL1, cancelL1, doneL1, inputSPTP, inputRedis, br)
+	common.RunAsync(ctxL1, cancelL1, doneL1, inputSPTP, inputRedis, inputOTLP, traceIndex, br)
 	time.Sleep(time.Millisecond * 100)
 
 	// ignite pprof / expvar
@@ -276,6 +537,8 @@ func main() {
 		log.Error().Err(err).Msg("error occurred")
 	case sig := <-chsig:
 		log.Info().Str("signal", sig.String()).Msg("signal caught")
+	case <-chDrained:
+		log.Info().Msg("queues drained")
 	}
 
 	// notify systemd
@@ -289,6 +552,16 @@ func main() {
 		log.Info().Msg("L1 cut off")
 	}
 
+	// drain queues into ES before cutting off L2
+	if opts.ShutdownDrain && outputEsStd != nil {
+		log.Info().Int64("pending", core.PendingOf(drainables...)).Int("timeout", opts.ShutdownTimeout).Msg("draining queues")
+		if n := core.WaitDrained(time.Duration(opts.ShutdownTimeout)*time.Second, drainables...); n > 0 {
+			log.Warn().Int64("pending", n).Msg("drain timeout, ops remaining on disk")
+		} else {
+			log.Info().Msg("queues drained")
+		}
+	}
+
 	// cancel L2
 	cancelL2()
 	if err = <-doneL2; err != nil {
@@ -0,0 +1,144 @@
+package otlp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/logtube/logtubed/types"
+	"strings"
+	"time"
+)
+
+const (
+	AttrServiceName           = "service.name"
+	AttrDeploymentEnvironment = "deployment.environment"
+	AttrHostName              = "host.name"
+
+	// optional log attributes to override logtube fields
+	AttrLogtubeTopic   = "logtube.topic"
+	AttrLogtubeKeyword = "logtube.keyword"
+	AttrLogtubeCrsrc   = "logtube.crsrc"
+)
+
+// ToEvents convert all log records into Logtube events
+func (r LogsRequest) ToEvents() (es []types.Event) {
+	for _, rl := range r.ResourceLogs {
+		res := KeyValuesToMap(rl.Resource.Attributes)
+		var base types.Event
+		base.Project = stringAttr(res, AttrServiceName)
+		base.Env = stringAttr(res, AttrDeploymentEnvironment, AttrDeploymentEnvironment+".name")
+		base.Hostname = stringAttr(res, AttrHostName)
+		for _, sl := range append(rl.ScopeLogs, rl.InstrumentationLibraryLogs...) {
+			for _, lr := range sl.LogRecords {
+				es = append(es, lr.toEvent(base))
+			}
+		}
+	}
+	return
+}
+
+func (lr LogRecord) toEvent(e types.Event) types.Event {
+	// timestamp
+	if lr.TimeUnixNano != 0 {
+		e.Timestamp = time.Unix(0, int64(lr.TimeUnixNano))
+	} else if lr.ObservedTimeUnixNano != 0 {
+		e.Timestamp = time.Unix(0, int64(lr.ObservedTimeUnixNano))
+	} else {
+		e.Timestamp = time.Now()
+	}
+	// correlation
+	e.Crid = hexID(lr.TraceID)
+	e.Crsrc = hexID(lr.SpanID)
+	// attributes
+	attrs := KeyValuesToMap(lr.Attributes)
+	if v := stringAttr(attrs, AttrLogtubeCrsrc); v != "" {
+		e.Crsrc = v
+	}
+	e.Topic = stringAttr(attrs, AttrLogtubeTopic)
+	if e.Topic == "" {
+		e.Topic = severityTopic(lr.SeverityNumber, lr.SeverityText)
+	}
+	e.Keyword = stringAttr(attrs, AttrLogtubeKeyword)
+	delete(attrs, AttrLogtubeTopic)
+	delete(attrs, AttrLogtubeKeyword)
+	delete(attrs, AttrLogtubeCrsrc)
+	e.Extra = map[string]interface{}{}
+	for k, v := range attrs {
+		e.Extra[extraKey(k)] = v
+	}
+	if lr.SeverityText != "" {
+		e.Extra["severity"] = lr.SeverityText
+	}
+	// body
+	switch body := lr.Body.Value.(type) {
+	case nil:
+	case string:
+		e.Message = body
+	case map[string]interface{}:
+		for k, v := range body {
+			e.Extra[extraKey(k)] = v
+		}
+	default:
+		e.Message = fmt.Sprint(body)
+	}
+	if len(e.Extra) == 0 {
+		e.Extra = nil
+	}
+	return e
+}
+
+// severityTopic map SeverityNumber ranges to Logtube topics, SeverityText is used if number is not set
+func severityTopic(num int, text string) string {
+	if num == 0 {
+		text = strings.ToUpper(strings.TrimSpace(text))
+		switch {
+		case strings.HasPrefix(text, "TRACE"):
+			num = 1
+		case strings.HasPrefix(text, "DEBUG"):
+			num = 5
+		case strings.HasPrefix(text, "WARN"):
+			num = 13
+		case strings.HasPrefix(text, "ERR"), strings.HasPrefix(text, "FATAL"):
+			num = 17
+		default:
+			num = 9
+		}
+	}
+	switch {
+	case num <= 4:
+		return "trace"
+	case num <= 8:
+		return "debug"
+	case num <= 12:
+		return "info"
+	case num <= 16:
+		return "warn"
+	default:
+		return "err"
+	}
+}
+
+func stringAttr(m map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		if v, ok := m[key].(string); ok {
+			if v = strings.TrimSpace(v); v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// extraKey dots in semantic convention keys would become nested objects in ElasticSearch
+func extraKey(k string) string {
+	return strings.ReplaceAll(k, ".", "_")
+}
+
+// hexID empty for invalid all-zero ids
+func hexID(id []byte) string {
+	for _, b := range id {
+		if b != 0 {
+			return hex.EncodeToString(id)
+		}
+	}
+	return ""
+}
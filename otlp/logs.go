@@ -0,0 +1,153 @@
+package otlp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+/*
+
+OpenTelemetry Logs, OTLP/HTTP, JSON and protobuf encoding of ExportLogsServiceRequest
+
+https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/logs/v1/logs.proto
+
+*/
+
+var (
+	ErrInvalidAnyValue = errors.New("otlp: invalid AnyValue")
+)
+
+// LogsRequest ExportLogsServiceRequest
+type LogsRequest struct {
+	ResourceLogs []ResourceLogs `json:"resourceLogs"`
+}
+
+type ResourceLogs struct {
+	Resource  Resource    `json:"resource"`
+	ScopeLogs []ScopeLogs `json:"scopeLogs"`
+	// deprecated name of ScopeLogs, still emitted by older SDKs
+	InstrumentationLibraryLogs []ScopeLogs `json:"instrumentationLibraryLogs"`
+}
+
+type Resource struct {
+	Attributes []KeyValue `json:"attributes"`
+}
+
+type ScopeLogs struct {
+	LogRecords []LogRecord `json:"logRecords"`
+}
+
+type LogRecord struct {
+	TimeUnixNano         Uint64     `json:"timeUnixNano"`
+	ObservedTimeUnixNano Uint64     `json:"observedTimeUnixNano"`
+	SeverityNumber       int        `json:"severityNumber"`
+	SeverityText         string     `json:"severityText"`
+	Body                 AnyValue   `json:"body"`
+	Attributes           []KeyValue `json:"attributes"`
+	TraceID              HexBytes   `json:"traceId"`
+	SpanID               HexBytes   `json:"spanId"`
+}
+
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+// AnyValue holds one of string, bool, int64, float64, []byte, []interface{} and map[string]interface{}
+type AnyValue struct {
+	Value interface{}
+}
+
+type anyValueJSON struct {
+	StringValue *string      `json:"stringValue"`
+	BoolValue   *bool        `json:"boolValue"`
+	IntValue    *json.Number `json:"intValue"`
+	DoubleValue *json.Number `json:"doubleValue"`
+	BytesValue  *string      `json:"bytesValue"`
+	ArrayValue  *struct {
+		Values []AnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []KeyValue `json:"values"`
+	} `json:"kvlistValue"`
+}
+
+func (a *AnyValue) UnmarshalJSON(buf []byte) (err error) {
+	var j anyValueJSON
+	if err = json.Unmarshal(buf, &j); err != nil {
+		return
+	}
+	switch {
+	case j.StringValue != nil:
+		a.Value = *j.StringValue
+	case j.BoolValue != nil:
+		a.Value = *j.BoolValue
+	case j.IntValue != nil:
+		if a.Value, err = j.IntValue.Int64(); err != nil {
+			return ErrInvalidAnyValue
+		}
+	case j.DoubleValue != nil:
+		if a.Value, err = j.DoubleValue.Float64(); err != nil {
+			return ErrInvalidAnyValue
+		}
+	case j.BytesValue != nil:
+		if a.Value, err = base64.StdEncoding.DecodeString(*j.BytesValue); err != nil {
+			return ErrInvalidAnyValue
+		}
+	case j.ArrayValue != nil:
+		vals := make([]interface{}, 0, len(j.ArrayValue.Values))
+		for _, v := range j.ArrayValue.Values {
+			vals = append(vals, v.Value)
+		}
+		a.Value = vals
+	case j.KvlistValue != nil:
+		a.Value = KeyValuesToMap(j.KvlistValue.Values)
+	}
+	return
+}
+
+// Uint64 accepts both JSON string and number, OTLP JSON encodes 64 bit integers as strings
+type Uint64 uint64
+
+func (u *Uint64) UnmarshalJSON(buf []byte) (err error) {
+	var n json.Number
+	if err = json.Unmarshal(buf, &n); err != nil {
+		return
+	}
+	var v uint64
+	if v, err = strconv.ParseUint(string(n), 10, 64); err != nil {
+		return
+	}
+	*u = Uint64(v)
+	return
+}
+
+// HexBytes trace id and span id, OTLP JSON encodes them as hex strings
+type HexBytes []byte
+
+func (h *HexBytes) UnmarshalJSON(buf []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(buf, &s); err != nil {
+		return
+	}
+	*h, err = hex.DecodeString(s)
+	return
+}
+
+// KeyValuesToMap convert repeated KeyValue to a map, later keys overwrite former ones
+func KeyValuesToMap(kvs []KeyValue) map[string]interface{} {
+	m := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value.Value
+	}
+	return m
+}
+
+// UnmarshalLogsRequestJSON decode OTLP/HTTP JSON payload
+func UnmarshalLogsRequestJSON(buf []byte) (r LogsRequest, err error) {
+	err = json.Unmarshal(buf, &r)
+	return
+}
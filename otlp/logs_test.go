@@ -0,0 +1,125 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+	"time"
+)
+
+const testLogsJSON = `{
+  "resourceLogs": [{
+    "resource": {"attributes": [
+      {"key": "service.name", "value": {"stringValue": "ms-order"}},
+      {"key": "deployment.environment", "value": {"stringValue": "prod"}},
+      {"key": "host.name", "value": {"stringValue": "node-1"}}
+    ]},
+    "scopeLogs": [{
+      "scope": {"name": "io.opentelemetry.logback"},
+      "logRecords": [{
+        "timeUnixNano": "1597403361727000000",
+        "severityNumber": 17,
+        "severityText": "ERROR",
+        "traceId": "5b8efff798038103d269b633813fc60c",
+        "spanId": "eee19b7ec3c1b174",
+        "body": {"stringValue": "order failed"},
+        "attributes": [
+          {"key": "http.status_code", "value": {"intValue": "500"}},
+          {"key": "retry", "value": {"boolValue": true}},
+          {"key": "logtube.keyword", "value": {"stringValue": "order"}}
+        ]
+      }]
+    }]
+  }]
+}`
+
+func TestUnmarshalLogsRequestJSON(t *testing.T) {
+	r, err := UnmarshalLogsRequestJSON([]byte(testLogsJSON))
+	require.NoError(t, err)
+	es := r.ToEvents()
+	require.Len(t, es, 1)
+	e := es[0]
+	require.Equal(t, "ms-order", e.Project)
+	require.Equal(t, "prod", e.Env)
+	require.Equal(t, "node-1", e.Hostname)
+	require.Equal(t, "err", e.Topic)
+	require.Equal(t, "5b8efff798038103d269b633813fc60c", e.Crid)
+	require.Equal(t, "eee19b7ec3c1b174", e.Crsrc)
+	require.Equal(t, "order", e.Keyword)
+	require.Equal(t, "order failed", e.Message)
+	require.True(t, e.Timestamp.Equal(time.Unix(1597403361, 727000000)))
+	require.Equal(t, int64(500), e.Extra["http_status_code"])
+	require.Equal(t, true, e.Extra["retry"])
+	require.Equal(t, "ERROR", e.Extra["severity"])
+}
+
+type testProto []byte
+
+func (p testProto) uvarint(v uint64) testProto {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(p, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func (p testProto) key(num, typ int) testProto {
+	return p.uvarint(uint64(num<<3 | typ))
+}
+
+func (p testProto) bytes(num int, b []byte) testProto {
+	return append(p.key(num, wireBytes).uvarint(uint64(len(b))), b...)
+}
+
+func (p testProto) str(num int, s string) testProto {
+	return p.bytes(num, []byte(s))
+}
+
+func (p testProto) varint(num int, v uint64) testProto {
+	return p.key(num, wireVarint).uvarint(v)
+}
+
+func (p testProto) fixed64(num int, v uint64) testProto {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	return append(p.key(num, wireFixed64), buf...)
+}
+
+func testProtoKeyValue(k string, v testProto) testProto {
+	return testProto{}.str(1, k).bytes(2, v)
+}
+
+func TestUnmarshalLogsRequestProto(t *testing.T) {
+	record := testProto{}.
+		fixed64(1, 1597403361727000000).
+		varint(2, 9).
+		str(3, "INFO").
+		bytes(5, testProto{}.str(1, "hello")).
+		bytes(6, testProtoKeyValue("duration", testProto{}.varint(3, 121))).
+		bytes(6, testProtoKeyValue("ratio", testProto{}.fixed64(4, math.Float64bits(0.5)))).
+		bytes(6, testProtoKeyValue("logtube.topic", testProto{}.str(1, "x-order"))).
+		bytes(9, []byte{0x5b, 0x8e, 0xff, 0xf7}).
+		bytes(10, []byte{0xee, 0xe1})
+	resource := testProto{}.
+		bytes(1, testProtoKeyValue("service.name", testProto{}.str(1, "ms-order"))).
+		bytes(1, testProtoKeyValue("deployment.environment", testProto{}.str(1, "test")))
+	req := testProto{}.bytes(1, testProto{}.
+		bytes(1, resource).
+		bytes(2, testProto{}.bytes(1, testProto{}.str(1, "scope")).bytes(2, record)))
+
+	r, err := UnmarshalLogsRequestProto(req)
+	require.NoError(t, err)
+	es := r.ToEvents()
+	require.Len(t, es, 1)
+	e := es[0]
+	require.Equal(t, "ms-order", e.Project)
+	require.Equal(t, "test", e.Env)
+	require.Equal(t, "x-order", e.Topic)
+	require.Equal(t, "5b8efff7", e.Crid)
+	require.Equal(t, "eee1", e.Crsrc)
+	require.Equal(t, "hello", e.Message)
+	require.Equal(t, int64(121), e.Extra["duration"])
+	require.Equal(t, 0.5, e.Extra["ratio"])
+	require.True(t, e.Timestamp.Equal(time.Unix(1597403361, 727000000)))
+
+	_, err = UnmarshalLogsRequestProto(req[:len(req)-3])
+	require.Error(t, err)
+}
@@ -0,0 +1,218 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// minimal protobuf wire format decoder, only fields used by logtubed are decoded, others are skipped
+
+var (
+	ErrInvalidProto = errors.New("otlp: invalid protobuf payload")
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type protoField struct {
+	num  int
+	typ  int
+	u    uint64 // varint, fixed64, fixed32
+	data []byte // length delimited
+}
+
+// walkProto iterates all fields in a message
+func walkProto(buf []byte, fn func(f protoField) error) error {
+	for len(buf) > 0 {
+		var f protoField
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return ErrInvalidProto
+		}
+		buf = buf[n:]
+		f.num, f.typ = int(key>>3), int(key&0x7)
+		switch f.typ {
+		case wireVarint:
+			if f.u, n = binary.Uvarint(buf); n <= 0 {
+				return ErrInvalidProto
+			}
+			buf = buf[n:]
+		case wireFixed64:
+			if len(buf) < 8 {
+				return ErrInvalidProto
+			}
+			f.u = binary.LittleEndian.Uint64(buf)
+			buf = buf[8:]
+		case wireFixed32:
+			if len(buf) < 4 {
+				return ErrInvalidProto
+			}
+			f.u = uint64(binary.LittleEndian.Uint32(buf))
+			buf = buf[4:]
+		case wireBytes:
+			var l uint64
+			if l, n = binary.Uvarint(buf); n <= 0 || uint64(len(buf)-n) < l {
+				return ErrInvalidProto
+			}
+			f.data = buf[n : n+int(l)]
+			buf = buf[n+int(l):]
+		default:
+			return ErrInvalidProto
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnmarshalLogsRequestProto decode OTLP/HTTP protobuf payload
+func UnmarshalLogsRequestProto(buf []byte) (r LogsRequest, err error) {
+	err = walkProto(buf, func(f protoField) (err error) {
+		if f.num == 1 && f.typ == wireBytes {
+			var rl ResourceLogs
+			if rl, err = unmarshalResourceLogsProto(f.data); err != nil {
+				return
+			}
+			r.ResourceLogs = append(r.ResourceLogs, rl)
+		}
+		return
+	})
+	return
+}
+
+func unmarshalResourceLogsProto(buf []byte) (r ResourceLogs, err error) {
+	err = walkProto(buf, func(f protoField) (err error) {
+		if f.typ != wireBytes {
+			return
+		}
+		switch f.num {
+		case 1:
+			err = walkProto(f.data, func(f protoField) (err error) {
+				if f.num == 1 && f.typ == wireBytes {
+					var kv KeyValue
+					if kv, err = unmarshalKeyValueProto(f.data); err != nil {
+						return
+					}
+					r.Resource.Attributes = append(r.Resource.Attributes, kv)
+				}
+				return
+			})
+		case 2, 1000:
+			// 1000 is the deprecated instrumentation_library_logs
+			var sl ScopeLogs
+			if sl, err = unmarshalScopeLogsProto(f.data); err != nil {
+				return
+			}
+			r.ScopeLogs = append(r.ScopeLogs, sl)
+		}
+		return
+	})
+	return
+}
+
+func unmarshalScopeLogsProto(buf []byte) (s ScopeLogs, err error) {
+	err = walkProto(buf, func(f protoField) (err error) {
+		if f.num == 2 && f.typ == wireBytes {
+			var lr LogRecord
+			if lr, err = unmarshalLogRecordProto(f.data); err != nil {
+				return
+			}
+			s.LogRecords = append(s.LogRecords, lr)
+		}
+		return
+	})
+	return
+}
+
+func unmarshalLogRecordProto(buf []byte) (r LogRecord, err error) {
+	err = walkProto(buf, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			r.TimeUnixNano = Uint64(f.u)
+		case 11:
+			r.ObservedTimeUnixNano = Uint64(f.u)
+		case 2:
+			r.SeverityNumber = int(f.u)
+		case 3:
+			r.SeverityText = string(f.data)
+		case 5:
+			r.Body, err = unmarshalAnyValueProto(f.data)
+		case 6:
+			var kv KeyValue
+			if kv, err = unmarshalKeyValueProto(f.data); err != nil {
+				return
+			}
+			r.Attributes = append(r.Attributes, kv)
+		case 9:
+			r.TraceID = append(HexBytes(nil), f.data...)
+		case 10:
+			r.SpanID = append(HexBytes(nil), f.data...)
+		}
+		return
+	})
+	return
+}
+
+func unmarshalKeyValueProto(buf []byte) (kv KeyValue, err error) {
+	err = walkProto(buf, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			kv.Key = string(f.data)
+		case 2:
+			kv.Value, err = unmarshalAnyValueProto(f.data)
+		}
+		return
+	})
+	return
+}
+
+func unmarshalAnyValueProto(buf []byte) (a AnyValue, err error) {
+	err = walkProto(buf, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			a.Value = string(f.data)
+		case 2:
+			a.Value = f.u != 0
+		case 3:
+			a.Value = int64(f.u)
+		case 4:
+			a.Value = math.Float64frombits(f.u)
+		case 5:
+			vals := []interface{}{}
+			err = walkProto(f.data, func(f protoField) (err error) {
+				if f.num == 1 {
+					var v AnyValue
+					if v, err = unmarshalAnyValueProto(f.data); err != nil {
+						return
+					}
+					vals = append(vals, v.Value)
+				}
+				return
+			})
+			a.Value = vals
+		case 6:
+			var kvs []KeyValue
+			err = walkProto(f.data, func(f protoField) (err error) {
+				if f.num == 1 {
+					var kv KeyValue
+					if kv, err = unmarshalKeyValueProto(f.data); err != nil {
+						return
+					}
+					kvs = append(kvs, kv)
+				}
+				return
+			})
+			a.Value = KeyValuesToMap(kvs)
+		case 7:
+			a.Value = append([]byte(nil), f.data...)
+		}
+		return
+	})
+	return
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/logtube/logtubed/core"
+	"github.com/logtube/logtubed/types"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	queueCmdStats = "stats"
+	queueCmdPeek  = "peek"
+	queueCmdDump  = "dump"
+	queueCmdDrain = "drain"
+	queueCmdPurge = "purge"
+)
+
+// runQueue logtubed queue stats|peek|dump|drain|purge [flags]
+func runQueue(args []string) (err error) {
+	if len(args) == 0 {
+		err = errors.New("queue: missing command, stats, peek, dump, drain or purge")
+		return
+	}
+	cmd := args[0]
+
+	var (
+		optCfgFile string
+		optQueue   string
+		optNum     int
+		optOutput  string
+		optPrefix  string
+	)
+
+	fs := flag.NewFlagSet("queue "+cmd, flag.ExitOnError)
+	fs.StringVar(&optCfgFile, "c", "/etc/logtubed.yml", "config file")
+	fs.StringVar(&optQueue, "queue", "std", "queue to operate, std or pri")
+	switch cmd {
+	case queueCmdStats:
+	case queueCmdPeek:
+		fs.IntVar(&optNum, "n", 10, "number of ops to decode")
+	case queueCmdDump, queueCmdDrain:
+		fs.StringVar(&optOutput, "o", "", "output NDJSON file, default to stdout")
+	case queueCmdPurge:
+		fs.StringVar(&optPrefix, "prefix", "", "purge ops with index starting with this prefix, i.e. debug- or info-test-2020-08")
+	default:
+		err = errors.New("queue: unknown command " + cmd)
+		return
+	}
+	_ = fs.Parse(args[1:])
+
+	var opts types.Options
+	if opts, err = types.LoadOptions(optCfgFile); err != nil {
+		return
+	}
+
+	// queues are accessed directly, the daemon must be stopped
+	dir, name := opts.Queue.Dir, opts.Queue.Name
+	switch optQueue {
+	case "std":
+	case "pri":
+		name = name + "-pri"
+	default:
+		err = errors.New("queue: unknown queue " + optQueue)
+		return
+	}
+
+	switch cmd {
+	case queueCmdStats:
+		var s core.QueueStats
+		if s, err = core.InspectQueue(dir, name); err != nil {
+			return
+		}
+		printQueueStats(os.Stdout, s)
+	case queueCmdPeek:
+		var ops []types.Op
+		if ops, err = core.PeekQueue(dir, name, optNum); err != nil {
+			return
+		}
+		for _, op := range ops {
+			fmt.Printf("%s\t%s\n", op.Index, op.Body)
+		}
+	case queueCmdDump, queueCmdDrain:
+		// hide Sync and Close of stdout from DrainQueue
+		var w io.Writer = struct{ io.Writer }{os.Stdout}
+		if optOutput != "" {
+			var f *os.File
+			if f, err = os.OpenFile(optOutput, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
+				return
+			}
+			// closed and checked below, DrainQueue also syncs it before emptying the queue
+			defer f.Close()
+			w = f
+		}
+		var n int64
+		if cmd == queueCmdDump {
+			if n, err = core.DumpQueue(dir, name, w); err == nil {
+				if c, ok := w.(io.Closer); ok {
+					err = c.Close()
+				}
+			}
+		} else {
+			n, err = core.DrainQueue(dir, name, w)
+		}
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d ops exported\n", cmd, n)
+	case queueCmdPurge:
+		var purged, kept int64
+		if purged, kept, err = core.PurgeQueue(dir, name, optPrefix); err != nil {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "purge: %d ops purged, %d ops kept\n", purged, kept)
+	}
+	return
+}
+
+func printQueueStats(w io.Writer, s core.QueueStats) {
+	fmt.Fprintf(w, "queue:   %s\n", s.Name)
+	fmt.Fprintf(w, "depth:   %d\n", s.Depth)
+	fmt.Fprintf(w, "records: %d (%d invalid)\n", s.Records, s.Invalid)
+	fmt.Fprintf(w, "unacked: %d\n", s.Unacked)
+	fmt.Fprintf(w, "size:    %d\n", s.TotalSize)
+	for _, f := range s.Files {
+		fmt.Fprintf(w, "  %s\t%d\n", f.Name, f.Size)
+	}
+	if !s.Oldest.IsZero() {
+		fmt.Fprintf(w, "oldest:  %s\n", s.Oldest.Local().Format(time.RFC3339))
+		fmt.Fprintf(w, "newest:  %s\n", s.Newest.Local().Format(time.RFC3339))
+	}
+	if len(s.Indexes) > 0 {
+		indexes := make([]string, 0, len(s.Indexes))
+		for k := range s.Indexes {
+			indexes = append(indexes, k)
+		}
+		sort.Strings(indexes)
+		fmt.Fprintln(w, "indexes:")
+		for _, k := range indexes {
+			fmt.Fprintf(w, "  %s\t%d\n", k, s.Indexes[k])
+		}
+	}
+}
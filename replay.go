@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/logtube/logtubed/core"
+	"github.com/logtube/logtubed/types"
+	"github.com/rs/zerolog/log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	replayTargetDispatcher = "dispatcher"
+	replayTargetStd        = "std"
+	replayTargetPri        = "pri"
+)
+
+func parseReplayTime(s string) (t time.Time, err error) {
+	if s == "" {
+		return
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err = time.ParseInLocation(layout, s, time.Local); err == nil {
+			return
+		}
+	}
+	err = errors.New("invalid time: " + s)
+	return
+}
+
+func splitReplayList(s string) (out []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return
+}
+
+// runReplay logtubed replay [flags] FILE|DIR...
+func runReplay(args []string) (err error) {
+	var (
+		optCfgFile    string
+		optTarget     string
+		optFrom       string
+		optTo         string
+		optProjects   string
+		optTopics     string
+		optRate       int
+		optCheckpoint string
+	)
+
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.StringVar(&optCfgFile, "c", "/etc/logtubed.yml", "config file")
+	fs.StringVar(&optTarget, "target", replayTargetDispatcher, "replay target, dispatcher, std or pri")
+	fs.StringVar(&optFrom, "from", "", "replay events at or after this time, i.e. 2020-08-14 or 2020-08-14T10:00:00+08:00")
+	fs.StringVar(&optTo, "to", "", "replay events before this time")
+	fs.StringVar(&optProjects, "project", "", "comma separated projects to replay")
+	fs.StringVar(&optTopics, "topic", "", "comma separated topics to replay")
+	fs.IntVar(&optRate, "rate", 0, "max events per second, 0 for unlimited")
+	fs.StringVar(&optCheckpoint, "checkpoint", "", "checkpoint file to resume from")
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		err = errors.New("replay: no files or directories specified")
+		return
+	}
+	if optTarget != replayTargetDispatcher && optTarget != replayTargetStd && optTarget != replayTargetPri {
+		err = errors.New("replay: unknown target " + optTarget)
+		return
+	}
+
+	var opts types.Options
+	if opts, err = types.LoadOptions(optCfgFile); err != nil {
+		return
+	}
+
+	rOpts := core.ReplayOptions{
+		Paths:      fs.Args(),
+		Projects:   splitReplayList(optProjects),
+		Topics:     splitReplayList(optTopics),
+		Rate:       optRate,
+		Checkpoint: optCheckpoint,
+		TimeOffset: opts.InputRedis.Pipeline.Logtube.TimeOffset,
+	}
+	if rOpts.From, err = parseReplayTime(optFrom); err != nil {
+		return
+	}
+	if rOpts.To, err = parseReplayTime(optTo); err != nil {
+		return
+	}
+
+	// queues are written directly, the daemon must be stopped
+	var queueStd, queuePri core.QueueWriter
+	if optTarget != replayTargetPri {
+		if queueStd, err = core.NewQueueWriter(core.QueueOptions{
+			Dir:       opts.Queue.Dir,
+			Name:      opts.Queue.Name,
+			SyncEvery: opts.Queue.SyncEvery,
+			Compress:  opts.Queue.Compress,
+		}); err != nil {
+			return
+		}
+		defer queueStd.Close()
+	}
+	if optTarget == replayTargetPri || (optTarget == replayTargetDispatcher && len(opts.Topics.Priors) > 0) {
+		if queuePri, err = core.NewQueueWriter(core.QueueOptions{
+			Dir:       opts.Queue.Dir,
+			Name:      opts.Queue.Name + "-pri",
+			SyncEvery: opts.Queue.SyncEvery,
+			Compress:  opts.Queue.Compress,
+		}); err != nil {
+			return
+		}
+		defer queuePri.Close()
+	}
+
+	switch optTarget {
+	case replayTargetDispatcher:
+		var dOpts core.DispatcherOptions
+		if dOpts, err = newDispatcherOptions(opts); err != nil {
+			return
+		}
+		dOpts.NextStd = queueStd
+		if queuePri != nil {
+			dOpts.NextPri = queuePri
+		}
+		if rOpts.Next, err = core.NewDispatcher(dOpts); err != nil {
+			return
+		}
+	case replayTargetStd, replayTargetPri:
+		q := queueStd
+		if optTarget == replayTargetPri {
+			q = queuePri
+		}
+		rOpts.Next = types.EventConsumerFunc(func(e types.Event) error {
+			return q.ConsumeOp(e.ToOp())
+		})
+	}
+
+	var r core.Replayer
+	if r, err = core.NewReplayer(rOpts); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chsig := make(chan os.Signal, 1)
+	signal.Notify(chsig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-chsig:
+			log.Info().Str("signal", sig.String()).Msg("signal caught, saving checkpoint")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err = r.Run(ctx)
+	return
+}
@@ -0,0 +1,117 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type ClientOptions struct {
+	Endpoint  string // i.e. https://s3.amazonaws.com, http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool // use endpoint/bucket/key instead of bucket.endpoint/key, required by most MinIO deployments
+
+	HTTPClient *http.Client
+}
+
+// Client a minimal S3-compatible client, only what archive needs
+type Client struct {
+	endpoint  *url.URL
+	bucket    string
+	pathStyle bool
+	creds     Credentials
+	hc        *http.Client
+}
+
+func NewClient(opts ClientOptions) (*Client, error) {
+	if len(opts.Endpoint) == 0 {
+		return nil, errors.New("s3: Endpoint is not set")
+	}
+	if len(opts.Bucket) == 0 {
+		return nil, errors.New("s3: Bucket is not set")
+	}
+	if len(opts.Region) == 0 {
+		opts.Region = "us-east-1"
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: time.Minute * 5}
+	}
+	u, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("s3: invalid Endpoint " + opts.Endpoint)
+	}
+	return &Client{
+		endpoint:  u,
+		bucket:    opts.Bucket,
+		pathStyle: opts.PathStyle,
+		creds: Credentials{
+			AccessKey: opts.AccessKey,
+			SecretKey: opts.SecretKey,
+			Region:    opts.Region,
+			Service:   "s3",
+		},
+		hc: opts.HTTPClient,
+	}, nil
+}
+
+func (c *Client) objectURL(key string) *url.URL {
+	u := *c.endpoint
+	key = strings.TrimPrefix(key, "/")
+	base := strings.TrimSuffix(u.Path, "/")
+	if c.pathStyle {
+		u.Path = base + "/" + c.bucket + "/" + key
+	} else {
+		u.Host = c.bucket + "." + u.Host
+		u.Path = base + "/" + key
+	}
+	u.RawPath = escape(u.Path, true)
+	return &u
+}
+
+// PutObject upload a object, header is optional, i.e. Content-Type, Content-Encoding
+func (c *Client) PutObject(ctx context.Context, key string, body []byte, header http.Header) error {
+	return c.PutObjectStream(ctx, key, bytes.NewReader(body), int64(len(body)), PayloadHash(body), header)
+}
+
+// PutObjectStream upload a object from a reader of known size, payloadHash is the hex encoded SHA256 of body,
+// so large objects can be uploaded without being held in memory
+func (c *Client) PutObjectStream(ctx context.Context, key string, body io.Reader, size int64, payloadHash string, header http.Header) (err error) {
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodPut, c.objectURL(key).String(), body); err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	Sign(req, c.creds, payloadHash, time.Now())
+
+	var res *http.Response
+	if res, err = c.hc.Do(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		err = fmt.Errorf("s3: failed to put object %s, status %d: %s", key, res.StatusCode, strings.TrimSpace(string(msg)))
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	return
+}
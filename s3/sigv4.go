@@ -0,0 +1,155 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+
+AWS Signature Version 4, header based authorization
+
+https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+
+*/
+
+const (
+	sigAlgorithm  = "AWS4-HMAC-SHA256"
+	sigTimeLayout = "20060102T150405Z"
+	sigDateLayout = "20060102"
+
+	HeaderDate          = "X-Amz-Date"
+	HeaderContentSHA256 = "X-Amz-Content-Sha256"
+
+	EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Credentials signing credentials
+type Credentials struct {
+	AccessKey string
+	SecretKey string
+	Region    string
+	Service   string
+}
+
+// PayloadHash hex encoded sha256 of payload
+func PayloadHash(buf []byte) string {
+	h := sha256.Sum256(buf)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// escape uri encode as required by SigV4, '/' is kept if path is true
+func escape(s string, path bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (path && b == '/') {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteByte('%')
+			sb.WriteString(strings.ToUpper(hex.EncodeToString([]byte{b})))
+		}
+	}
+	return sb.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	var pairs []string
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, escape(k, false)+"="+escape(v, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// signedHeaders host and all headers already set, except ones modified by transports
+func signedHeaders(req *http.Request) (names []string, canonical string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	vals := map[string]string{"host": host}
+	names = []string{"host"}
+	for k, vs := range req.Header {
+		k = strings.ToLower(k)
+		if k == "authorization" || k == "user-agent" || k == "accept-encoding" || k == "content-length" {
+			continue
+		}
+		var trimmed []string
+		for _, v := range vs {
+			trimmed = append(trimmed, strings.Join(strings.Fields(v), " "))
+		}
+		vals[k] = strings.Join(trimmed, ",")
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, k := range names {
+		sb.WriteString(k)
+		sb.WriteByte(':')
+		sb.WriteString(vals[k])
+		sb.WriteByte('\n')
+	}
+	canonical = sb.String()
+	return
+}
+
+// Sign sign a request in place, payloadHash should be hex encoded sha256 of body
+func Sign(req *http.Request, c Credentials, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set(HeaderDate, t.Format(sigTimeLayout))
+	req.Header.Set(HeaderContentSHA256, payloadHash)
+
+	names, headers := signedHeaders(req)
+	signed := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if u, err := url.PathUnescape(path); err == nil {
+		path = escape(u, true)
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		headers,
+		signed,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{t.Format(sigDateLayout), c.Region, c.Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		sigAlgorithm,
+		t.Format(sigTimeLayout),
+		scope,
+		PayloadHash([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), t.Format(sigDateLayout))
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, c.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", sigAlgorithm+
+		" Credential="+c.AccessKey+"/"+scope+
+		", SignedHeaders="+signed+
+		", Signature="+signature)
+}
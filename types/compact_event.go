@@ -1,13 +1,31 @@
 package types
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
 	"strings"
 	"time"
 )
 
-var ErrInvalidCompactEvent = errors.New("invalid compact event")
+var (
+	ErrInvalidCompactEvent       = errors.New("invalid compact event")
+	ErrCompactEventsTooLarge     = errors.New("compact events payload too large after decompression")
+	ErrCompactEventsNotSupported = errors.New("zstd compressed compact events are not supported")
+)
+
+var (
+	compactEventsGzipMagic = []byte{0x1f, 0x8b}
+	compactEventsZstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+const (
+	// limit of decompressed payload, prevents decompression bombs
+	compactEventsMaxSize = 64 * 1024 * 1024
+)
 
 // CompactEvent compact version of event
 type CompactEvent struct {
@@ -37,6 +55,73 @@ func UnmarshalCompactEventJSON(buf []byte) (c CompactEvent, err error) {
 	return
 }
 
+// CompactEventResult a compact event decoded from a batch payload, with its raw JSON
+type CompactEventResult struct {
+	Event CompactEvent
+	Raw   []byte
+	Err   error
+}
+
+// UnmarshalCompactEventsJSON decode a payload of one or many compact events, a single JSON object, a JSON array or NDJSON,
+// gzip compressed payload is detected by its magic bytes, invalid events are reported in results, err is returned only if
+// the payload as a whole can not be decoded
+func UnmarshalCompactEventsJSON(buf []byte) (rs []CompactEventResult, err error) {
+	if bytes.HasPrefix(buf, compactEventsZstdMagic) {
+		err = ErrCompactEventsNotSupported
+		return
+	}
+	if bytes.HasPrefix(buf, compactEventsGzipMagic) {
+		if buf, err = gunzipCompactEvents(buf); err != nil {
+			return
+		}
+	}
+	trimmed := bytes.TrimSpace(buf)
+	if len(trimmed) == 0 {
+		err = ErrInvalidCompactEvent
+		return
+	}
+	var raws [][]byte
+	if trimmed[0] == '[' {
+		var items []json.RawMessage
+		if err = json.Unmarshal(trimmed, &items); err != nil {
+			return
+		}
+		for _, item := range items {
+			raws = append(raws, item)
+		}
+	} else if json.Valid(trimmed) {
+		// single event, possibly pretty printed
+		raws = [][]byte{buf}
+	} else {
+		for _, line := range bytes.Split(trimmed, []byte{'\n'}) {
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				raws = append(raws, line)
+			}
+		}
+	}
+	for _, raw := range raws {
+		r := CompactEventResult{Raw: raw}
+		r.Event, r.Err = UnmarshalCompactEventJSON(raw)
+		rs = append(rs, r)
+	}
+	return
+}
+
+func gunzipCompactEvents(buf []byte) (out []byte, err error) {
+	var r *gzip.Reader
+	if r, err = gzip.NewReader(bytes.NewReader(buf)); err != nil {
+		return
+	}
+	defer r.Close()
+	if out, err = ioutil.ReadAll(io.LimitReader(r, compactEventsMaxSize+1)); err != nil {
+		return
+	}
+	if len(out) > compactEventsMaxSize {
+		err = ErrCompactEventsTooLarge
+	}
+	return
+}
+
 func (c CompactEvent) ToEvent() (e Event) {
 	e.Timestamp = time.Unix(c.Timestamp/1000, int64(time.Millisecond/time.Nanosecond)*(c.Timestamp%1000))
 	e.Hostname = c.Hostname
@@ -26,7 +26,7 @@ func TestCompactEvent_ToEvent(t *testing.T) {
 		{
 			name:   "case-1",
 			fields: fields{1000, "a", "b", "c", "d", "e", "f", "g", map[string]interface{}{"h": "i"}},
-			wantE:  Event{time.Unix(1, 0), "a", "b", "c", "d", "e", "f", "g", "", 71, map[string]interface{}{"h": "i"}},
+			wantE:  Event{time.Unix(1, 0), "a", "b", "c", "d", "e", "", "f", "g", "", 0, map[string]interface{}{"h": "i"}},
 		},
 	}
 	for _, tt := range tests {
@@ -62,7 +62,7 @@ func TestUnmarshalCompactEventJSON(t *testing.T) {
 		{
 			name:    "case-1",
 			args:    args{[]byte(`{"t":1000, "h":"a", "e":"b", "p":"c", "o":"d", "c":"e", "m":"f", "k":"g", "x":{"h":"i"}}`)},
-			wantC:   CompactEvent{1000, "a", "b", "c", "d", "e", "f", "g", map[string]interface{}{"h": "i"}},
+			wantC:   CompactEvent{1000, "a", "b", "c", "d", "e", "", "f", "g", map[string]interface{}{"h": "i"}},
 			wantErr: false,
 		},
 	}
@@ -29,6 +29,14 @@ type EventConsumer interface {
 	ConsumeEvent(e Event) error
 }
 
+// EventConsumerFunc adapter to use a function as EventConsumer
+type EventConsumerFunc func(e Event) error
+
+// ConsumeEvent calls f(e)
+func (f EventConsumerFunc) ConsumeEvent(e Event) error {
+	return f(e)
+}
+
 // ToMap convert event into Logtube Event final format
 func (r Event) ToMap() (out map[string]interface{}) {
 	out = map[string]interface{}{}
@@ -55,6 +63,46 @@ func (r Event) ToMap() (out map[string]interface{}) {
 	return
 }
 
+// EventFromMap convert a map produced by ToMap back into Event, keys with "x_" prefix are restored as Extra
+func EventFromMap(m map[string]interface{}) (r Event, ok bool) {
+	str := func(key string) string {
+		s, _ := m[key].(string)
+		return s
+	}
+	var err error
+	if r.Timestamp, err = time.Parse(time.RFC3339Nano, str("timestamp")); err != nil {
+		return
+	}
+	r.Hostname = str("hostname")
+	r.Env = str("env")
+	r.Project = str("project")
+	r.Topic = str("topic")
+	r.Crid = str("crid")
+	r.Crsrc = str("crsrc")
+	r.Via = str("via")
+	r.Keyword = str("keyword")
+	r.Message = str("message")
+	switch v := m["raw_size"].(type) {
+	case float64:
+		r.RawSize = int(v)
+	case json.Number:
+		n, _ := v.Int64()
+		r.RawSize = int(n)
+	case int:
+		r.RawSize = v
+	}
+	for k, v := range m {
+		if strings.HasPrefix(k, "x_") {
+			if r.Extra == nil {
+				r.Extra = map[string]interface{}{}
+			}
+			r.Extra[k[2:]] = v
+		}
+	}
+	ok = true
+	return
+}
+
 // EnvForIndex group env for index
 func (r Event) EnvForIndex() string {
 	if strings.Contains(r.Env, "dev") {
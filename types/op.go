@@ -2,11 +2,15 @@ package types
 
 import (
 	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"time"
 )
 
-// Op memory layout
+// Op memory layout, v1 (read only)
 
 // 1. 2-bytes, 0xAC, 0xCF,
 // 2. 2-bytes, Index length, uint16 (BE)
@@ -14,17 +18,59 @@ import (
 // 4. 4-bytes, Body length, uint32 (BE)
 // 5. N-bytes, Body
 
+// Op memory layout, v2
+
+// 1. 2-bytes, 0xAC, 0xD0
+// 2. 1-byte,  version, 0x02
+// 3. 1-byte,  body compression, see OpCompressionXXX
+// 4. 1-byte,  header count
+// 5. headers, each with 1-byte key, 2-bytes value length uint16 (BE) and value, unknown keys are skipped
+// 6. 2-bytes, Index length, uint16 (BE)
+// 7. N-bytes, Index
+// 8. 4-bytes, Body length, uint32 (BE)
+// 9. N-bytes, Body, possibly compressed
+// 10. 4-bytes, CRC32 (IEEE) of all preceding bytes, uint32 (BE)
+
 var (
-	ErrInvalidFormat = errors.New("invalid format of Op")
+	ErrInvalidFormat   = errors.New("invalid format of Op")
+	ErrInvalidVersion  = errors.New("unsupported version of Op")
+	ErrInvalidChecksum = errors.New("checksum mismatch of Op")
 )
 
 var (
-	opMagicBytes = []byte{0xAC, 0xCF}
+	opMagicBytes   = []byte{0xAC, 0xCF}
+	opMagicBytesV2 = []byte{0xAC, 0xD0}
+)
+
+const (
+	opVersion2 = 0x02
+)
+
+// body compression of v2 Op, snappy and zstd are not available without extra dependencies, stdlib DEFLATE is used
+const (
+	OpCompressionNone  = 0x00
+	OpCompressionFlate = 0x01
+)
+
+// header keys of v2 Op
+const (
+	opHeaderID         = 0x01
+	opHeaderRouting    = 0x02
+	opHeaderEnqueuedAt = 0x03
+)
+
+const (
+	// bodies smaller than this are never compressed
+	opCompressMinSize = 512
 )
 
 type Op struct {
 	Index string
 	Body  []byte
+
+	ID         string    // optional document id
+	Routing    string    // optional routing key
+	EnqueuedAt time.Time // optional time when Op was put into queue
 }
 
 // OpConsumer consumes Ops
@@ -33,39 +79,219 @@ type OpConsumer interface {
 	ConsumeOp(op Op) error
 }
 
-func OpMarshal(o Op) (ret []byte) {
+// BatchOpConsumer consumes Ops in batches, the slice is owned by the consumer once passed
+type BatchOpConsumer interface {
+	OpConsumer
+
+	// add a batch of Ops to the consumer
+	ConsumeOps(ops []Op) error
+}
+
+// AckOpConsumer consumes Ops in batches, ack is invoked once the whole batch is delivered with a nil error,
+// or once the batch is given up with the error, a batch never acknowledged will be delivered again
+type AckOpConsumer interface {
+	BatchOpConsumer
+
+	// add a batch of Ops to the consumer, with a callback for acknowledgement
+	ConsumeOpsAck(ops []Op, ack func(err error)) error
+}
+
+// OpMarshal encode a Op with v2 layout, without compression
+func OpMarshal(o Op) []byte {
+	return opMarshal(o, OpCompressionNone, o.Body)
+}
+
+// OpMarshalCompressed encode a Op with v2 layout, body is compressed if large enough and compression pays off,
+// DEFLATE of stdlib is used instead of snappy or zstd since neither is vendored, the compression byte leaves room for them
+func OpMarshalCompressed(o Op) []byte {
+	if len(o.Body) < opCompressMinSize {
+		return OpMarshal(o)
+	}
+	buf := &bytes.Buffer{}
+	w, _ := flate.NewWriter(buf, flate.BestSpeed)
+	if _, err := w.Write(o.Body); err != nil {
+		return OpMarshal(o)
+	}
+	if err := w.Close(); err != nil {
+		return OpMarshal(o)
+	}
+	if buf.Len() >= len(o.Body) {
+		return OpMarshal(o)
+	}
+	return opMarshal(o, OpCompressionFlate, buf.Bytes())
+}
+
+type opHeader struct {
+	key   byte
+	value []byte
+}
+
+func opMarshal(o Op, compression byte, body []byte) (ret []byte) {
+	var headers []opHeader
+	if len(o.ID) > 0 {
+		headers = append(headers, opHeader{key: opHeaderID, value: []byte(o.ID)})
+	}
+	if len(o.Routing) > 0 {
+		headers = append(headers, opHeader{key: opHeaderRouting, value: []byte(o.Routing)})
+	}
+	if !o.EnqueuedAt.IsZero() {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(o.EnqueuedAt.UnixNano()))
+		headers = append(headers, opHeader{key: opHeaderEnqueuedAt, value: v})
+	}
+
 	index := []byte(o.Index)
-	total := 2 + 2 + len(index) + 4 + len(o.Body)
+	total := 2 + 1 + 1 + 1 + 2 + len(index) + 4 + len(body) + 4
+	for _, h := range headers {
+		total += 1 + 2 + len(h.value)
+	}
 
 	ret = make([]byte, total, total)
 	i := 0
 
-	copy(ret, opMagicBytes)
+	copy(ret, opMagicBytesV2)
 	i += 2
 
+	ret[i] = opVersion2
+	ret[i+1] = compression
+	ret[i+2] = byte(len(headers))
+	i += 3
+
+	for _, h := range headers {
+		ret[i] = h.key
+		binary.BigEndian.PutUint16(ret[i+1:], uint16(len(h.value)))
+		i += 3
+		copy(ret[i:], h.value)
+		i += len(h.value)
+	}
+
 	binary.BigEndian.PutUint16(ret[i:], uint16(len(index)))
 	i += 2
 
 	copy(ret[i:], index)
 	i += len(index)
 
-	binary.BigEndian.PutUint32(ret[i:], uint32(len(o.Body)))
+	binary.BigEndian.PutUint32(ret[i:], uint32(len(body)))
 	i += 4
 
-	copy(ret[i:], o.Body)
+	copy(ret[i:], body)
+	i += len(body)
+
+	binary.BigEndian.PutUint32(ret[i:], crc32.ChecksumIEEE(ret[:i]))
 	return
 }
 
+// OpUnmarshal decode a Op of v1 or v2 layout, all lengths are checked against the buffer
 func OpUnmarshal(b []byte) (ret Op, err error) {
-	// check format and magic bytes
-	if len(b) < 10 || !bytes.Equal(opMagicBytes, b[0:2]) {
+	if len(b) < 2 {
 		err = ErrInvalidFormat
 		return
 	}
+	if bytes.Equal(opMagicBytes, b[0:2]) {
+		return opUnmarshalV1(b)
+	}
+	if bytes.Equal(opMagicBytesV2, b[0:2]) {
+		return opUnmarshalV2(b)
+	}
+	err = ErrInvalidFormat
+	return
+}
 
+func opUnmarshalV1(b []byte) (ret Op, err error) {
+	if len(b) < 8 {
+		err = ErrInvalidFormat
+		return
+	}
 	indexLen := int(binary.BigEndian.Uint16(b[2:4]))
+	if len(b) < 8+indexLen {
+		err = ErrInvalidFormat
+		return
+	}
 	ret.Index = string(b[4 : 4+indexLen])
-	bodyLen := int(binary.BigEndian.Uint32(b[4+indexLen:]))
-	ret.Body = b[8+indexLen : 8+indexLen+bodyLen]
+	bodyLen := int64(binary.BigEndian.Uint32(b[4+indexLen:]))
+	if int64(len(b)) < 8+int64(indexLen)+bodyLen {
+		err = ErrInvalidFormat
+		return
+	}
+	ret.Body = b[8+indexLen : 8+indexLen+int(bodyLen)]
+	return
+}
+
+func opUnmarshalV2(b []byte) (ret Op, err error) {
+	// magic, version, compression, header count, index length, body length, checksum
+	if len(b) < 2+3+2+4+4 {
+		err = ErrInvalidFormat
+		return
+	}
+	if b[2] != opVersion2 {
+		err = ErrInvalidVersion
+		return
+	}
+	end := len(b) - 4
+	if binary.BigEndian.Uint32(b[end:]) != crc32.ChecksumIEEE(b[:end]) {
+		err = ErrInvalidChecksum
+		return
+	}
+	compression := b[3]
+	count := int(b[4])
+	i := 5
+
+	for n := 0; n < count; n++ {
+		if i+3 > end {
+			err = ErrInvalidFormat
+			return
+		}
+		key := b[i]
+		l := int(binary.BigEndian.Uint16(b[i+1:]))
+		i += 3
+		if i+l > end {
+			err = ErrInvalidFormat
+			return
+		}
+		v := b[i : i+l]
+		i += l
+		switch key {
+		case opHeaderID:
+			ret.ID = string(v)
+		case opHeaderRouting:
+			ret.Routing = string(v)
+		case opHeaderEnqueuedAt:
+			if len(v) == 8 {
+				ret.EnqueuedAt = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+			}
+		}
+	}
+
+	if i+2 > end {
+		err = ErrInvalidFormat
+		return
+	}
+	indexLen := int(binary.BigEndian.Uint16(b[i:]))
+	i += 2
+	if i+indexLen+4 > end {
+		err = ErrInvalidFormat
+		return
+	}
+	ret.Index = string(b[i : i+indexLen])
+	i += indexLen
+
+	bodyLen := int64(binary.BigEndian.Uint32(b[i:]))
+	i += 4
+	if int64(i)+bodyLen != int64(end) {
+		err = ErrInvalidFormat
+		return
+	}
+	body := b[i:end]
+
+	switch compression {
+	case OpCompressionNone:
+		ret.Body = body
+	case OpCompressionFlate:
+		r := flate.NewReader(bytes.NewReader(body))
+		ret.Body, err = ioutil.ReadAll(r)
+		_ = r.Close()
+	default:
+		err = ErrInvalidFormat
+	}
 	return
 }
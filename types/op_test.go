@@ -2,11 +2,15 @@ package types
 
 import (
 	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_OpMarshalUnmarshal(t *testing.T) {
-	o1 := Op{"this-is-a-Index", []byte{0x01, 0x02, 0x03}}
+	o1 := Op{Index: "this-is-a-Index", Body: []byte{0x01, 0x02, 0x03}}
 
 	var err error
 	var buf []byte
@@ -23,3 +27,97 @@ func Test_OpMarshalUnmarshal(t *testing.T) {
 		t.Fatal("not equal")
 	}
 }
+
+func Test_OpMarshalCompressed(t *testing.T) {
+	o1 := Op{
+		Index:      "info-test-2020-08-14",
+		Body:       []byte(strings.Repeat(`{"message":"hello world"}`, 100)),
+		ID:         "doc-1",
+		Routing:    "order",
+		EnqueuedAt: time.Unix(1597370400, 123),
+	}
+	buf := OpMarshalCompressed(o1)
+	if len(buf) >= len(o1.Body) {
+		t.Fatal("not compressed")
+	}
+	o2, err := OpUnmarshal(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o1.Index != o2.Index || !bytes.Equal(o1.Body, o2.Body) || o1.ID != o2.ID || o1.Routing != o2.Routing || !o1.EnqueuedAt.Equal(o2.EnqueuedAt) {
+		t.Fatal("not equal")
+	}
+}
+
+func Test_OpUnmarshalV1(t *testing.T) {
+	index, body := []byte("info-test-2020-08-14"), []byte(`{"message":"hello"}`)
+	buf := []byte{0xAC, 0xCF, 0, 0}
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(index)))
+	buf = append(buf, index...)
+	buf = append(buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(len(body)))
+	buf = append(buf, body...)
+
+	o, err := OpUnmarshal(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Index != string(index) || !bytes.Equal(o.Body, body) {
+		t.Fatal("not equal")
+	}
+
+	// truncated records must not panic
+	for i := 0; i < len(buf); i++ {
+		if _, err = OpUnmarshal(buf[:i]); err == nil {
+			t.Fatal("truncated v1 record accepted", i)
+		}
+	}
+}
+
+func Test_OpUnmarshalCorrupted(t *testing.T) {
+	buf := OpMarshal(Op{Index: "info-test-2020-08-14", Body: []byte(`{"message":"hello"}`), ID: "doc-1"})
+	for i := 0; i < len(buf); i++ {
+		if _, err := OpUnmarshal(buf[:i]); err == nil {
+			t.Fatal("truncated v2 record accepted", i)
+		}
+	}
+	buf[len(buf)-6] ^= 0xff
+	if _, err := OpUnmarshal(buf); err != ErrInvalidChecksum {
+		t.Fatal("corrupted v2 record accepted", err)
+	}
+}
+
+func Test_OpUnmarshalFlagBytes(t *testing.T) {
+	// v1 records written by older releases are recognized by magic bytes, they have no version or compression byte
+	buf := []byte{0xAC, 0xCF, 0x00, 0x01, 'a', 0x00, 0x00, 0x00, 0x01, 'b'}
+	o, err := OpUnmarshal(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Index != "a" || string(o.Body) != "b" {
+		t.Fatal("not equal")
+	}
+
+	// v2 records carry version and compression bytes
+	buf = OpMarshal(Op{Index: "a", Body: []byte("b")})
+	if buf[2] != opVersion2 || buf[3] != OpCompressionNone {
+		t.Fatalf("unexpected flag bytes % 02x", buf[2:4])
+	}
+	buf = OpMarshalCompressed(Op{Index: "a", Body: []byte(strings.Repeat("b", 1024))})
+	if buf[2] != opVersion2 || buf[3] != OpCompressionFlate {
+		t.Fatalf("unexpected flag bytes % 02x", buf[2:4])
+	}
+
+	// unknown version and compression are rejected
+	buf = OpMarshal(Op{Index: "a", Body: []byte("b")})
+	buf[2] = 0x03
+	if _, err = OpUnmarshal(buf); err != ErrInvalidVersion {
+		t.Fatal("unknown version accepted", err)
+	}
+	buf = OpMarshal(Op{Index: "a", Body: []byte("b")})
+	buf[3] = 0x02
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], crc32.ChecksumIEEE(buf[:len(buf)-4]))
+	if _, err = OpUnmarshal(buf); err != ErrInvalidFormat {
+		t.Fatal("unknown compression accepted", err)
+	}
+}
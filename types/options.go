@@ -8,9 +8,11 @@ import (
 
 // Options options for logtubed
 type Options struct {
-	Verbose  bool   `yaml:"verbose" default:"$LOGTUBED_VERBOSE|false"`
-	Hostname string `yaml:"hostname"`
-	PProf    struct {
+	Verbose         bool   `yaml:"verbose" default:"$LOGTUBED_VERBOSE|false"`
+	Hostname        string `yaml:"hostname"`
+	ShutdownDrain   bool   `yaml:"shutdown_drain" default:"$LOGTUBED_SHUTDOWN_DRAIN|false"`
+	ShutdownTimeout int    `yaml:"shutdown_timeout" default:"$LOGTUBED_SHUTDOWN_TIMEOUT|30"`
+	PProf           struct {
 		Bind  string `yaml:"bind" default:"$LOGTUBED_PPROF_BIND|0.0.0.0:6060"`
 		Block int    `yaml:"block" default:"$LOGTUBED_PPROF_BLOCK|0"`
 		Mutex int    `yaml:"mutex" default:"$LOGTUBED_PPROF_MUTEX|0"`
@@ -19,6 +21,31 @@ type Options struct {
 		Enabled  bool   `yaml:"enabled" default:"$LOGTUBED_REDIS_ENABLED|false"`
 		Bind     string `yaml:"bind" default:"$LOGTUBED_REDIS_BIND|0.0.0.0:6379"`
 		Multi    bool   `yaml:"multi" default:"$LOGTUBED_REDIS_MULTI|false"`
+		Password string `yaml:"password" json:"-" default:"$LOGTUBED_REDIS_PASSWORD|"`
+		Tokens   []struct {
+			Token    string   `yaml:"token" json:"-"`
+			Envs     []string `yaml:"envs"`
+			Projects []string `yaml:"projects"`
+		} `yaml:"tokens"`
+		Routes []struct {
+			Key     string `yaml:"key"`
+			Decoder string `yaml:"decoder"`
+			Env     string `yaml:"env"`
+			Project string `yaml:"project"`
+			Topic   string `yaml:"topic"`
+		} `yaml:"routes"`
+		Strict bool `yaml:"strict" default:"$LOGTUBED_REDIS_STRICT|false"`
+		Limit  struct {
+			MaxRawSize     int  `yaml:"max_raw_size" default:"$LOGTUBED_REDIS_LIMIT_MAX_RAW_SIZE|1000000"`
+			MaxMessageSize int  `yaml:"max_message_size" default:"$LOGTUBED_REDIS_LIMIT_MAX_MESSAGE_SIZE|0"`
+			Truncate       bool `yaml:"truncate" default:"$LOGTUBED_REDIS_LIMIT_TRUNCATE|false"`
+		} `yaml:"limit"`
+		TLS struct {
+			Bind     string `yaml:"bind" default:"$LOGTUBED_REDIS_TLS_BIND|"`
+			Cert     string `yaml:"cert" default:"$LOGTUBED_REDIS_TLS_CERT|"`
+			Key      string `yaml:"key" default:"$LOGTUBED_REDIS_TLS_KEY|"`
+			ClientCA string `yaml:"client_ca" default:"$LOGTUBED_REDIS_TLS_CLIENT_CA|"`
+		} `yaml:"tls"`
 		Pipeline struct {
 			Logtube struct {
 				TimeOffset int `yaml:"time_offset" default:"$LOGTUBED_REDIS_TIME_OFFSET|0"`
@@ -26,12 +53,40 @@ type Options struct {
 			MySQL struct {
 				ErrorIgnoreLevels []string `yaml:"error_ignore_levels" default:"$LOGTUBE_REDIS_PIPELINE_MYSQL_ERROR_IGNORE_LEVELS|[]"`
 			} `yaml:"mysql"`
+			Nginx struct {
+				Format string `yaml:"format" default:"$LOGTUBED_REDIS_PIPELINE_NGINX_FORMAT|auto"`
+				Tags   []struct {
+					Tag   string `yaml:"tag"`
+					Name  string `yaml:"name"`
+					Type  string `yaml:"type"`
+					Multi bool   `yaml:"multi"`
+				} `yaml:"tags"`
+			} `yaml:"nginx"`
+			Kubernetes struct {
+				Env          []string `yaml:"env" default:"$LOGTUBED_REDIS_PIPELINE_KUBERNETES_ENV|[\"annotation:logtube.io/env\",\"label:logtube.io/env\"]"`
+				Project      []string `yaml:"project" default:"$LOGTUBED_REDIS_PIPELINE_KUBERNETES_PROJECT|[\"annotation:logtube.io/project\",\"label:logtube.io/project\",\"label:app\"]"`
+				Topic        []string `yaml:"topic" default:"$LOGTUBED_REDIS_PIPELINE_KUBERNETES_TOPIC|[\"annotation:logtube.io/topic\",\"label:logtube.io/topic\"]"`
+				DefaultTopic string   `yaml:"default_topic" default:"$LOGTUBED_REDIS_PIPELINE_KUBERNETES_DEFAULT_TOPIC|info"`
+			} `yaml:"kubernetes"`
 		} `yaml:"pipeline"`
 	} `yaml:"input_redis"`
+	InputCapture struct {
+		File    string `yaml:"file" default:"$LOGTUBED_INPUT_CAPTURE_FILE|"`
+		Sample  int    `yaml:"sample" default:"$LOGTUBED_INPUT_CAPTURE_SAMPLE|100"`
+		MaxSize int64  `yaml:"max_size" default:"$LOGTUBED_INPUT_CAPTURE_MAX_SIZE|104857600"`
+	} `yaml:"input_capture"`
 	InputSPTP struct {
 		Enabled bool   `yaml:"enabled" default:"$LOGTUBED_SPTP_ENABLED|false"`
 		Bind    string `yaml:"bind" default:"$LOGTUBED_SPTP_BIND|0.0.0.0:9921"`
+		// socket receive buffer in bytes, 0 keeps system default
+		ReadBuffer int `yaml:"read_buffer" default:"$LOGTUBED_SPTP_READ_BUFFER|0"`
+		Workers    int `yaml:"workers" default:"$LOGTUBED_SPTP_WORKERS|4"`
+		QueueSize  int `yaml:"queue_size" default:"$LOGTUBED_SPTP_QUEUE_SIZE|1024"`
 	} `yaml:"input_sptp"`
+	InputOTLP struct {
+		Enabled bool   `yaml:"enabled" default:"$LOGTUBED_OTLP_ENABLED|false"`
+		Bind    string `yaml:"bind" default:"$LOGTUBED_OTLP_BIND|0.0.0.0:4318"`
+	} `yaml:"input_otlp"`
 	Keywords struct {
 		Ingnored []string `yaml:"ignored" default:"$LOGTUBED_KEYWORDS_IGNORED|[]"`
 	} `yaml:"keywords"`
@@ -44,11 +99,52 @@ type Options struct {
 		Env   map[string]string `yaml:"env"`
 		Topic map[string]string `yaml:"topic"`
 	} `yaml:"mappings"`
+	Schemas map[string]map[string]struct {
+		Type      string `yaml:"type"`
+		Required  bool   `yaml:"required"`
+		MaxLength int    `yaml:"max_length"`
+	} `yaml:"schemas"`
+	Digest struct {
+		Rules []struct {
+			Pattern     string `yaml:"pattern"`
+			Placeholder string `yaml:"placeholder"`
+		} `yaml:"rules"`
+		Routes     map[string][]string `yaml:"routes"`
+		MaxDigests int                 `yaml:"max_digests" default:"$LOGTUBED_DIGEST_MAX_DIGESTS|0"`
+	} `yaml:"digest"`
+	Enrich struct {
+		GeoIPFile string `yaml:"geoip_file" default:"$LOGTUBED_ENRICH_GEOIP_FILE|"`
+		ASNFile   string `yaml:"asn_file" default:"$LOGTUBED_ENRICH_ASN_FILE|"`
+		CacheSize int    `yaml:"cache_size" default:"$LOGTUBED_ENRICH_CACHE_SIZE|10000"`
+		Topics    map[string]struct {
+			GeoIP     bool     `yaml:"geoip"`
+			UserAgent bool     `yaml:"user_agent"`
+			IPFields  []string `yaml:"ip_fields"`
+			UAField   string   `yaml:"ua_field"`
+		} `yaml:"topics"`
+	} `yaml:"enrich"`
+	Trace struct {
+		Enabled    bool   `yaml:"enabled" default:"$LOGTUBED_TRACE_ENABLED|false"`
+		Bind       string `yaml:"bind" default:"$LOGTUBED_TRACE_BIND|127.0.0.1:6061"`
+		MaxTraces  int    `yaml:"max_traces" default:"$LOGTUBED_TRACE_MAX_TRACES|100000"`
+		MaxEntries int    `yaml:"max_entries" default:"$LOGTUBED_TRACE_MAX_ENTRIES|100"`
+		Window     int    `yaml:"window" default:"$LOGTUBED_TRACE_WINDOW|60"`
+		Emit       bool   `yaml:"emit" default:"$LOGTUBED_TRACE_EMIT|false"`
+		Topic      string `yaml:"topic" default:"$LOGTUBED_TRACE_TOPIC|x-trace"`
+	} `yaml:"trace"`
+	Tail struct {
+		Enabled        bool   `yaml:"enabled" default:"$LOGTUBED_TAIL_ENABLED|false"`
+		Bind           string `yaml:"bind" default:"$LOGTUBED_TAIL_BIND|127.0.0.1:6062"`
+		BufferSize     int    `yaml:"buffer_size" default:"$LOGTUBED_TAIL_BUFFER_SIZE|1000"`
+		MaxSubscribers int    `yaml:"max_subscribers" default:"$LOGTUBED_TAIL_MAX_SUBSCRIBERS|16"`
+	} `yaml:"tail"`
 	Queue struct {
-		Dir       string `yaml:"dir" default:"$LOGTUBED_QUEUE_DIR|/var/lib/logtubed"`
-		Name      string `yaml:"name" default:"$LOGTUBED_QUEUE_NAME|logtubed"`
-		SyncEvery int    `yaml:"sync_every" default:"$LOGTUBED_QUEUE_SYNC_EVERY|100"`
-		Watermark int    `yaml:"watermark" default:"$LOGTUBED_QUEUE_WATERMARK|10"`
+		Dir         string `yaml:"dir" default:"$LOGTUBED_QUEUE_DIR|/var/lib/logtubed"`
+		Name        string `yaml:"name" default:"$LOGTUBED_QUEUE_NAME|logtubed"`
+		SyncEvery   int    `yaml:"sync_every" default:"$LOGTUBED_QUEUE_SYNC_EVERY|100"`
+		Watermark   int    `yaml:"watermark" default:"$LOGTUBED_QUEUE_WATERMARK|10"`
+		Compress    bool   `yaml:"compress" default:"$LOGTUBED_QUEUE_COMPRESS|false"`
+		AtLeastOnce bool   `yaml:"at_least_once" default:"$LOGTUBED_QUEUE_AT_LEAST_ONCE|false"`
 	} `yaml:"queue"`
 	OutputSlowSQL struct {
 		Enabled   bool   `yaml:"enabled" default:"$OUTPUT_SLOW_SQL_ENABLED|false"`
@@ -69,7 +165,39 @@ type Options struct {
 		Enabled   bool   `yaml:"enabled" default:"$LOGTUBED_LOCAL_ENABLED|false"`
 		Dir       string `yaml:"dir" default:"$LOGTUBED_LOCAL_DIR|/var/log/logtubed"`
 		Watermark int    `yaml:"watermark" default:"$LOGTUBED_LOCAL_WATERMARK|10"`
+		// serialization format, text, json, logfmt, logtube or template
+		Format   string `yaml:"format" default:"$LOGTUBED_LOCAL_FORMAT|text"`
+		Template string `yaml:"template"`
+		// rotation, capacities like 512m, 10g, interval in seconds
+		MaxFileSize    string `yaml:"max_file_size" default:"$LOGTUBED_LOCAL_MAX_FILE_SIZE|"`
+		RotateInterval int    `yaml:"rotate_interval" default:"$LOGTUBED_LOCAL_ROTATE_INTERVAL|0"`
+		MaxOpenFiles   int    `yaml:"max_open_files" default:"$LOGTUBED_LOCAL_MAX_OPEN_FILES|2000"`
+		// compression and retention, max age in days
+		Compress       bool   `yaml:"compress" default:"$LOGTUBED_LOCAL_COMPRESS|false"`
+		MaxAge         int    `yaml:"max_age" default:"$LOGTUBED_LOCAL_MAX_AGE|0"`
+		MaxProjectSize string `yaml:"max_project_size" default:"$LOGTUBED_LOCAL_MAX_PROJECT_SIZE|"`
+		// writers, flush interval in seconds
+		Shards        int    `yaml:"shards" default:"$LOGTUBED_LOCAL_SHARDS|4"`
+		QueueSize     int    `yaml:"queue_size" default:"$LOGTUBED_LOCAL_QUEUE_SIZE|10000"`
+		QueuePolicy   string `yaml:"queue_policy" default:"$LOGTUBED_LOCAL_QUEUE_POLICY|block"`
+		BufferSize    int    `yaml:"buffer_size" default:"$LOGTUBED_LOCAL_BUFFER_SIZE|16384"`
+		FlushInterval int    `yaml:"flush_interval" default:"$LOGTUBED_LOCAL_FLUSH_INTERVAL|1"`
+		Fsync         string `yaml:"fsync" default:"$LOGTUBED_LOCAL_FSYNC|none"`
 	} `yaml:"output_local"`
+	OutputArchive struct {
+		Enabled   bool   `yaml:"enabled" default:"$LOGTUBED_ARCHIVE_ENABLED|false"`
+		Dir       string `yaml:"dir" default:"$LOGTUBED_ARCHIVE_DIR|/var/lib/logtubed/archive"`
+		Watermark int    `yaml:"watermark" default:"$LOGTUBED_ARCHIVE_WATERMARK|10"`
+		Endpoint  string `yaml:"endpoint" default:"$LOGTUBED_ARCHIVE_ENDPOINT|"`
+		Region    string `yaml:"region" default:"$LOGTUBED_ARCHIVE_REGION|us-east-1"`
+		Bucket    string `yaml:"bucket" default:"$LOGTUBED_ARCHIVE_BUCKET|"`
+		AccessKey string `yaml:"access_key" default:"$LOGTUBED_ARCHIVE_ACCESS_KEY|"`
+		SecretKey string `yaml:"secret_key" json:"-" default:"$LOGTUBED_ARCHIVE_SECRET_KEY|"`
+		PathStyle bool   `yaml:"path_style" default:"$LOGTUBED_ARCHIVE_PATH_STYLE|false"`
+		Prefix    string `yaml:"prefix" default:"$LOGTUBED_ARCHIVE_PREFIX|"`
+		MaxSize   string `yaml:"max_size" default:"$LOGTUBED_ARCHIVE_MAX_SIZE|256m"`
+		SealDelay int    `yaml:"seal_delay" default:"$LOGTUBED_ARCHIVE_SEAL_DELAY|300"`
+	} `yaml:"output_archive"`
 }
 
 // LoadOptions load options from yaml file